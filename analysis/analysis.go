@@ -0,0 +1,76 @@
+// Package analysis answers questions about a customer's stored inventory,
+// such as which instances are open to the internet, by reading entities
+// back from the store and interpreting their raw AWS data.
+package analysis
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/opsee/fieri/store"
+	"sort"
+)
+
+var (
+	ErrInstanceNotFound = errors.New("instance not found")
+	ErrGroupNotFound    = errors.New("group not found")
+)
+
+// InstanceRef identifies an instance within a customer's inventory.
+type InstanceRef struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	AccountId string `json:"account_id"`
+}
+
+type instanceRefs []*InstanceRef
+
+func (r instanceRefs) Len() int      { return len(r) }
+func (r instanceRefs) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r instanceRefs) Less(i, j int) bool {
+	if r[i].AccountId != r[j].AccountId {
+		return r[i].AccountId < r[j].AccountId
+	}
+	if r[i].Type != r[j].Type {
+		return r[i].Type < r[j].Type
+	}
+	return r[i].Id < r[j].Id
+}
+
+// getInstance gets the instance request names, translating a missing one to
+// ErrInstanceNotFound.
+func getInstance(db store.Store, request *store.InstanceRequest) (*store.InstanceResponse, error) {
+	response, err := db.GetInstance(request)
+	if err == sql.ErrNoRows {
+		return nil, ErrInstanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// getGroup gets the group request names, translating a missing one to
+// ErrGroupNotFound.
+func getGroup(db store.Store, request *store.GroupRequest) (*store.GroupResponse, error) {
+	response, err := db.GetGroup(request)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// sortedKeys returns the members of a set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
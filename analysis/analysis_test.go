@@ -0,0 +1,206 @@
+package analysis
+
+import (
+	"database/sql"
+	"github.com/opsee/fieri/importer"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+const (
+	testCustomerId = "8c3ec0e4-5a1f-4bd9-b5ff-a11b5ea7b5ad"
+	testAccountId  = "933693344490"
+)
+
+// fixtureStore serves the entities imported from fixtures, along with any
+// added by a test, as the postgres store would.
+type fixtureStore struct {
+	store.Store
+
+	instances   []*store.Instance
+	groups      []*store.Group
+	subnets     []*store.Subnet
+	routeTables []*store.RouteTable
+	dismissals  []*store.SuggestionDismissal
+}
+
+// newFixtureStore imports fixtures/<kind>.json for each kind.
+func newFixtureStore(t *testing.T, kinds ...string) *fixtureStore {
+	s := &fixtureStore{}
+	for _, kind := range kinds {
+		f, err := os.Open("../fixtures/" + kind + ".json")
+		require.NoError(t, err)
+
+		entities, err := importer.Parse(kind, testCustomerId, testAccountId, f)
+		f.Close()
+		require.NoError(t, err, kind)
+
+		for _, e := range entities {
+			s.add(e.Entity)
+		}
+	}
+
+	return s
+}
+
+func (s *fixtureStore) add(entity interface{}) {
+	switch e := entity.(type) {
+	case *store.Instance:
+		s.instances = append(s.instances, e)
+	case *store.Group:
+		s.groups = append(s.groups, e)
+	case *store.Subnet:
+		s.subnets = append(s.subnets, e)
+	case *store.RouteTable:
+		s.routeTables = append(s.routeTables, e)
+	case *store.SuggestionDismissal:
+		s.dismissals = append(s.dismissals, e)
+	}
+}
+
+func (s *fixtureStore) GetInstance(request *store.InstanceRequest) (*store.InstanceResponse, error) {
+	var found *store.Instance
+	for _, instance := range s.instances {
+		if instance.Id == request.InstanceId && instance.Type == request.Type && (request.AccountId == "" || instance.AccountId == request.AccountId) {
+			if found != nil {
+				return nil, store.ErrAmbiguousAccount
+			}
+			found = instance
+		}
+	}
+
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return instanceResponse(found), nil
+}
+
+func (s *fixtureStore) ListInstances(request *store.InstancesRequest) (*store.InstancesResponse, error) {
+	response := &store.InstancesResponse{}
+	for _, instance := range s.instances {
+		if (request.AccountId == "" || instance.AccountId == request.AccountId) && (request.Type == "" || instance.Type == request.Type) {
+			response.Instances = append(response.Instances, instanceResponse(instance))
+		}
+	}
+
+	return response, nil
+}
+
+func (s *fixtureStore) GetGroup(request *store.GroupRequest) (*store.GroupResponse, error) {
+	var found *store.Group
+	for _, group := range s.groups {
+		if group.Name == request.GroupId && group.Type == request.Type && (request.AccountId == "" || group.AccountId == request.AccountId) {
+			if found != nil {
+				return nil, store.ErrAmbiguousAccount
+			}
+			found = group
+		}
+	}
+
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return groupResponse(found), nil
+}
+
+// ListGroups counts the instances of each group as the postgres store
+// does, from the instances it was imported with and the instances imported
+// in it.
+func (s *fixtureStore) ListGroups(request *store.GroupsRequest) (*store.GroupsResponse, error) {
+	response := &store.GroupsResponse{}
+	for _, group := range s.groups {
+		if (request.Type != "" && group.Type != request.Type) || (request.AccountId != "" && group.AccountId != request.AccountId) {
+			continue
+		}
+
+		members := make(map[string]bool)
+		for _, instance := range group.Instances {
+			members[instance.Type+"/"+instance.Id] = true
+		}
+		for _, instance := range s.instances {
+			for _, g := range instance.Groups {
+				if g.Type == group.Type && g.Name == group.Name && instance.AccountId == group.AccountId {
+					members[instance.Type+"/"+instance.Id] = true
+				}
+			}
+		}
+
+		r := groupResponse(group)
+		r.InstanceCount = len(members)
+		response.Groups = append(response.Groups, r)
+	}
+
+	return response, nil
+}
+
+// ListGroupLinks links instances to the groups they were imported with, and
+// groups to the instances they were imported with.
+func (s *fixtureStore) ListGroupLinks(request *store.GroupsRequest) (*store.GroupLinksResponse, error) {
+	response := &store.GroupLinksResponse{}
+	link := func(accountId string, group *store.Group, instance *store.Instance) {
+		if (request.Type != "" && group.Type != request.Type) || (request.AccountId != "" && accountId != request.AccountId) {
+			return
+		}
+
+		response.Links = append(response.Links, &store.GroupLink{
+			AccountId:    accountId,
+			GroupType:    group.Type,
+			GroupName:    group.Name,
+			InstanceType: instance.Type,
+			InstanceId:   instance.Id,
+		})
+	}
+
+	for _, instance := range s.instances {
+		for _, group := range instance.Groups {
+			link(instance.AccountId, group, instance)
+		}
+	}
+	for _, group := range s.groups {
+		for _, instance := range group.Instances {
+			link(group.AccountId, group, instance)
+		}
+	}
+
+	return response, nil
+}
+
+func (s *fixtureStore) ListSubnets(request *store.NetworkRequest) (*store.SubnetsResponse, error) {
+	return &store.SubnetsResponse{Subnets: s.subnets}, nil
+}
+
+func (s *fixtureStore) ListRouteTables(request *store.NetworkRequest) (*store.RouteTablesResponse, error) {
+	return &store.RouteTablesResponse{RouteTables: s.routeTables}, nil
+}
+
+// ListAccounts lists the accounts of the stored instances and groups.
+func (s *fixtureStore) ListAccounts(request *store.AccountsRequest) (*store.AccountsResponse, error) {
+	seen := make(map[string]bool)
+	for _, instance := range s.instances {
+		seen[instance.AccountId] = true
+	}
+	for _, group := range s.groups {
+		seen[group.AccountId] = true
+	}
+
+	response := &store.AccountsResponse{}
+	for _, accountId := range sortedKeys(seen) {
+		response.Accounts = append(response.Accounts, &store.Account{Id: accountId, CustomerId: testCustomerId})
+	}
+
+	return response, nil
+}
+
+func (s *fixtureStore) ListSuggestionDismissals(request *store.SuggestionDismissalsRequest) (*store.SuggestionDismissalsResponse, error) {
+	return &store.SuggestionDismissalsResponse{Dismissals: s.dismissals}, nil
+}
+
+func instanceResponse(instance *store.Instance) *store.InstanceResponse {
+	return &store.InstanceResponse{Id: instance.Id, Instance: instance, AccountId: instance.AccountId, Type: instance.Type}
+}
+
+func groupResponse(group *store.Group) *store.GroupResponse {
+	return &store.GroupResponse{Id: group.Name, Group: group, AccountId: group.AccountId, Type: group.Type}
+}
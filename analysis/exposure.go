@@ -0,0 +1,408 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	"sort"
+)
+
+// worldCidrs are the ranges that match any address.
+var worldCidrs = map[string]bool{
+	"0.0.0.0/0": true,
+	"::/0":      true,
+}
+
+// protocolNames names the protocols security groups may give by number.
+var protocolNames = map[string]string{
+	"-1": "all",
+	"1":  "icmp",
+	"6":  "tcp",
+	"17": "udp",
+	"58": "icmpv6",
+}
+
+// ExposureRequest asks for the exposure of a customer's instances, in one
+// account when AccountId is set. Only instances open to the world are
+// reported unless All is set.
+type ExposureRequest struct {
+	CustomerId string `json:"customer_id"`
+	AccountId  string `json:"account_id"`
+	All        bool   `json:"all"`
+}
+
+// Exposure is an instance's effective inbound access: the union of the
+// rules of every security group applied to it. PendingGroups are applied
+// groups whose rules haven't been discovered yet, so the exposure may be
+// wider than reported. WorldOpen lists the ports open to any address, such
+// as "tcp/22", "udp/8000-8100" or "all".
+type Exposure struct {
+	Instance       *InstanceRef `json:"instance"`
+	SecurityGroups []string     `json:"security_groups"`
+	PendingGroups  []string     `json:"pending_groups,omitempty"`
+	Rules          []*Rule      `json:"rules"`
+	WorldOpen      []string     `json:"world_open"`
+}
+
+// Rule is the inbound access to a port range, merged from every applied
+// group granting it. Groups are the sources given as security groups,
+// resolved into the instances they're applied to.
+type Rule struct {
+	Protocol    string         `json:"protocol"`
+	FromPort    int64          `json:"from_port"`
+	ToPort      int64          `json:"to_port"`
+	Cidrs       []string       `json:"cidrs,omitempty"`
+	PrefixLists []string       `json:"prefix_lists,omitempty"`
+	Groups      []*GroupSource `json:"groups,omitempty"`
+	GrantedBy   []string       `json:"granted_by"`
+	WorldOpen   bool           `json:"world_open"`
+}
+
+// GroupSource is a security group allowed in by a rule, with the account
+// owning it. Instances are those of the customer's it's applied to.
+type GroupSource struct {
+	GroupId   string         `json:"group_id"`
+	AccountId string         `json:"account_id,omitempty"`
+	Instances []*InstanceRef `json:"instances"`
+}
+
+// ExposureReport is the exposure of a customer's instances. InstanceCount
+// and ExposedCount count every instance and those open to the world, whether
+// or not they're listed.
+type ExposureReport struct {
+	Instances     []*Exposure `json:"instances"`
+	InstanceCount int         `json:"instance_count"`
+	ExposedCount  int         `json:"exposed_count"`
+}
+
+// securityGroups indexes a customer's security groups by group id, along
+// with the instances each is linked to.
+type securityGroups struct {
+	groups  map[string]*opsee_aws_ec2.SecurityGroup
+	members map[string][]*InstanceRef
+	linked  map[InstanceRef][]string
+}
+
+type ruleKey struct {
+	protocol string
+	from     int64
+	to       int64
+}
+
+type ruleSources struct {
+	rule        *Rule
+	cidrs       map[string]bool
+	prefixLists map[string]bool
+	groups      map[string]*GroupSource
+	grantedBy   map[string]bool
+}
+
+// InstanceExposure computes the exposure of the instance request names.
+func InstanceExposure(db store.Store, request *store.InstanceRequest) (*Exposure, error) {
+	instance, err := getInstance(db, request)
+	if err != nil {
+		return nil, err
+	}
+
+	sg, err := loadSecurityGroups(db, request.CustomerId, request.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+
+	return sg.exposure(instance), nil
+}
+
+// CustomerExposure computes the exposure of every instance of a customer.
+// Security groups are loaded across all of the customer's accounts, since
+// rules may allow in groups of another.
+func CustomerExposure(db store.Store, request *ExposureRequest) (*ExposureReport, error) {
+	instances, err := db.ListInstances(&store.InstancesRequest{CustomerId: request.CustomerId, AccountId: request.AccountId})
+	if err != nil {
+		return nil, err
+	}
+
+	sg, err := loadSecurityGroups(db, request.CustomerId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ExposureReport{Instances: make([]*Exposure, 0)}
+	for _, instance := range instances.Instances {
+		exposure := sg.exposure(instance)
+		report.InstanceCount++
+		if len(exposure.WorldOpen) > 0 {
+			report.ExposedCount++
+		} else if !request.All {
+			continue
+		}
+
+		report.Instances = append(report.Instances, exposure)
+	}
+
+	sort.Sort(exposuresByInstance(report.Instances))
+	return report, nil
+}
+
+func loadSecurityGroups(db store.Store, customerId string, includeDeleted bool) (*securityGroups, error) {
+	request := &store.GroupsRequest{CustomerId: customerId, Type: store.SecurityGroupStoreType, IncludeDeleted: includeDeleted}
+
+	groups, err := db.ListGroups(request)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := db.ListGroupLinks(request)
+	if err != nil {
+		return nil, err
+	}
+
+	sg := &securityGroups{
+		groups:  make(map[string]*opsee_aws_ec2.SecurityGroup),
+		members: make(map[string][]*InstanceRef),
+		linked:  make(map[InstanceRef][]string),
+	}
+
+	for _, g := range groups.Groups {
+		group := &opsee_aws_ec2.SecurityGroup{}
+		if err := json.Unmarshal(g.Group.Data, group); err != nil {
+			return nil, err
+		}
+
+		// group ids are unique across accounts, but a group only referenced
+		// by an instance so far is stored as a stub without its rules, which
+		// mustn't hide the discovered group.
+		if existing, ok := sg.groups[g.Id]; ok && discovered(existing) {
+			continue
+		}
+		sg.groups[g.Id] = group
+	}
+
+	for _, link := range links.Links {
+		ref := InstanceRef{Id: link.InstanceId, Type: link.InstanceType, AccountId: link.AccountId}
+		sg.members[link.GroupName] = append(sg.members[link.GroupName], &ref)
+		sg.linked[ref] = append(sg.linked[ref], link.GroupName)
+	}
+
+	for _, members := range sg.members {
+		sort.Sort(instanceRefs(members))
+	}
+
+	return sg, nil
+}
+
+// exposure unions the inbound rules of the groups applied to an instance.
+func (sg *securityGroups) exposure(instance *store.InstanceResponse) *Exposure {
+	ref := InstanceRef{Id: instance.Id, Type: instance.Type, AccountId: instance.AccountId}
+	groupIds := sg.appliedGroups(ref, instance.Instance)
+
+	exposure := &Exposure{
+		Instance:       &ref,
+		SecurityGroups: groupIds,
+		Rules:          make([]*Rule, 0),
+		WorldOpen:      make([]string, 0),
+	}
+
+	rules := make(map[ruleKey]*ruleSources)
+	keys := make([]ruleKey, 0)
+	for _, groupId := range groupIds {
+		group, ok := sg.groups[groupId]
+		if !ok || !discovered(group) {
+			exposure.PendingGroups = append(exposure.PendingGroups, groupId)
+			continue
+		}
+
+		for _, permission := range group.IpPermissions {
+			key := permissionKey(permission)
+			sources, ok := rules[key]
+			if !ok {
+				sources = newRuleSources(key)
+				rules[key] = sources
+				keys = append(keys, key)
+			}
+
+			sources.grantedBy[groupId] = true
+			sg.addSources(sources, permission)
+		}
+	}
+
+	sort.Sort(ruleKeys(keys))
+	for _, key := range keys {
+		rule := rules[key].build()
+		exposure.Rules = append(exposure.Rules, rule)
+		if rule.WorldOpen {
+			exposure.WorldOpen = append(exposure.WorldOpen, portLabel(key))
+		}
+	}
+
+	return exposure
+}
+
+// appliedGroups returns the ids of the security groups applied to an
+// instance. They're taken from its own data when it lists any, since links
+// outlive groups being removed from an instance and rds instances' groups
+// aren't linked, and from its links otherwise.
+func (sg *securityGroups) appliedGroups(ref InstanceRef, instance *store.Instance) []string {
+	ids := make(map[string]bool)
+
+	if instance != nil {
+		switch ref.Type {
+		case store.InstanceStoreType:
+			data := &opsee_aws_ec2.Instance{}
+			if json.Unmarshal(instance.Data, data) == nil {
+				for _, group := range data.SecurityGroups {
+					if group.GroupId != nil {
+						ids[*group.GroupId] = true
+					}
+				}
+			}
+
+		case store.DBInstanceStoreType:
+			data := &opsee_aws_rds.DBInstance{}
+			if json.Unmarshal(instance.Data, data) == nil {
+				for _, group := range data.VpcSecurityGroups {
+					if group.VpcSecurityGroupId != nil {
+						ids[*group.VpcSecurityGroupId] = true
+					}
+				}
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		for _, groupId := range sg.linked[ref] {
+			ids[groupId] = true
+		}
+	}
+
+	return sortedKeys(ids)
+}
+
+// addSources adds a permission's sources to a rule, resolving the groups it
+// allows in into their instances.
+func (sg *securityGroups) addSources(sources *ruleSources, permission *opsee_aws_ec2.IpPermission) {
+	for _, ipRange := range permission.IpRanges {
+		if ipRange.CidrIp != nil {
+			sources.cidrs[*ipRange.CidrIp] = true
+		}
+	}
+
+	for _, prefixList := range permission.PrefixListIds {
+		if prefixList.PrefixListId != nil {
+			sources.prefixLists[*prefixList.PrefixListId] = true
+		}
+	}
+
+	for _, pair := range permission.UserIdGroupPairs {
+		groupId := aws.StringValue(pair.GroupId)
+		if groupId == "" || sources.groups[groupId] != nil {
+			continue
+		}
+
+		source := &GroupSource{GroupId: groupId, AccountId: aws.StringValue(pair.UserId), Instances: sg.members[groupId]}
+		if source.Instances == nil {
+			source.Instances = make([]*InstanceRef, 0)
+		}
+
+		sources.groups[groupId] = source
+	}
+}
+
+func newRuleSources(key ruleKey) *ruleSources {
+	return &ruleSources{
+		rule:        &Rule{Protocol: key.protocol, FromPort: key.from, ToPort: key.to},
+		cidrs:       make(map[string]bool),
+		prefixLists: make(map[string]bool),
+		groups:      make(map[string]*GroupSource),
+		grantedBy:   make(map[string]bool),
+	}
+}
+
+func (s *ruleSources) build() *Rule {
+	rule := s.rule
+	rule.Cidrs = sortedKeys(s.cidrs)
+	rule.PrefixLists = sortedKeys(s.prefixLists)
+	rule.GrantedBy = sortedKeys(s.grantedBy)
+
+	for cidr := range s.cidrs {
+		if worldCidrs[cidr] {
+			rule.WorldOpen = true
+		}
+	}
+
+	groupIds := make(map[string]bool, len(s.groups))
+	for groupId := range s.groups {
+		groupIds[groupId] = true
+	}
+	for _, groupId := range sortedKeys(groupIds) {
+		rule.Groups = append(rule.Groups, s.groups[groupId])
+	}
+
+	return rule
+}
+
+// permissionKey normalizes a permission's protocol and ports, so that the
+// same access granted by different groups merges into one rule. Rules for
+// all protocols, and tcp or udp rules without ports, cover every port.
+func permissionKey(permission *opsee_aws_ec2.IpPermission) ruleKey {
+	protocol := aws.StringValue(permission.IpProtocol)
+	if name, ok := protocolNames[protocol]; ok {
+		protocol = name
+	}
+
+	if protocol == "all" || permission.FromPort == nil || permission.ToPort == nil {
+		if protocol == "icmp" || protocol == "icmpv6" {
+			return ruleKey{protocol, -1, -1}
+		}
+		return ruleKey{protocol, 0, 65535}
+	}
+
+	return ruleKey{protocol, *permission.FromPort, *permission.ToPort}
+}
+
+// portLabel describes a rule's ports, e.g. "tcp/22", "tcp/8000-8100", or
+// only the protocol when it covers every port. Icmp rules give a type
+// rather than ports.
+func portLabel(key ruleKey) string {
+	switch {
+	case key.protocol == "all":
+		return "all"
+	case key.from == -1 || (key.from == 0 && key.to == 65535):
+		return key.protocol
+	case key.from == key.to || key.protocol == "icmp" || key.protocol == "icmpv6":
+		return fmt.Sprintf("%s/%d", key.protocol, key.from)
+	default:
+		return fmt.Sprintf("%s/%d-%d", key.protocol, key.from, key.to)
+	}
+}
+
+// discovered reports whether a group's own description has been stored,
+// rather than only the stub of an instance referencing it, which lacks an
+// owner.
+func discovered(group *opsee_aws_ec2.SecurityGroup) bool {
+	return group.OwnerId != nil
+}
+
+type ruleKeys []ruleKey
+
+func (k ruleKeys) Len() int      { return len(k) }
+func (k ruleKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k ruleKeys) Less(i, j int) bool {
+	if k[i].protocol != k[j].protocol {
+		return k[i].protocol < k[j].protocol
+	}
+	if k[i].from != k[j].from {
+		return k[i].from < k[j].from
+	}
+	return k[i].to < k[j].to
+}
+
+type exposuresByInstance []*Exposure
+
+func (e exposuresByInstance) Len() int      { return len(e) }
+func (e exposuresByInstance) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e exposuresByInstance) Less(i, j int) bool {
+	return instanceRefs{e[i].Instance, e[j].Instance}.Less(0, 1)
+}
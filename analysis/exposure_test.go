@@ -0,0 +1,109 @@
+package analysis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCustomerExposure(t *testing.T) {
+	db := newFixtureStore(t, "security-groups", "instances", "db-instances")
+
+	// an instance in a group that hasn't been described yet.
+	pending, err := store.NewInstance(testCustomerId, testAccountId, &opsee_aws_ec2.Instance{
+		InstanceId:     aws.String("i-0bd6e7c1"),
+		SecurityGroups: []*opsee_aws_ec2.GroupIdentifier{{GroupId: aws.String("sg-0d5c1e2f")}},
+	})
+	require.NoError(t, err)
+	db.add(pending)
+
+	report, err := CustomerExposure(db, &ExposureRequest{CustomerId: testCustomerId, All: true})
+	require.NoError(t, err)
+	assert.Equal(t, 10, report.InstanceCount)
+	assert.Equal(t, 2, report.ExposedCount)
+
+	exposures := make(map[string]*Exposure)
+	for _, exposure := range report.Instances {
+		exposures[exposure.Instance.Id] = exposure
+	}
+
+	cluster := []string{"i-20f122e5", "i-38aae6fa", "i-39aae6fb", "i-822ff347"}
+	tests := []struct {
+		name      string
+		instance  string
+		worldOpen []string
+		pending   []string
+		// groups are the instances of each group a rule allows in, by the
+		// rule's ports.
+		groups map[string]map[string][]string
+	}{
+		{
+			name:      "open to everything",
+			instance:  "i-8dd40a48",
+			worldOpen: []string{"all"},
+		},
+		{
+			name:      "open on some ports",
+			instance:  "i-301674fb",
+			worldOpen: []string{"tcp/22", "tcp/443", "tcp/943", "udp/1194"},
+		},
+		{
+			name:      "only open to groups",
+			instance:  "i-39aae6fb",
+			worldOpen: []string{},
+			groups: map[string]map[string][]string{
+				"all":    {"sg-c852dbad": cluster, "sg-df6de4ba": {"i-301674fb"}},
+				"tcp/22": {"sg-52a42237": {}},
+				"tcp/80": {"sg-5f65e13a": {}},
+			},
+		},
+		{
+			name:      "rds instance",
+			instance:  "beta-auth",
+			worldOpen: []string{},
+			groups: map[string]map[string][]string{
+				"tcp/5432": {"sg-c852dbad": cluster, "sg-df6de4ba": {"i-301674fb"}},
+			},
+		},
+		{
+			name:      "undiscovered group",
+			instance:  "i-0bd6e7c1",
+			worldOpen: []string{},
+			pending:   []string{"sg-0d5c1e2f"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exposure, ok := exposures[test.instance]
+			require.True(t, ok, "exposure of %s", test.instance)
+
+			assert.Equal(t, test.worldOpen, exposure.WorldOpen)
+			assert.Equal(t, test.pending, exposure.PendingGroups)
+
+			rules := make(map[string]*Rule)
+			for _, rule := range exposure.Rules {
+				rules[portLabel(ruleKey{rule.Protocol, rule.FromPort, rule.ToPort})] = rule
+			}
+
+			for label, groups := range test.groups {
+				rule, ok := rules[label]
+				if !assert.True(t, ok, "rule for %s", label) {
+					continue
+				}
+
+				resolved := make(map[string][]string)
+				for _, group := range rule.Groups {
+					resolved[group.GroupId] = make([]string, 0)
+					for _, instance := range group.Instances {
+						resolved[group.GroupId] = append(resolved[group.GroupId], instance.Id)
+					}
+				}
+				assert.Equal(t, groups, resolved, "groups allowed %s", label)
+			}
+		})
+	}
+}
@@ -0,0 +1,630 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// the results of each step of a reachability check.
+const (
+	Allowed = "allowed"
+	Blocked = "blocked"
+	Unknown = "unknown"
+)
+
+// ReachabilityRequest asks whether traffic can get from an instance to an
+// instance or load balancer on a tcp or udp port. Entities are looked up in
+// AccountId when it's set.
+type ReachabilityRequest struct {
+	CustomerId string     `json:"customer_id"`
+	AccountId  string     `json:"account_id"`
+	From       *EntityRef `json:"from"`
+	To         *EntityRef `json:"to"`
+	Protocol   string     `json:"protocol"`
+	Port       int64      `json:"port"`
+}
+
+// EntityRef names an instance or group by its store type and id, in
+// AccountId when it's set.
+type EntityRef struct {
+	AccountId string `json:"account_id,omitempty"`
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+}
+
+// accountIdPattern matches aws account ids, which prefix entity references
+// to entities of customers with more than one account.
+var accountIdPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// Reachability is the answer to a ReachabilityRequest, with each step taken
+// to reach it. Traffic is only Reachable when every step allows it. When a
+// step couldn't be evaluated for lack of data and none blocks the traffic,
+// the answer isn't Conclusive.
+type Reachability struct {
+	From       *Endpoint `json:"from"`
+	To         *Endpoint `json:"to"`
+	Protocol   string    `json:"protocol"`
+	Port       int64     `json:"port"`
+	Reachable  bool      `json:"reachable"`
+	Conclusive bool      `json:"conclusive"`
+	Steps      []*Step   `json:"steps"`
+}
+
+// Endpoint is an end of a reachability check as the network sees it.
+// Address is only known for ec2 instances; other endpoints are placed by
+// their subnets.
+type Endpoint struct {
+	Type           string   `json:"type"`
+	Id             string   `json:"id"`
+	AccountId      string   `json:"account_id"`
+	VpcId          string   `json:"vpc_id,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	Subnets        []string `json:"subnets"`
+	SecurityGroups []string `json:"security_groups"`
+
+	networks  []*net.IPNet
+	listeners []*opsee_aws_elb.Listener
+	port      int64
+}
+
+// Step is a check on the way between two endpoints, with the security
+// group, route table or other entity that allowed or blocked the traffic.
+type Step struct {
+	Check       string `json:"check"`
+	Result      string `json:"result"`
+	Entity      string `json:"entity,omitempty"`
+	Explanation string `json:"explanation"`
+}
+
+// network holds the customer's entities a reachability check reads.
+type network struct {
+	sg          *securityGroups
+	subnets     map[string]*opsee_aws_ec2.Subnet
+	routeTables []*opsee_aws_ec2.RouteTable
+}
+
+// ParseEntityRef parses a "type/id" reference such as "elb/my-lb", taking an
+// id alone, such as "i-123", as an ec2 instance. The reference may start
+// with an account id, as in "933693344490/elb/my-lb".
+func ParseEntityRef(ref string) (*EntityRef, error) {
+	accountId := ""
+	if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 && accountIdPattern.MatchString(parts[0]) {
+		accountId, ref = parts[0], parts[1]
+	}
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 1 {
+		parts = []string{store.InstanceStoreType, parts[0]}
+	}
+
+	if parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("malformed entity reference: %q", ref)
+	}
+
+	return &EntityRef{AccountId: accountId, Type: parts[0], Id: parts[1]}, nil
+}
+
+// Reach checks whether traffic can get between the request's entities,
+// evaluating in turn their subnets, the source's security group egress, the
+// routes between their subnets both ways, the destination's security group
+// ingress, and for load balancers and rds instances whether they listen on
+// the port. Network ACLs aren't discovered, so aren't evaluated.
+func Reach(db store.Store, request *ReachabilityRequest) (*Reachability, error) {
+	n, err := loadNetwork(db, request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := n.resolve(db, request, request.From)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := n.resolve(db, request, request.To)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []*Step{
+		n.locate(from),
+		n.locate(to),
+		n.groupCheck("egress", from, to, request.Protocol, request.Port),
+		n.route("route", from, to),
+		n.route("return route", to, from),
+		n.groupCheck("ingress", to, from, request.Protocol, request.Port),
+	}
+	if step := listen(to, request.Protocol, request.Port); step != nil {
+		steps = append(steps, step)
+	}
+
+	reachability := &Reachability{
+		From:     from,
+		To:       to,
+		Protocol: request.Protocol,
+		Port:     request.Port,
+		Steps:    steps,
+	}
+
+	var blocked, unknown bool
+	for _, step := range steps {
+		switch step.Result {
+		case Blocked:
+			blocked = true
+		case Unknown:
+			unknown = true
+		}
+	}
+	reachability.Reachable = !blocked && !unknown
+	reachability.Conclusive = blocked || !unknown
+
+	return reachability, nil
+}
+
+func loadNetwork(db store.Store, customerId string) (*network, error) {
+	sg, err := loadSecurityGroups(db, customerId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	subnets, err := db.ListSubnets(&store.NetworkRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, err
+	}
+
+	routeTables, err := db.ListRouteTables(&store.NetworkRequest{CustomerId: customerId})
+	if err != nil {
+		return nil, err
+	}
+
+	n := &network{
+		sg:          sg,
+		subnets:     make(map[string]*opsee_aws_ec2.Subnet, len(subnets.Subnets)),
+		routeTables: make([]*opsee_aws_ec2.RouteTable, 0, len(routeTables.RouteTables)),
+	}
+
+	for _, s := range subnets.Subnets {
+		subnet := &opsee_aws_ec2.Subnet{}
+		if err := json.Unmarshal(s.Data, subnet); err != nil {
+			return nil, err
+		}
+		n.subnets[s.Id] = subnet
+	}
+
+	for _, rt := range routeTables.RouteTables {
+		routeTable := &opsee_aws_ec2.RouteTable{}
+		if err := json.Unmarshal(rt.Data, routeTable); err != nil {
+			return nil, err
+		}
+		n.routeTables = append(n.routeTables, routeTable)
+	}
+
+	return n, nil
+}
+
+// resolve looks up the entity ref names and places it in the network.
+func (n *network) resolve(db store.Store, request *ReachabilityRequest, ref *EntityRef) (*Endpoint, error) {
+	endpoint := &Endpoint{Type: ref.Type, Id: ref.Id}
+	accountId := request.AccountId
+	if ref.AccountId != "" {
+		accountId = ref.AccountId
+	}
+
+	switch ref.Type {
+	case store.InstanceStoreType, store.DBInstanceStoreType:
+		instance, err := getInstance(db, &store.InstanceRequest{CustomerId: request.CustomerId, AccountId: accountId, InstanceId: ref.Id, Type: ref.Type})
+		if err != nil {
+			return nil, err
+		}
+
+		endpoint.AccountId = instance.AccountId
+		endpoint.SecurityGroups = n.sg.appliedGroups(InstanceRef{Id: instance.Id, Type: instance.Type, AccountId: instance.AccountId}, instance.Instance)
+
+		if ref.Type == store.InstanceStoreType {
+			data := &opsee_aws_ec2.Instance{}
+			if err := json.Unmarshal(instance.Instance.Data, data); err != nil {
+				return nil, err
+			}
+
+			endpoint.VpcId = aws.StringValue(data.VpcId)
+			endpoint.Address = aws.StringValue(data.PrivateIpAddress)
+			if data.SubnetId != nil {
+				endpoint.Subnets = []string{*data.SubnetId}
+			}
+		} else {
+			data := &opsee_aws_rds.DBInstance{}
+			if err := json.Unmarshal(instance.Instance.Data, data); err != nil {
+				return nil, err
+			}
+
+			if data.DBSubnetGroup != nil {
+				endpoint.VpcId = aws.StringValue(data.DBSubnetGroup.VpcId)
+				for _, subnet := range data.DBSubnetGroup.Subnets {
+					if subnet.SubnetIdentifier != nil {
+						endpoint.Subnets = append(endpoint.Subnets, *subnet.SubnetIdentifier)
+					}
+				}
+			}
+			if data.Endpoint != nil {
+				endpoint.port = aws.Int64Value(data.Endpoint.Port)
+			}
+		}
+
+	case store.ELBStoreType:
+		group, err := getGroup(db, &store.GroupRequest{CustomerId: request.CustomerId, AccountId: accountId, GroupId: ref.Id, Type: ref.Type})
+		if err != nil {
+			return nil, err
+		}
+
+		data := &opsee_aws_elb.LoadBalancerDescription{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return nil, err
+		}
+
+		endpoint.AccountId = group.AccountId
+		endpoint.VpcId = aws.StringValue(data.VPCId)
+		endpoint.Subnets = data.Subnets
+		endpoint.SecurityGroups = data.SecurityGroups
+		for _, listener := range data.ListenerDescriptions {
+			if listener.Listener != nil {
+				endpoint.listeners = append(endpoint.listeners, listener.Listener)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported reachability endpoint type: %s", ref.Type)
+	}
+
+	if endpoint.Subnets == nil {
+		endpoint.Subnets = make([]string, 0)
+	}
+	if endpoint.SecurityGroups == nil {
+		endpoint.SecurityGroups = make([]string, 0)
+	}
+
+	if ip := net.ParseIP(endpoint.Address); ip != nil {
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		endpoint.networks = []*net.IPNet{{IP: ip, Mask: net.CIDRMask(bits, bits)}}
+	} else {
+		for _, subnetId := range endpoint.Subnets {
+			if subnet, ok := n.subnets[subnetId]; ok {
+				if _, network, err := net.ParseCIDR(aws.StringValue(subnet.CidrBlock)); err == nil {
+					endpoint.networks = append(endpoint.networks, network)
+				}
+			}
+		}
+	}
+
+	return endpoint, nil
+}
+
+// locate places an endpoint in its subnets. It can't be placed when it has
+// no address and none of its subnets have been discovered.
+func (n *network) locate(e *Endpoint) *Step {
+	step := &Step{Check: "subnet", Entity: strings.Join(e.Subnets, ", ")}
+
+	if len(e.Subnets) == 0 {
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("%s %s isn't in a vpc subnet.", e.Type, e.Id)
+		return step
+	}
+
+	located := make([]string, 0, len(e.Subnets))
+	for _, subnetId := range e.Subnets {
+		if subnet, ok := n.subnets[subnetId]; ok {
+			located = append(located, fmt.Sprintf("%s (%s)", subnetId, aws.StringValue(subnet.CidrBlock)))
+		} else {
+			located = append(located, subnetId)
+		}
+	}
+
+	if len(e.networks) == 0 {
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("%s %s is in %s, which haven't been discovered, so its addresses aren't known.", e.Type, e.Id, strings.Join(located, ", "))
+		return step
+	}
+
+	at := ""
+	if e.Address != "" {
+		at = " at " + e.Address
+	}
+
+	step.Result = Allowed
+	step.Explanation = fmt.Sprintf("%s %s%s is in %s of %s.", e.Type, e.Id, at, strings.Join(located, ", "), e.VpcId)
+	return step
+}
+
+// groupCheck checks whether e's security groups let traffic out to peer, for
+// egress, or in from it, for ingress, either by a cidr covering the peer's
+// address or one of its subnets, or by naming one of its groups.
+func (n *network) groupCheck(check string, e, peer *Endpoint, protocol string, port int64) *Step {
+	step := &Step{Check: check}
+	direction := "in from"
+	if check == "egress" {
+		direction = "out to"
+	}
+
+	peerGroups := make(map[string]bool, len(peer.SecurityGroups))
+	for _, groupId := range peer.SecurityGroups {
+		peerGroups[groupId] = true
+	}
+
+	pending := make([]string, 0)
+	for _, groupId := range e.SecurityGroups {
+		group, ok := n.sg.groups[groupId]
+		if !ok || !discovered(group) {
+			pending = append(pending, groupId)
+			continue
+		}
+
+		permissions := group.IpPermissions
+		if check == "egress" {
+			permissions = group.IpPermissionsEgress
+		}
+
+		for _, permission := range permissions {
+			if !permits(permission, protocol, port) {
+				continue
+			}
+
+			if source := matchPeer(permission, peer, peerGroups); source != "" {
+				step.Result = Allowed
+				step.Entity = groupId
+				step.Explanation = fmt.Sprintf("%s allows %s/%d %s %s.", groupId, protocol, port, direction, source)
+				return step
+			}
+		}
+	}
+
+	switch {
+	case len(e.SecurityGroups) == 0:
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("%s %s has no known security groups.", e.Type, e.Id)
+	case len(pending) > 0:
+		step.Result = Unknown
+		step.Entity = strings.Join(pending, ", ")
+		step.Explanation = fmt.Sprintf("No discovered security group of %s %s allows %s/%d %s %s %s, and %s haven't been discovered.", e.Type, e.Id, protocol, port, direction, peer.Type, peer.Id, step.Entity)
+	case len(peer.networks) == 0:
+		step.Result = Unknown
+		step.Entity = strings.Join(e.SecurityGroups, ", ")
+		step.Explanation = fmt.Sprintf("No security group of %s %s allows %s/%d %s %s %s's groups, and its address isn't known to check cidrs against.", e.Type, e.Id, protocol, port, direction, peer.Type, peer.Id)
+	default:
+		step.Result = Blocked
+		step.Entity = strings.Join(e.SecurityGroups, ", ")
+		step.Explanation = fmt.Sprintf("None of %s allow %s/%d %s %s %s.", step.Entity, protocol, port, direction, peer.Type, peer.Id)
+	}
+
+	return step
+}
+
+// route checks that the route table of one of from's subnets routes traffic
+// to to. Subnets of one vpc always reach each other through its local route;
+// between vpcs only peering connections are followed.
+func (n *network) route(check string, from, to *Endpoint) *Step {
+	step := &Step{Check: check}
+
+	if from.VpcId == "" || to.VpcId == "" {
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("The vpcs of %s %s and %s %s aren't both known.", from.Type, from.Id, to.Type, to.Id)
+		return step
+	}
+
+	if from.VpcId == to.VpcId {
+		step.Result = Allowed
+		step.Entity = from.VpcId
+		step.Explanation = fmt.Sprintf("%s %s and %s %s are both in %s, connected by its local route.", from.Type, from.Id, to.Type, to.Id, from.VpcId)
+		return step
+	}
+
+	if len(to.networks) == 0 {
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("The address of %s %s isn't known to route to.", to.Type, to.Id)
+		return step
+	}
+
+	var fallback *Step
+	for _, subnetId := range from.Subnets {
+		s := n.subnetRoute(check, subnetId, from.VpcId, to)
+		if s.Result == Allowed {
+			return s
+		}
+		if fallback == nil || s.Result == Blocked {
+			fallback = s
+		}
+	}
+
+	if fallback == nil {
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("%s %s isn't in a vpc subnet.", from.Type, from.Id)
+		return step
+	}
+
+	return fallback
+}
+
+// subnetRoute follows the most specific route to to in a subnet's route
+// table: the one associated with it, or the main table of its vpc.
+func (n *network) subnetRoute(check, subnetId, vpcId string, to *Endpoint) *Step {
+	step := &Step{Check: check}
+
+	routeTable := n.routeTable(subnetId, vpcId)
+	if routeTable == nil {
+		step.Result = Unknown
+		step.Entity = subnetId
+		step.Explanation = fmt.Sprintf("No route table of %s has been discovered.", subnetId)
+		return step
+	}
+
+	routeTableId := aws.StringValue(routeTable.RouteTableId)
+	step.Entity = routeTableId
+
+	var (
+		best     *opsee_aws_ec2.Route
+		bestOnes = -1
+	)
+	for _, route := range routeTable.Routes {
+		_, destination, err := net.ParseCIDR(aws.StringValue(route.DestinationCidrBlock))
+		if err != nil {
+			continue
+		}
+
+		ones, _ := destination.Mask.Size()
+		if ones > bestOnes && coversAny(destination, to.networks) {
+			best, bestOnes = route, ones
+		}
+	}
+
+	destination := fmt.Sprintf("%s %s", to.Type, to.Id)
+	switch {
+	case best == nil:
+		step.Result = Blocked
+		step.Explanation = fmt.Sprintf("%s has no route to %s.", routeTableId, destination)
+	case aws.StringValue(best.State) == "blackhole":
+		step.Result = Blocked
+		step.Explanation = fmt.Sprintf("%s routes %s to %s, which is a blackhole.", routeTableId, aws.StringValue(best.DestinationCidrBlock), routeTarget(best))
+	case best.VpcPeeringConnectionId != nil:
+		step.Result = Allowed
+		step.Entity = routeTableId + ", " + *best.VpcPeeringConnectionId
+		step.Explanation = fmt.Sprintf("%s routes %s to %s through peering connection %s.", routeTableId, aws.StringValue(best.DestinationCidrBlock), to.VpcId, *best.VpcPeeringConnectionId)
+	case aws.StringValue(best.GatewayId) == "local":
+		step.Result = Blocked
+		step.Explanation = fmt.Sprintf("%s routes %s locally within %s rather than to %s.", routeTableId, aws.StringValue(best.DestinationCidrBlock), vpcId, to.VpcId)
+	default:
+		step.Result = Unknown
+		step.Explanation = fmt.Sprintf("%s routes %s through %s; reachability beyond it isn't evaluated.", routeTableId, aws.StringValue(best.DestinationCidrBlock), routeTarget(best))
+	}
+
+	return step
+}
+
+// routeTable returns the route table associated with a subnet, or the main
+// table of its vpc when there's none.
+func (n *network) routeTable(subnetId, vpcId string) *opsee_aws_ec2.RouteTable {
+	var main *opsee_aws_ec2.RouteTable
+	for _, routeTable := range n.routeTables {
+		for _, association := range routeTable.Associations {
+			if aws.StringValue(association.SubnetId) == subnetId {
+				return routeTable
+			}
+			if aws.BoolValue(association.Main) && aws.StringValue(routeTable.VpcId) == vpcId {
+				main = routeTable
+			}
+		}
+	}
+
+	return main
+}
+
+// listen checks that a load balancer or rds instance listens on the port.
+// Whether an ec2 instance does isn't known.
+func listen(to *Endpoint, protocol string, port int64) *Step {
+	step := &Step{Check: "listener", Entity: to.Id}
+
+	switch to.Type {
+	case store.ELBStoreType:
+		ports := make([]string, 0, len(to.listeners))
+		for _, listener := range to.listeners {
+			if protocol == "tcp" && aws.Int64Value(listener.LoadBalancerPort) == port {
+				step.Result = Allowed
+				step.Explanation = fmt.Sprintf("%s listens on %d, forwarding to instance port %d.", to.Id, port, aws.Int64Value(listener.InstancePort))
+				return step
+			}
+			ports = append(ports, fmt.Sprint(aws.Int64Value(listener.LoadBalancerPort)))
+		}
+
+		step.Result = Blocked
+		if len(ports) == 0 {
+			step.Explanation = fmt.Sprintf("%s has no listeners.", to.Id)
+		} else {
+			step.Explanation = fmt.Sprintf("%s has no %s listener on %d, only on %s.", to.Id, protocol, port, strings.Join(ports, ", "))
+		}
+		return step
+
+	case store.DBInstanceStoreType:
+		if to.port == 0 {
+			step.Result = Unknown
+			step.Explanation = fmt.Sprintf("The port %s listens on isn't known.", to.Id)
+		} else if protocol == "tcp" && to.port == port {
+			step.Result = Allowed
+			step.Explanation = fmt.Sprintf("%s listens on %d.", to.Id, port)
+		} else {
+			step.Result = Blocked
+			step.Explanation = fmt.Sprintf("%s listens on tcp/%d, not %s/%d.", to.Id, to.port, protocol, port)
+		}
+		return step
+	}
+
+	return nil
+}
+
+// permits reports whether a permission covers a protocol and port.
+func permits(permission *opsee_aws_ec2.IpPermission, protocol string, port int64) bool {
+	key := permissionKey(permission)
+	if key.protocol == "all" {
+		return true
+	}
+
+	return key.protocol == protocol && key.from <= port && port <= key.to
+}
+
+// matchPeer describes how a permission matches a peer: by a cidr covering
+// one of its networks, or any address, or by one of its security groups.
+// It's empty when the permission doesn't match.
+func matchPeer(permission *opsee_aws_ec2.IpPermission, peer *Endpoint, peerGroups map[string]bool) string {
+	for _, pair := range permission.UserIdGroupPairs {
+		if groupId := aws.StringValue(pair.GroupId); peerGroups[groupId] {
+			return fmt.Sprintf("members of %s", groupId)
+		}
+	}
+
+	for _, ipRange := range permission.IpRanges {
+		cidr := aws.StringValue(ipRange.CidrIp)
+		if worldCidrs[cidr] {
+			return cidr
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		if coversAny(network, peer.networks) {
+			return cidr
+		}
+	}
+
+	return ""
+}
+
+// coversAny reports whether network contains the whole of any of networks.
+func coversAny(network *net.IPNet, networks []*net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, n := range networks {
+		nOnes, nBits := n.Mask.Size()
+		if bits == nBits && ones <= nOnes && network.Contains(n.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func routeTarget(route *opsee_aws_ec2.Route) string {
+	for _, target := range []*string{route.GatewayId, route.NatGatewayId, route.InstanceId, route.NetworkInterfaceId, route.VpcPeeringConnectionId} {
+		if target != nil {
+			return *target
+		}
+	}
+
+	return "an unknown target"
+}
@@ -0,0 +1,294 @@
+package analysis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// reachStore serves the fixtures, where instances and load balancers are in
+// vpc-79b1491c and the subnets and route tables in vpc-b5f3a4d0, along with
+// entities added to reach across the two.
+func reachStore(t *testing.T, entities ...interface{}) *fixtureStore {
+	db := newFixtureStore(t, "security-groups", "instances", "db-instances", "load-balancers", "subnets", "route-tables")
+
+	// an instance in vpc-b5f3a4d0, open both ways to everything.
+	peer, err := store.NewInstance(testCustomerId, testAccountId, &opsee_aws_ec2.Instance{
+		InstanceId:       aws.String("i-5c0e4f2a"),
+		VpcId:            aws.String("vpc-b5f3a4d0"),
+		SubnetId:         aws.String("subnet-50760c27"),
+		PrivateIpAddress: aws.String("172.30.1.10"),
+		SecurityGroups:   []*opsee_aws_ec2.GroupIdentifier{{GroupId: aws.String("sg-92a4d9f7")}},
+	})
+	require.NoError(t, err)
+	db.add(peer)
+
+	for _, entity := range entities {
+		db.add(entity)
+	}
+
+	return db
+}
+
+func testSubnet(t *testing.T, subnetId, vpcId, cidr string) *store.Subnet {
+	subnet, err := store.NewSubnet(testCustomerId, testAccountId, &opsee_aws_ec2.Subnet{SubnetId: aws.String(subnetId), VpcId: aws.String(vpcId), CidrBlock: aws.String(cidr)})
+	require.NoError(t, err)
+	return subnet
+}
+
+// testRouteTable returns a route table of vpcId associated with subnetId, or
+// its main table when subnetId is empty.
+func testRouteTable(t *testing.T, routeTableId, vpcId, subnetId string, routes ...*opsee_aws_ec2.Route) *store.RouteTable {
+	association := &opsee_aws_ec2.RouteTableAssociation{Main: aws.Bool(true)}
+	if subnetId != "" {
+		association = &opsee_aws_ec2.RouteTableAssociation{Main: aws.Bool(false), SubnetId: aws.String(subnetId)}
+	}
+
+	routeTable, err := store.NewRouteTable(testCustomerId, testAccountId, &opsee_aws_ec2.RouteTable{
+		RouteTableId: aws.String(routeTableId),
+		VpcId:        aws.String(vpcId),
+		Associations: []*opsee_aws_ec2.RouteTableAssociation{association},
+		Routes:       routes,
+	})
+	require.NoError(t, err)
+	return routeTable
+}
+
+func peeringRoute(cidr, state string) *opsee_aws_ec2.Route {
+	return &opsee_aws_ec2.Route{DestinationCidrBlock: aws.String(cidr), VpcPeeringConnectionId: aws.String("pcx-4e1b2c27"), State: aws.String(state)}
+}
+
+func localRoute(cidr string) *opsee_aws_ec2.Route {
+	return &opsee_aws_ec2.Route{DestinationCidrBlock: aws.String(cidr), GatewayId: aws.String("local"), State: aws.String("active")}
+}
+
+func TestReach(t *testing.T) {
+	// the subnets of vpc-79b1491c, so its load balancers can be placed.
+	subnets := []interface{}{
+		testSubnet(t, "subnet-eccedfaa", "vpc-79b1491c", "172.31.0.0/20"),
+		testSubnet(t, "subnet-0378a966", "vpc-79b1491c", "172.31.16.0/20"),
+	}
+
+	unlistened, err := store.NewGroup(testCustomerId, testAccountId, &opsee_aws_elb.LoadBalancerDescription{
+		LoadBalancerName: aws.String("draining-lb"),
+		VPCId:            aws.String("vpc-79b1491c"),
+		Subnets:          []string{"subnet-eccedfaa"},
+		SecurityGroups:   []string{"sg-ac528bc9"},
+	})
+	require.NoError(t, err)
+
+	returnRoute := testRouteTable(t, "rtb-3a7f0c11", "vpc-79b1491c", "", localRoute("172.31.0.0/16"), peeringRoute("172.30.0.0/16", "active"))
+
+	type step struct {
+		result      string
+		entity      string
+		explanation string
+	}
+
+	tests := []struct {
+		name       string
+		entities   []interface{}
+		from, to   string
+		protocol   string
+		port       int64
+		reachable  bool
+		conclusive bool
+		steps      map[string]step
+	}{
+		{
+			name:       "load balancer in the same vpc",
+			entities:   subnets,
+			from:       "i-301674fb",
+			to:         "elb/api-lb",
+			protocol:   "tcp",
+			port:       80,
+			reachable:  true,
+			conclusive: true,
+			steps: map[string]step{
+				"route":    {result: Allowed, entity: "vpc-79b1491c"},
+				"ingress":  {result: Allowed, entity: "sg-ac528bc9"},
+				"listener": {result: Allowed, explanation: "api-lb listens on 80, forwarding to instance port 8080."},
+			},
+		},
+		{
+			name:       "load balancer not listening",
+			entities:   subnets,
+			from:       "i-301674fb",
+			to:         "elb/api-lb",
+			protocol:   "tcp",
+			port:       443,
+			conclusive: true,
+			steps: map[string]step{
+				"ingress":  {result: Blocked, entity: "sg-ac528bc9"},
+				"listener": {result: Blocked, explanation: "api-lb has no tcp listener on 443, only on 4080, 80."},
+			},
+		},
+		{
+			name:       "load balancer without listeners",
+			entities:   append([]interface{}{unlistened}, subnets...),
+			from:       "i-301674fb",
+			to:         "elb/draining-lb",
+			protocol:   "tcp",
+			port:       80,
+			conclusive: true,
+			steps: map[string]step{
+				"ingress":  {result: Allowed},
+				"listener": {result: Blocked, explanation: "draining-lb has no listeners."},
+			},
+		},
+		{
+			name:       "rds instance by its group",
+			entities:   subnets,
+			from:       "i-39aae6fb",
+			to:         "rds/beta-auth",
+			protocol:   "tcp",
+			port:       5432,
+			reachable:  true,
+			conclusive: true,
+			steps: map[string]step{
+				"ingress":  {result: Allowed, explanation: "sg-d39a43b6 allows tcp/5432 in from members of sg-c852dbad."},
+				"listener": {result: Allowed},
+			},
+		},
+		{
+			name:     "undiscovered subnets are unknown",
+			from:     "i-301674fb",
+			to:       "elb/api-lb",
+			protocol: "tcp",
+			port:     80,
+			steps: map[string]step{
+				"subnet":   {result: Unknown, entity: "subnet-0378a966, subnet-eccedfaa"},
+				"ingress":  {result: Allowed},
+				"listener": {result: Allowed},
+			},
+		},
+		{
+			name:       "blocked is conclusive despite unknowns",
+			from:       "i-301674fb",
+			to:         "elb/api-lb",
+			protocol:   "tcp",
+			port:       443,
+			conclusive: true,
+			steps: map[string]step{
+				"subnet":  {result: Unknown},
+				"ingress": {result: Blocked},
+			},
+		},
+		{
+			name:     "main route table through a gateway",
+			from:     "i-5c0e4f2a",
+			to:       "i-8dd40a48",
+			protocol: "tcp",
+			port:     22,
+			steps: map[string]step{
+				"egress":       {result: Allowed, entity: "sg-92a4d9f7"},
+				"route":        {result: Unknown, entity: "rtb-f0085195", explanation: "rtb-f0085195 routes 0.0.0.0/0 through igw-8e76e7eb; reachability beyond it isn't evaluated."},
+				"return route": {result: Unknown, entity: "subnet-eccedfaa"},
+				"ingress":      {result: Allowed, entity: "sg-92a4d9f7"},
+			},
+		},
+		{
+			name: "peering both ways",
+			entities: []interface{}{
+				testRouteTable(t, "rtb-9d2e6b40", "vpc-b5f3a4d0", "subnet-50760c27", localRoute("172.30.0.0/16"), peeringRoute("172.31.0.0/16", "active")),
+				returnRoute,
+			},
+			from:       "i-5c0e4f2a",
+			to:         "i-8dd40a48",
+			protocol:   "tcp",
+			port:       22,
+			reachable:  true,
+			conclusive: true,
+			steps: map[string]step{
+				"route":        {result: Allowed, entity: "rtb-9d2e6b40, pcx-4e1b2c27"},
+				"return route": {result: Allowed, entity: "rtb-3a7f0c11, pcx-4e1b2c27"},
+			},
+		},
+		{
+			name: "blackholed peering",
+			entities: []interface{}{
+				testRouteTable(t, "rtb-9d2e6b40", "vpc-b5f3a4d0", "subnet-50760c27", localRoute("172.30.0.0/16"), peeringRoute("172.31.0.0/16", "blackhole")),
+				returnRoute,
+			},
+			from:       "i-5c0e4f2a",
+			to:         "i-8dd40a48",
+			protocol:   "tcp",
+			port:       22,
+			conclusive: true,
+			steps: map[string]step{
+				"route":        {result: Blocked, explanation: "rtb-9d2e6b40 routes 172.31.0.0/16 to pcx-4e1b2c27, which is a blackhole."},
+				"return route": {result: Allowed},
+			},
+		},
+		{
+			name: "most specific route wins",
+			entities: []interface{}{
+				testRouteTable(t, "rtb-9d2e6b40", "vpc-b5f3a4d0", "subnet-50760c27", peeringRoute("172.31.0.0/16", "active"), peeringRoute("172.31.0.0/20", "blackhole")),
+				returnRoute,
+			},
+			from:       "i-5c0e4f2a",
+			to:         "i-8dd40a48",
+			protocol:   "tcp",
+			port:       22,
+			conclusive: true,
+			steps: map[string]step{
+				"route": {result: Blocked, entity: "rtb-9d2e6b40"},
+			},
+		},
+		{
+			name: "no route",
+			entities: []interface{}{
+				testRouteTable(t, "rtb-9d2e6b40", "vpc-b5f3a4d0", "subnet-50760c27", localRoute("172.30.0.0/16")),
+				returnRoute,
+			},
+			from:       "i-5c0e4f2a",
+			to:         "i-8dd40a48",
+			protocol:   "tcp",
+			port:       22,
+			conclusive: true,
+			steps: map[string]step{
+				"route": {result: Blocked, explanation: "rtb-9d2e6b40 has no route to ec2 i-8dd40a48."},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from, err := ParseEntityRef(test.from)
+			require.NoError(t, err)
+			to, err := ParseEntityRef(test.to)
+			require.NoError(t, err)
+
+			reachability, err := Reach(reachStore(t, test.entities...), &ReachabilityRequest{CustomerId: testCustomerId, From: from, To: to, Protocol: test.protocol, Port: test.port})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.reachable, reachability.Reachable, "reachable")
+			assert.Equal(t, test.conclusive, reachability.Conclusive, "conclusive")
+
+			// the subnet step kept is the destination's, placed second.
+			steps := make(map[string]*Step)
+			for _, s := range reachability.Steps {
+				steps[s.Check] = s
+			}
+
+			for check, expected := range test.steps {
+				s, ok := steps[check]
+				if !assert.True(t, ok, "%s step", check) {
+					continue
+				}
+
+				assert.Equal(t, expected.result, s.Result, "%s result: %s", check, s.Explanation)
+				if expected.entity != "" {
+					assert.Equal(t, expected.entity, s.Entity, "%s entity", check)
+				}
+				if expected.explanation != "" {
+					assert.Equal(t, expected.explanation, s.Explanation, "%s explanation", check)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Scores rank suggestions by how likely they are to be a check worth
+// having: a load balancer's own health check is the best guess at what
+// matters about its instances, while an open port is only a hint.
+const (
+	healthCheckScore = 100
+	listenerScore    = 80
+	endpointScore    = 70
+)
+
+// maxPortRange is the widest ingress range whose common ports are
+// suggested. Wider ranges, such as all ephemeral ports, say little about
+// what's actually served.
+const maxPortRange = 100
+
+// commonPort is a service commonly exposed on a port, and how to check it.
+type commonPort struct {
+	protocol string
+	path     string
+	score    int
+}
+
+// commonPorts are the ports whose ingress rules are suggested as checks.
+var commonPorts = map[int64]commonPort{
+	80:    {"http", "/", 60},
+	443:   {"https", "/", 60},
+	8000:  {"http", "/", 50},
+	8080:  {"http", "/", 50},
+	8443:  {"https", "/", 50},
+	9200:  {"http", "/", 40},
+	3306:  {"tcp", "", 40},
+	5432:  {"tcp", "", 40},
+	6379:  {"tcp", "", 40},
+	27017: {"tcp", "", 40},
+	5672:  {"tcp", "", 30},
+	11211: {"tcp", "", 30},
+	22:    {"tcp", "", 20},
+}
+
+// checkProtocols maps the protocols of load balancer listeners and health
+// checks to those of checks.
+var checkProtocols = map[string]string{
+	"HTTP":  "http",
+	"HTTPS": "https",
+	"TCP":   "tcp",
+	"SSL":   "tcp",
+}
+
+// SuggestionsRequest asks for the check suggestions of a customer, in one
+// account when AccountId is set.
+type SuggestionsRequest struct {
+	CustomerId string `json:"customer_id"`
+	AccountId  string `json:"account_id"`
+}
+
+// Suggestion is a check target proposed for a group or instance. Path is
+// only set for http and https checks.
+type Suggestion struct {
+	Target   *SuggestionTarget `json:"target"`
+	Protocol string            `json:"protocol"`
+	Port     int64             `json:"port"`
+	Path     string            `json:"path,omitempty"`
+	Score    int               `json:"score"`
+	Reason   string            `json:"reason"`
+}
+
+// SuggestionTarget is the group or instance a check would run against.
+type SuggestionTarget struct {
+	Type          string `json:"type"`
+	Id            string `json:"id"`
+	AccountId     string `json:"account_id"`
+	Name          string `json:"name,omitempty"`
+	InstanceCount int    `json:"instance_count"`
+}
+
+// Suggestions are ranked best first. Dismissed counts the suggestions left
+// out because the customer dismissed them.
+type Suggestions struct {
+	Suggestions []*Suggestion `json:"suggestions"`
+	Dismissed   int           `json:"dismissed"`
+}
+
+type suggestionKey struct {
+	accountId  string
+	targetType string
+	targetId   string
+	protocol   string
+	port       int64
+	path       string
+}
+
+// suggester collects suggestions, keeping the best scored one for each
+// account's target, protocol, port and path.
+type suggester struct {
+	suggestions map[suggestionKey]*Suggestion
+}
+
+// Suggest proposes check targets from a customer's load balancers, rds
+// instances and security groups, skipping the ones the customer dismissed.
+// Groups without instances have nothing to check, so aren't suggested.
+func Suggest(db store.Store, request *SuggestionsRequest) (*Suggestions, error) {
+	groups, err := db.ListGroups(&store.GroupsRequest{CustomerId: request.CustomerId, AccountId: request.AccountId})
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := db.ListInstances(&store.InstancesRequest{CustomerId: request.CustomerId, AccountId: request.AccountId, Type: store.DBInstanceStoreType})
+	if err != nil {
+		return nil, err
+	}
+
+	dismissals, err := db.ListSuggestionDismissals(&store.SuggestionDismissalsRequest{CustomerId: request.CustomerId})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &suggester{suggestions: make(map[suggestionKey]*Suggestion)}
+	for _, group := range groups.Groups {
+		if group.InstanceCount == 0 {
+			continue
+		}
+
+		switch group.Type {
+		case store.ELBStoreType:
+			err = s.addLoadBalancer(group)
+		case store.SecurityGroupStoreType:
+			err = s.addSecurityGroup(group)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, instance := range instances.Instances {
+		if err := s.addDBInstance(instance); err != nil {
+			return nil, err
+		}
+	}
+
+	dismissed := make(map[suggestionKey]bool, len(dismissals.Dismissals))
+	for _, d := range dismissals.Dismissals {
+		dismissed[suggestionKey{d.AccountId, d.TargetType, d.TargetId, d.Protocol, d.Port, d.Path}] = true
+	}
+
+	response := &Suggestions{Suggestions: make([]*Suggestion, 0, len(s.suggestions))}
+	for key, suggestion := range s.suggestions {
+		if dismissed[key] {
+			response.Dismissed++
+			continue
+		}
+		response.Suggestions = append(response.Suggestions, suggestion)
+	}
+
+	sort.Sort(suggestionsByRank(response.Suggestions))
+	return response, nil
+}
+
+// addLoadBalancer suggests a load balancer's health check target, and the
+// instance side of its listeners.
+func (s *suggester) addLoadBalancer(group *store.GroupResponse) error {
+	data := &opsee_aws_elb.LoadBalancerDescription{}
+	if err := json.Unmarshal(group.Group.Data, data); err != nil {
+		return err
+	}
+
+	// a listener on the health check's port is already checked by it.
+	var checked int64
+	target := groupTarget(group, "")
+	if data.HealthCheck != nil {
+		if protocol, port, path, ok := parseHealthCheckTarget(aws.StringValue(data.HealthCheck.Target)); ok {
+			s.add(target, protocol, port, path, healthCheckScore, "load balancer health check")
+			checked = port
+		}
+	}
+
+	for _, description := range data.ListenerDescriptions {
+		listener := description.Listener
+		if listener == nil || listener.InstancePort == nil || *listener.InstancePort == checked {
+			continue
+		}
+
+		protocol, ok := checkProtocols[strings.ToUpper(aws.StringValue(listener.InstanceProtocol))]
+		if !ok {
+			continue
+		}
+
+		s.add(target, protocol, *listener.InstancePort, defaultPath(protocol), listenerScore, fmt.Sprintf("load balancer listens on port %d", aws.Int64Value(listener.LoadBalancerPort)))
+	}
+
+	return nil
+}
+
+// addSecurityGroup suggests the common ports a security group lets in over
+// tcp.
+func (s *suggester) addSecurityGroup(group *store.GroupResponse) error {
+	data := &opsee_aws_ec2.SecurityGroup{}
+	if err := json.Unmarshal(group.Group.Data, data); err != nil {
+		return err
+	}
+
+	target := groupTarget(group, aws.StringValue(data.GroupName))
+	for _, permission := range data.IpPermissions {
+		key := permissionKey(permission)
+		if key.protocol != "tcp" || key.to-key.from >= maxPortRange {
+			continue
+		}
+
+		for port, common := range commonPorts {
+			if key.from <= port && port <= key.to {
+				s.add(target, common.protocol, port, common.path, common.score, fmt.Sprintf("security group allows %s in", portLabel(key)))
+			}
+		}
+	}
+
+	return nil
+}
+
+// addDBInstance suggests an rds instance's endpoint.
+func (s *suggester) addDBInstance(instance *store.InstanceResponse) error {
+	data := &opsee_aws_rds.DBInstance{}
+	if err := json.Unmarshal(instance.Instance.Data, data); err != nil {
+		return err
+	}
+
+	if data.Endpoint == nil || data.Endpoint.Port == nil {
+		return nil
+	}
+
+	target := &SuggestionTarget{Type: instance.Type, Id: instance.Id, AccountId: instance.AccountId}
+	s.add(target, "tcp", *data.Endpoint.Port, "", endpointScore, "rds endpoint")
+
+	return nil
+}
+
+func (s *suggester) add(target *SuggestionTarget, protocol string, port int64, path string, score int, reason string) {
+	key := suggestionKey{target.AccountId, target.Type, target.Id, protocol, port, path}
+	if existing, ok := s.suggestions[key]; ok && existing.Score >= score {
+		return
+	}
+
+	s.suggestions[key] = &Suggestion{
+		Target:   target,
+		Protocol: protocol,
+		Port:     port,
+		Path:     path,
+		Score:    score,
+		Reason:   reason,
+	}
+}
+
+func groupTarget(group *store.GroupResponse, name string) *SuggestionTarget {
+	return &SuggestionTarget{
+		Type:          group.Type,
+		Id:            group.Id,
+		AccountId:     group.AccountId,
+		Name:          name,
+		InstanceCount: group.InstanceCount,
+	}
+}
+
+// parseHealthCheckTarget reads a load balancer health check target, such as
+// "HTTP:80/health" or "TCP:22".
+func parseHealthCheckTarget(target string) (string, int64, string, bool) {
+	parts := strings.SplitN(target, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, "", false
+	}
+
+	protocol, ok := checkProtocols[strings.ToUpper(parts[0])]
+	if !ok {
+		return "", 0, "", false
+	}
+
+	port, path := parts[1], ""
+	if i := strings.Index(port, "/"); i >= 0 {
+		port, path = port[:i], port[i:]
+	}
+
+	n, err := strconv.ParseInt(port, 10, 64)
+	if err != nil || n < 1 || n > 65535 {
+		return "", 0, "", false
+	}
+
+	if protocol == "tcp" {
+		path = ""
+	} else if path == "" {
+		path = "/"
+	}
+
+	return protocol, n, path, true
+}
+
+func defaultPath(protocol string) string {
+	if protocol == "tcp" {
+		return ""
+	}
+
+	return "/"
+}
+
+type suggestionsByRank []*Suggestion
+
+func (s suggestionsByRank) Len() int      { return len(s) }
+func (s suggestionsByRank) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s suggestionsByRank) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.Target.InstanceCount != b.Target.InstanceCount {
+		return a.Target.InstanceCount > b.Target.InstanceCount
+	}
+	if a.Target.Type != b.Target.Type {
+		return a.Target.Type < b.Target.Type
+	}
+	if a.Target.Id != b.Target.Id {
+		return a.Target.Id < b.Target.Id
+	}
+	if a.Port != b.Port {
+		return a.Port < b.Port
+	}
+	if a.Protocol != b.Protocol {
+		return a.Protocol < b.Protocol
+	}
+	return a.Path < b.Path
+}
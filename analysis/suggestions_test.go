@@ -0,0 +1,113 @@
+package analysis
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	db := newFixtureStore(t, "load-balancers", "security-groups", "db-instances", "instances")
+
+	// a group open on ephemeral ports, too wide to suggest, and on a range
+	// narrow enough to.
+	ephemeral, err := store.NewGroup(testCustomerId, testAccountId, &opsee_aws_ec2.SecurityGroup{
+		GroupId:   aws.String("sg-0e5a7c31"),
+		GroupName: aws.String("ephemeral"),
+		IpPermissions: []*opsee_aws_ec2.IpPermission{
+			{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(1024), ToPort: aws.Int64(65535)},
+			{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(8000), ToPort: aws.Int64(8099)},
+		},
+	})
+	require.NoError(t, err)
+	db.add(ephemeral)
+
+	worker, err := store.NewInstance(testCustomerId, testAccountId, &opsee_aws_ec2.Instance{
+		InstanceId:     aws.String("i-6b1c0d2e"),
+		SecurityGroups: []*opsee_aws_ec2.GroupIdentifier{{GroupId: aws.String("sg-0e5a7c31")}},
+	})
+	require.NoError(t, err)
+	db.add(worker)
+
+	// dismissals only apply in their own account.
+	db.add(&store.SuggestionDismissal{CustomerId: testCustomerId, AccountId: testAccountId, TargetType: store.ELBStoreType, TargetId: "api-lb", Protocol: "http", Port: 8080, Path: "/health_check"})
+	db.add(&store.SuggestionDismissal{CustomerId: testCustomerId, AccountId: "120589623411", TargetType: store.ELBStoreType, TargetId: "lasape", Protocol: "http", Port: 80, Path: "/index.html"})
+
+	suggestions, err := Suggest(db, &SuggestionsRequest{CustomerId: testCustomerId})
+	require.NoError(t, err)
+	assert.Equal(t, 1, suggestions.Dismissed)
+
+	// health checks rank first, then listeners not covered by them, rds
+	// endpoints and common ports, each by instance count. Load balancers
+	// and groups without instances aren't suggested.
+	ranked := make([]string, 0, len(suggestions.Suggestions))
+	for _, s := range suggestions.Suggestions {
+		ranked = append(ranked, fmt.Sprintf("%s/%s %s/%d%s %d", s.Target.Type, s.Target.Id, s.Protocol, s.Port, s.Path, s.Score))
+	}
+
+	assert.Equal(t, []string{
+		"elb/vape-private-lb http/9091/health 100",
+		"elb/c1-us-west-1-ssh tcp/22 100",
+		"elb/vape-public-lb http/8081/health 100",
+		"elb/webhooks http/20000/health 100",
+		"elb/bastion-vpn-lb tcp/1194 100",
+		"elb/lasape http/80/index.html 100",
+		"elb/nsqd-lb tcp/4150 100",
+		"elb/api-lb tcp/4080 80",
+		"elb/nsqd-lb http/4151/ 80",
+		"rds/bartnet tcp/5432 70",
+		"rds/beta-auth tcp/5432 70",
+		"rds/vape tcp/5432 70",
+		"security/sg-c852dbad http/80/ 60",
+		"security/sg-df6de4ba https/443/ 60",
+		"security/sg-c852dbad http/8080/ 50",
+		"security/sg-0e5a7c31 http/8000/ 50",
+		"security/sg-0e5a7c31 http/8080/ 50",
+		"security/sg-d39a43b6 tcp/5432 40",
+		"security/sg-c852dbad tcp/22 20",
+		"security/sg-df6de4ba tcp/22 20",
+	}, ranked)
+
+	for _, s := range suggestions.Suggestions {
+		if s.Target.Type == store.ELBStoreType && s.Target.Id == "vape-private-lb" {
+			assert.Equal(t, 3, s.Target.InstanceCount)
+			assert.Equal(t, testAccountId, s.Target.AccountId)
+		}
+	}
+}
+
+func TestParseHealthCheckTarget(t *testing.T) {
+	tests := []struct {
+		target   string
+		protocol string
+		port     int64
+		path     string
+		ok       bool
+	}{
+		{"HTTP:80/health", "http", 80, "/health", true},
+		{"HTTP:8080", "http", 8080, "/", true},
+		{"HTTPS:443/status?full=1", "https", 443, "/status?full=1", true},
+		{"TCP:22", "tcp", 22, "", true},
+		{"TCP:22/ignored", "tcp", 22, "", true},
+		{"SSL:443", "tcp", 443, "", true},
+		{"http:80/", "http", 80, "/", true},
+		{"HTTP:0/", "", 0, "", false},
+		{"HTTP:65536/", "", 0, "", false},
+		{"HTTP:web/", "", 0, "", false},
+		{"UDP:53", "", 0, "", false},
+		{"HTTP", "", 0, "", false},
+		{"", "", 0, "", false},
+	}
+
+	for _, test := range tests {
+		protocol, port, path, ok := parseHealthCheckTarget(test.target)
+		assert.Equal(t, test.ok, ok, test.target)
+		assert.Equal(t, test.protocol, protocol, test.target)
+		assert.Equal(t, test.port, port, test.target)
+		assert.Equal(t, test.path, path, test.target)
+	}
+}
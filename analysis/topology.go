@@ -0,0 +1,590 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	"sort"
+	"strings"
+)
+
+// VpcNodeType is the type of the vpc nodes of a topology. Vpcs aren't stored
+// themselves, only found in the entities in them.
+const VpcNodeType = "vpc"
+
+// the kinds of edges of a topology, from the entity to the one it names.
+const (
+	SecuredBy  = "secured_by"
+	Contains   = "contains"
+	AttachedTo = "attached_to"
+	InSubnet   = "in_subnet"
+	InVpc      = "in_vpc"
+	RoutesFor  = "routes_for"
+)
+
+// DefaultDepth is how many edges from a focus are kept unless a request
+// gives a depth.
+const DefaultDepth = 2
+
+var (
+	ErrFocusNotFound  = errors.New("focus not found in topology")
+	ErrFocusAmbiguous = errors.New("focus found in more than one account, prefix it with the account id")
+)
+
+// TopologyRequest asks for a customer's topology, limited to an account and a
+// vpc when set. Types, when set, limits the nodes to those of the given
+// types. With a Focus, only nodes within Depth edges of it are kept.
+type TopologyRequest struct {
+	CustomerId string     `json:"customer_id"`
+	AccountId  string     `json:"account_id"`
+	VpcId      string     `json:"vpc_id"`
+	Types      []string   `json:"types"`
+	Focus      *EntityRef `json:"focus"`
+	Depth      int        `json:"depth"`
+}
+
+// Topology is a graph of a customer's entities and their relationships.
+type Topology struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+}
+
+// Node is an entity of a topology. Its id is its type and entity id, e.g.
+// "ec2/i-123" or "subnet/subnet-123", as taken by a TopologyRequest's Focus.
+// Entity ids may repeat across accounts, so for customers with more than one
+// the id starts with the account, e.g. "933693344490/ec2/i-123". Label is the
+// entity's Name tag or name when it has one.
+type Node struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	EntityId  string `json:"entity_id"`
+	AccountId string `json:"account_id,omitempty"`
+	VpcId     string `json:"vpc_id,omitempty"`
+	Label     string `json:"label"`
+}
+
+// Edge is a relationship between two nodes, such as an instance secured_by
+// a security group or an elb that contains an instance.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+type graph struct {
+	nodes map[string]*Node
+	edges map[Edge]bool
+
+	// accounts is set when the customer has more than one account, so that
+	// node ids include theirs.
+	accounts bool
+
+	// secured are the instances whose data names their security groups,
+	// which are left out of links.
+	secured map[string]bool
+}
+
+// GetTopology builds the topology of a customer's entities. Entities
+// referenced but not discovered, such as an instance's subnet, are included
+// with only their ids.
+func GetTopology(db store.Store, request *TopologyRequest) (*Topology, error) {
+	g, err := loadGraph(db, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.VpcId != "" {
+		g.keepVpc(request.VpcId)
+	}
+
+	if len(request.Types) > 0 {
+		types := make(map[string]bool, len(request.Types))
+		for _, t := range request.Types {
+			types[t] = true
+		}
+		if request.Focus != nil {
+			types[request.Focus.Type] = true
+		}
+
+		g.keep(func(n *Node) bool { return types[n.Type] })
+	}
+
+	if request.Focus != nil {
+		focus, err := g.find(request.Focus)
+		if err != nil {
+			return nil, err
+		}
+
+		g.keepAround(focus, request.Depth)
+	}
+
+	return g.topology(), nil
+}
+
+func loadGraph(db store.Store, request *TopologyRequest) (*graph, error) {
+	g := &graph{nodes: make(map[string]*Node), edges: make(map[Edge]bool), secured: make(map[string]bool)}
+
+	accounts, err := db.ListAccounts(&store.AccountsRequest{CustomerId: request.CustomerId})
+	if err != nil {
+		return nil, err
+	}
+	g.accounts = len(accounts.Accounts) > 1
+
+	instances, err := db.ListInstances(&store.InstancesRequest{CustomerId: request.CustomerId, AccountId: request.AccountId})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := db.ListGroups(&store.GroupsRequest{CustomerId: request.CustomerId, AccountId: request.AccountId})
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := db.ListGroupLinks(&store.GroupsRequest{CustomerId: request.CustomerId, AccountId: request.AccountId})
+	if err != nil {
+		return nil, err
+	}
+
+	network := &store.NetworkRequest{CustomerId: request.CustomerId, AccountId: request.AccountId}
+	subnets, err := db.ListSubnets(network)
+	if err != nil {
+		return nil, err
+	}
+
+	routeTables, err := db.ListRouteTables(network)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range subnets.Subnets {
+		data := &opsee_aws_ec2.Subnet{}
+		if err := json.Unmarshal(s.Data, data); err != nil {
+			return nil, err
+		}
+
+		node := g.node(store.SubnetStoreType, s.Id, s.AccountId)
+		node.Label = nameTag(data.Tags, s.Id)
+		g.inVpc(node, aws.StringValue(data.VpcId))
+	}
+
+	for _, rt := range routeTables.RouteTables {
+		data := &opsee_aws_ec2.RouteTable{}
+		if err := json.Unmarshal(rt.Data, data); err != nil {
+			return nil, err
+		}
+
+		node := g.node(store.RouteTableStoreType, rt.Id, rt.AccountId)
+		node.Label = nameTag(data.Tags, rt.Id)
+		g.inVpc(node, aws.StringValue(data.VpcId))
+		for _, association := range data.Associations {
+			if association.SubnetId != nil {
+				g.edge(node, g.node(store.SubnetStoreType, *association.SubnetId, rt.AccountId), RoutesFor)
+			}
+		}
+	}
+
+	for _, group := range groups.Groups {
+		if err := g.addGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, instance := range instances.Instances {
+		if err := g.addInstance(instance); err != nil {
+			return nil, err
+		}
+	}
+
+	// links give the members of load balancers and autoscaling groups, the
+	// db security groups of rds instances, and the security groups of
+	// instances whose data doesn't name them, since links outlive groups
+	// being removed from an instance.
+	for _, link := range links.Links {
+		if link.GroupType == store.SecurityGroupStoreType && g.secured[g.nodeId(link.InstanceType, link.InstanceId, link.AccountId)] {
+			continue
+		}
+
+		group := g.node(link.GroupType, link.GroupName, link.AccountId)
+		instance := g.node(link.InstanceType, link.InstanceId, link.AccountId)
+		if link.GroupType == store.SecurityGroupStoreType || link.GroupType == store.DBSecurityGroupStoreType {
+			g.edge(instance, group, SecuredBy)
+		} else {
+			g.edge(group, instance, Contains)
+		}
+	}
+
+	return g, nil
+}
+
+func (g *graph) addInstance(instance *store.InstanceResponse) error {
+	node := g.node(instance.Type, instance.Id, instance.AccountId)
+
+	switch instance.Type {
+	case store.InstanceStoreType:
+		data := &opsee_aws_ec2.Instance{}
+		if err := json.Unmarshal(instance.Instance.Data, data); err != nil {
+			return err
+		}
+
+		node.Label = nameTag(data.Tags, instance.Id)
+		g.inVpc(node, aws.StringValue(data.VpcId))
+		if data.SubnetId != nil {
+			g.edge(node, g.node(store.SubnetStoreType, *data.SubnetId, instance.AccountId), InSubnet)
+		}
+		for _, group := range data.SecurityGroups {
+			if group.GroupId != nil {
+				g.edge(node, g.node(store.SecurityGroupStoreType, *group.GroupId, instance.AccountId), SecuredBy)
+				g.secured[node.Id] = true
+			}
+		}
+
+	case store.DBInstanceStoreType:
+		data := &opsee_aws_rds.DBInstance{}
+		if err := json.Unmarshal(instance.Instance.Data, data); err != nil {
+			return err
+		}
+
+		if data.DBSubnetGroup != nil {
+			g.inVpc(node, aws.StringValue(data.DBSubnetGroup.VpcId))
+			for _, subnet := range data.DBSubnetGroup.Subnets {
+				if subnet.SubnetIdentifier != nil {
+					g.edge(node, g.node(store.SubnetStoreType, *subnet.SubnetIdentifier, instance.AccountId), InSubnet)
+				}
+			}
+		}
+		for _, group := range data.VpcSecurityGroups {
+			if group.VpcSecurityGroupId != nil {
+				g.edge(node, g.node(store.SecurityGroupStoreType, *group.VpcSecurityGroupId, instance.AccountId), SecuredBy)
+				g.secured[node.Id] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func (g *graph) addGroup(group *store.GroupResponse) error {
+	node := g.node(group.Type, group.Id, group.AccountId)
+
+	switch group.Type {
+	case store.SecurityGroupStoreType:
+		data := &opsee_aws_ec2.SecurityGroup{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return err
+		}
+
+		if data.GroupName != nil {
+			node.Label = *data.GroupName
+		}
+		g.inVpc(node, aws.StringValue(data.VpcId))
+
+	case store.DBSecurityGroupStoreType:
+		data := &store.DBSecurityGroup{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return err
+		}
+
+		g.inVpc(node, aws.StringValue(data.VpcId))
+
+	case store.DBSubnetGroupStoreType:
+		data := &opsee_aws_rds.DBSubnetGroup{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return err
+		}
+
+		g.inVpc(node, aws.StringValue(data.VpcId))
+		for _, subnet := range data.Subnets {
+			if subnet.SubnetIdentifier != nil {
+				g.edge(node, g.node(store.SubnetStoreType, *subnet.SubnetIdentifier, group.AccountId), InSubnet)
+			}
+		}
+
+	case store.ELBStoreType:
+		data := &opsee_aws_elb.LoadBalancerDescription{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return err
+		}
+
+		g.inVpc(node, aws.StringValue(data.VPCId))
+		for _, subnetId := range data.Subnets {
+			g.edge(node, g.node(store.SubnetStoreType, subnetId, group.AccountId), InSubnet)
+		}
+		for _, groupId := range data.SecurityGroups {
+			g.edge(node, g.node(store.SecurityGroupStoreType, groupId, group.AccountId), SecuredBy)
+		}
+
+	case store.AutoScalingGroupStoreType:
+		data := &opsee_aws_autoscaling.Group{}
+		if err := json.Unmarshal(group.Group.Data, data); err != nil {
+			return err
+		}
+
+		for _, subnetId := range strings.Split(aws.StringValue(data.VPCZoneIdentifier), ",") {
+			if subnetId = strings.TrimSpace(subnetId); subnetId != "" {
+				g.edge(node, g.node(store.SubnetStoreType, subnetId, group.AccountId), InSubnet)
+			}
+		}
+		for _, name := range data.LoadBalancerNames {
+			g.edge(node, g.node(store.ELBStoreType, name, group.AccountId), AttachedTo)
+		}
+	}
+
+	return nil
+}
+
+// node returns the node of an entity, adding it when it's not in the graph.
+func (g *graph) node(entityType, entityId, accountId string) *Node {
+	id := g.nodeId(entityType, entityId, accountId)
+	if n, ok := g.nodes[id]; ok {
+		return n
+	}
+
+	n := &Node{Id: id, Type: entityType, EntityId: entityId, AccountId: accountId, Label: entityId}
+	g.nodes[id] = n
+	return n
+}
+
+func (g *graph) edge(from, to *Node, kind string) {
+	g.edges[Edge{From: from.Id, To: to.Id, Kind: kind}] = true
+}
+
+// inVpc places a node in a vpc, which is added to the graph.
+func (g *graph) inVpc(n *Node, vpcId string) {
+	if vpcId == "" {
+		return
+	}
+
+	n.VpcId = vpcId
+	vpc := g.node(VpcNodeType, vpcId, n.AccountId)
+	vpc.VpcId = vpcId
+	g.edge(n, vpc, InVpc)
+}
+
+// keepVpc keeps the nodes in a vpc, along with those placed in no vpc of
+// their own, such as autoscaling groups, that are connected to one.
+func (g *graph) keepVpc(vpcId string) {
+	inVpc := func(n *Node) bool { return n.VpcId == vpcId }
+	keep := make(map[string]bool)
+	for id, n := range g.nodes {
+		if inVpc(n) {
+			keep[id] = true
+		}
+	}
+
+	for e := range g.edges {
+		from, to := g.nodes[e.From], g.nodes[e.To]
+		if from.VpcId == "" && inVpc(to) {
+			keep[from.Id] = true
+		}
+		if to.VpcId == "" && inVpc(from) {
+			keep[to.Id] = true
+		}
+	}
+
+	g.keep(func(n *Node) bool { return keep[n.Id] })
+}
+
+// find returns the id of the node ref names. A ref without an account
+// names a node of any account, so long as only one matches.
+func (g *graph) find(ref *EntityRef) (string, error) {
+	if ref.AccountId != "" || !g.accounts {
+		id := g.nodeId(ref.Type, ref.Id, ref.AccountId)
+		if n, ok := g.nodes[id]; !ok || (ref.AccountId != "" && n.AccountId != ref.AccountId) {
+			return "", ErrFocusNotFound
+		}
+		return id, nil
+	}
+
+	found := ""
+	for id, n := range g.nodes {
+		if n.Type != ref.Type || n.EntityId != ref.Id {
+			continue
+		}
+		if found != "" {
+			return "", ErrFocusAmbiguous
+		}
+		found = id
+	}
+
+	if found == "" {
+		return "", ErrFocusNotFound
+	}
+	return found, nil
+}
+
+// keepAround keeps the nodes within depth edges of the focus, in either
+// direction.
+func (g *graph) keepAround(focus string, depth int) {
+	neighbors := make(map[string][]string)
+	for e := range g.edges {
+		neighbors[e.From] = append(neighbors[e.From], e.To)
+		neighbors[e.To] = append(neighbors[e.To], e.From)
+	}
+
+	keep := map[string]bool{focus: true}
+	frontier := []string{focus}
+	for i := 0; i < depth && len(frontier) > 0; i++ {
+		next := make([]string, 0)
+		for _, id := range frontier {
+			for _, neighbor := range neighbors[id] {
+				if !keep[neighbor] {
+					keep[neighbor] = true
+					next = append(next, neighbor)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	g.keep(func(n *Node) bool { return keep[n.Id] })
+}
+
+// keep removes the nodes f rejects, along with their edges.
+func (g *graph) keep(f func(*Node) bool) {
+	for id, n := range g.nodes {
+		if !f(n) {
+			delete(g.nodes, id)
+		}
+	}
+
+	for e := range g.edges {
+		if g.nodes[e.From] == nil || g.nodes[e.To] == nil {
+			delete(g.edges, e)
+		}
+	}
+}
+
+func (g *graph) topology() *Topology {
+	t := &Topology{
+		Nodes: make([]*Node, 0, len(g.nodes)),
+		Edges: make([]*Edge, 0, len(g.edges)),
+	}
+
+	for _, n := range g.nodes {
+		t.Nodes = append(t.Nodes, n)
+	}
+	sort.Sort(nodesById(t.Nodes))
+
+	for e := range g.edges {
+		edge := e
+		t.Edges = append(t.Edges, &edge)
+	}
+	sort.Sort(edgesByNodes(t.Edges))
+
+	return t
+}
+
+// dotShapes are the graphviz shapes of each type of node.
+var dotShapes = map[string]string{
+	store.InstanceStoreType:         "box",
+	store.DBInstanceStoreType:       "cylinder",
+	store.SecurityGroupStoreType:    "octagon",
+	store.DBSecurityGroupStoreType:  "octagon",
+	store.DBSubnetGroupStoreType:    "component",
+	store.ELBStoreType:              "invtrapezium",
+	store.AutoScalingGroupStoreType: "box3d",
+	store.SubnetStoreType:           "folder",
+	store.RouteTableStoreType:       "note",
+	VpcNodeType:                     "tab",
+}
+
+// DOT renders the topology in graphviz DOT, clustering the nodes of each
+// vpc together.
+func (t *Topology) DOT() []byte {
+	clusters := make(map[string][]*Node)
+	vpcs := make([]string, 0)
+	for _, n := range t.Nodes {
+		if _, ok := clusters[n.VpcId]; !ok {
+			vpcs = append(vpcs, n.VpcId)
+		}
+		clusters[n.VpcId] = append(clusters[n.VpcId], n)
+	}
+	sort.Strings(vpcs)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("digraph topology {\n")
+	for i, vpcId := range vpcs {
+		indent := "  "
+		if vpcId != "" {
+			fmt.Fprintf(buf, "  subgraph cluster_%d {\n    label=%s;\n", i, dotQuote(vpcId))
+			indent = "    "
+		}
+
+		for _, n := range clusters[vpcId] {
+			shape := dotShapes[n.Type]
+			if shape == "" {
+				shape = "ellipse"
+			}
+
+			label := n.Type + " " + n.EntityId
+			if n.Label != n.EntityId {
+				label += "\n" + n.Label
+			}
+			fmt.Fprintf(buf, "%s%s [label=%s, shape=%s];\n", indent, dotQuote(n.Id), dotQuote(label), shape)
+		}
+
+		if vpcId != "" {
+			buf.WriteString("  }\n")
+		}
+	}
+
+	for _, e := range t.Edges {
+		fmt.Fprintf(buf, "  %s -> %s [label=%s];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Kind))
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+func (g *graph) nodeId(entityType, entityId, accountId string) string {
+	if g.accounts {
+		return accountId + "/" + entityType + "/" + entityId
+	}
+
+	return entityType + "/" + entityId
+}
+
+// nameTag returns the value of the Name tag, or fallback without one.
+func nameTag(tags []*opsee_aws_ec2.Tag, fallback string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == "Name" && aws.StringValue(tag.Value) != "" {
+			return *tag.Value
+		}
+	}
+
+	return fallback
+}
+
+type nodesById []*Node
+
+func (n nodesById) Len() int           { return len(n) }
+func (n nodesById) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesById) Less(i, j int) bool { return n[i].Id < n[j].Id }
+
+type edgesByNodes []*Edge
+
+func (e edgesByNodes) Len() int      { return len(e) }
+func (e edgesByNodes) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e edgesByNodes) Less(i, j int) bool {
+	if e[i].From != e[j].From {
+		return e[i].From < e[j].From
+	}
+	if e[i].To != e[j].To {
+		return e[i].To < e[j].To
+	}
+	return e[i].Kind < e[j].Kind
+}
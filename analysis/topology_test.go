@@ -0,0 +1,194 @@
+package analysis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseEntityRef(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected *EntityRef
+	}{
+		{"i-39aae6fb", &EntityRef{Type: "ec2", Id: "i-39aae6fb"}},
+		{"elb/api-lb", &EntityRef{Type: "elb", Id: "api-lb"}},
+		{"933693344490/elb/api-lb", &EntityRef{AccountId: "933693344490", Type: "elb", Id: "api-lb"}},
+		{"933693344490/i-39aae6fb", &EntityRef{AccountId: "933693344490", Type: "ec2", Id: "i-39aae6fb"}},
+		{"autoscaling/web/blue", &EntityRef{Type: "autoscaling", Id: "web/blue"}},
+	}
+
+	for _, test := range tests {
+		ref, err := ParseEntityRef(test.ref)
+		if assert.NoError(t, err, test.ref) {
+			assert.Equal(t, test.expected, ref, test.ref)
+		}
+	}
+
+	_, err := ParseEntityRef("933693344490/elb/")
+	assert.Error(t, err)
+}
+
+func TestTopologyAccounts(t *testing.T) {
+	t.Run("one account", func(t *testing.T) {
+		db := newFixtureStore(t, "instances")
+		topology, err := GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Focus: &EntityRef{Type: "ec2", Id: "i-39aae6fb"}, Depth: 1})
+		require.NoError(t, err)
+		assert.Contains(t, nodeIds(topology), "ec2/i-39aae6fb")
+	})
+
+	// the same instance id in a second account.
+	db := newFixtureStore(t, "instances")
+	other, err := store.NewInstance(testCustomerId, "210987654321", &opsee_aws_ec2.Instance{
+		InstanceId: aws.String("i-39aae6fb"),
+		SubnetId:   aws.String("subnet-2c1d0e9f"),
+	})
+	require.NoError(t, err)
+	db.add(other)
+
+	tests := []struct {
+		name  string
+		focus string
+		nodes []string
+		err   error
+	}{
+		{
+			name:  "focus with its account",
+			focus: "210987654321/ec2/i-39aae6fb",
+			nodes: []string{"210987654321/ec2/i-39aae6fb", "210987654321/subnet/subnet-2c1d0e9f"},
+		},
+		{
+			name:  "focus without an account in one",
+			focus: "i-8dd40a48",
+			nodes: []string{"933693344490/ec2/i-8dd40a48", "933693344490/security/sg-92a4d9f7", "933693344490/subnet/subnet-eccedfaa", "933693344490/vpc/vpc-79b1491c"},
+		},
+		{
+			name:  "focus without an account in both",
+			focus: "i-39aae6fb",
+			err:   ErrFocusAmbiguous,
+		},
+		{
+			name:  "focus in the wrong account",
+			focus: "210987654321/ec2/i-8dd40a48",
+			err:   ErrFocusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			focus, err := ParseEntityRef(test.focus)
+			require.NoError(t, err)
+
+			topology, err := GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Focus: focus, Depth: 1})
+			if test.err != nil {
+				assert.Equal(t, test.err, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.nodes, nodeIds(topology))
+		})
+	}
+}
+
+func TestTopologyFilters(t *testing.T) {
+	db := newFixtureStore(t, "instances", "security-groups", "load-balancers", "subnets", "route-tables")
+
+	t.Run("vpc", func(t *testing.T) {
+		topology, err := GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, VpcId: "vpc-b5f3a4d0"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"route-table/rtb-f0085195", "subnet/subnet-50760c27", "subnet/subnet-58f9dd3d", "subnet/subnet-b233aeeb", "vpc/vpc-b5f3a4d0"}, nodeIds(topology))
+		assertEdgesKept(t, topology)
+	})
+
+	// the focus's type is kept, along with those asked for.
+	t.Run("types", func(t *testing.T) {
+		topology, err := GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Types: []string{"ec2", "security"}, Focus: &EntityRef{Type: "elb", Id: "api-lb"}, Depth: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"ec2/i-39aae6fb",
+			"elb/api-lb",
+			"elb/bastion-vpn-lb",
+			"elb/c1-us-west-1-ssh",
+			"elb/lasape",
+			"elb/vape-private-lb",
+			"elb/vape-public-lb",
+			"elb/webhooks",
+			"security/sg-ac528bc9",
+			"security/sg-c852dbad",
+		}, nodeIds(topology))
+		assertEdgesKept(t, topology)
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		focus := &EntityRef{Type: "ec2", Id: "i-8dd40a48"}
+
+		topology, err := GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Focus: focus, Depth: 0})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ec2/i-8dd40a48"}, nodeIds(topology))
+		assert.Empty(t, topology.Edges)
+
+		topology, err = GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Focus: focus, Depth: 1})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ec2/i-8dd40a48", "security/sg-92a4d9f7", "subnet/subnet-eccedfaa", "vpc/vpc-79b1491c"}, nodeIds(topology))
+		assertEdgesKept(t, topology)
+
+		// two edges away are the subnet's other instances, but not the
+		// subnets of the vpc's load balancers.
+		topology, err = GetTopology(db, &TopologyRequest{CustomerId: testCustomerId, Focus: focus, Depth: 2})
+		require.NoError(t, err)
+		assert.Contains(t, nodeIds(topology), "ec2/i-20f122e5")
+		assert.Contains(t, nodeIds(topology), "elb/api-lb")
+		assert.NotContains(t, nodeIds(topology), "subnet/subnet-0378a966")
+		assertEdgesKept(t, topology)
+	})
+}
+
+func TestTopologyDOT(t *testing.T) {
+	topology := &Topology{
+		Nodes: []*Node{
+			{Id: "ec2/i-39aae6fb", Type: "ec2", EntityId: "i-39aae6fb", VpcId: "vpc-79b1491c", Label: `api "blue"`},
+			{Id: "security/sg-c852dbad", Type: "security", EntityId: "sg-c852dbad", Label: "sg-c852dbad"},
+			{Id: "widget/w-1", Type: "widget", EntityId: "w-1", VpcId: "vpc-79b1491c", Label: "w-1"},
+		},
+		Edges: []*Edge{
+			{From: "ec2/i-39aae6fb", To: "security/sg-c852dbad", Kind: "secured_by"},
+		},
+	}
+
+	assert.Equal(t, `digraph topology {
+  "security/sg-c852dbad" [label="security sg-c852dbad", shape=octagon];
+  subgraph cluster_1 {
+    label="vpc-79b1491c";
+    "ec2/i-39aae6fb" [label="ec2 i-39aae6fb\napi \"blue\"", shape=box];
+    "widget/w-1" [label="widget w-1", shape=ellipse];
+  }
+  "ec2/i-39aae6fb" -> "security/sg-c852dbad" [label="secured_by"];
+}
+`, string(topology.DOT()))
+}
+
+// assertEdgesKept asserts that every edge of the topology is between its
+// nodes.
+func assertEdgesKept(t *testing.T, topology *Topology) {
+	ids := make(map[string]bool)
+	for _, n := range topology.Nodes {
+		ids[n.Id] = true
+	}
+
+	for _, e := range topology.Edges {
+		assert.True(t, ids[e.From] && ids[e.To], "%s -> %s", e.From, e.To)
+	}
+}
+
+func nodeIds(topology *Topology) []string {
+	ids := make([]string, len(topology.Nodes))
+	for i, n := range topology.Nodes {
+		ids[i] = n.Id
+	}
+
+	return ids
+}
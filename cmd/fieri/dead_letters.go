@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/config"
+	"github.com/opsee/fieri/consumer"
+	"github.com/opsee/fieri/store"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const deadLettersUsage = `usage: fieri dead-letters [flags] <action>
+
+Inspects, replays and purges discovery events that couldn't be stored.
+
+actions:
+  list              dead letters, newest first, filtered by -customer, -type and -before
+  show <id>...      dead letters with their event bodies
+  replay [<id>...]  handle the given dead letters again, or every listed one,
+                    deleting those that are stored
+  delete <id>...    delete dead letters
+  purge             delete every dead letter matching the filters; without
+                    filters it requires -all
+`
+
+func deadLettersCommand(args []string) error {
+	flags := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	request := &store.DeadLettersRequest{}
+	flags.StringVar(&request.CustomerId, "customer", "", "only dead letters for this customer id")
+	flags.StringVar(&request.Type, "type", "", "only dead letters of this event type, e.g. SecurityGroup")
+	flags.IntVar(&request.Limit, "limit", 100, "maximum dead letters to list or replay")
+	before := flags.String("before", "", "only dead letters captured before this RFC 3339 time")
+	all := flags.Bool("all", false, "allow purging every dead letter")
+	format := flags.String("output", "table", "output format: "+strings.Join(outputFormats, ", "))
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, deadLettersUsage)
+		flags.PrintDefaults()
+	}
+
+	cfg, err := config.Load(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return fmt.Errorf("dead-letters: invalid -before: %s", err)
+		}
+		request.Before = &t
+	}
+
+	var ids []int64
+	for i := 1; i < flags.NArg(); i++ {
+		arg := flags.Arg(i)
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("dead-letters: %q is not a dead letter id", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := cfg.ValidatePostgres(); err != nil {
+		return err
+	}
+
+	db, err := store.NewPostgres(cfg.Postgres())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action := flags.Arg(0); action {
+	case "list":
+		response, err := db.ListDeadLetters(request)
+		if err != nil {
+			return err
+		}
+		return writeListing(os.Stdout, *format, deadLetterListing(response.DeadLetters, false))
+
+	case "show":
+		if len(ids) == 0 {
+			return errors.New("dead-letters: show needs at least one id")
+		}
+
+		letters := make([]*store.DeadLetter, 0, len(ids))
+		for _, id := range ids {
+			letter, err := db.GetDeadLetter(&store.DeadLetterRequest{Id: id})
+			if err != nil {
+				return fmt.Errorf("dead letter %d: %s", id, err)
+			}
+			letters = append(letters, letter)
+		}
+		return writeListing(os.Stdout, *format, deadLetterListing(letters, true))
+
+	case "replay":
+		return replayDeadLetters(db, request, ids)
+
+	case "delete":
+		if len(ids) == 0 {
+			return errors.New("dead-letters: delete needs at least one id")
+		}
+
+		for _, id := range ids {
+			if err := db.DeleteDeadLetter(&store.DeadLetterRequest{Id: id}); err != nil {
+				return fmt.Errorf("dead letter %d: %s", id, err)
+			}
+		}
+		fmt.Printf("deleted %d dead letters\n", len(ids))
+		return nil
+
+	case "purge":
+		if request.CustomerId == "" && request.Type == "" && request.Before == nil && !*all {
+			return errors.New("dead-letters: purge without -customer, -type or -before needs -all")
+		}
+
+		response, err := db.PurgeDeadLetters(request)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d dead letters\n", response.Count)
+		return nil
+
+	default:
+		flags.Usage()
+		return fmt.Errorf("dead-letters: unknown action %q", action)
+	}
+}
+
+// replayDeadLetters replays the dead letters with the given ids, or every
+// one matching request when there are none.
+func replayDeadLetters(db store.Store, request *store.DeadLettersRequest, ids []int64) error {
+	var letters []*store.DeadLetter
+	if len(ids) == 0 {
+		response, err := db.ListDeadLetters(request)
+		if err != nil {
+			return err
+		}
+		letters = response.DeadLetters
+	}
+
+	for _, id := range ids {
+		letter, err := db.GetDeadLetter(&store.DeadLetterRequest{Id: id})
+		if err != nil {
+			return fmt.Errorf("dead letter %d: %s", id, err)
+		}
+		letters = append(letters, letter)
+	}
+
+	failed := 0
+	for _, letter := range letters {
+		if err := consumer.ReplayDeadLetter(db, letter); err != nil {
+			fmt.Printf("dead letter %d: %s\n", letter.Id, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("replayed %d dead letters, %d failed\n", len(letters)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("dead-letters: %d replays failed", failed)
+	}
+
+	return nil
+}
+
+func deadLetterListing(letters []*store.DeadLetter, withBody bool) *listing {
+	l := &listing{columns: []string{"id", "customer_id", "type", "attempts", "created_at", "error"}}
+	for _, letter := range letters {
+		r := record{
+			"id":          letter.Id,
+			"customer_id": letter.CustomerId,
+			"account_id":  letter.AccountId,
+			"type":        letter.Type,
+			"source":      letter.Source,
+			"attempts":    letter.Attempts,
+			"error":       letter.Error,
+			"created_at":  timeField(letter.CreatedAt),
+			"updated_at":  timeField(letter.UpdatedAt),
+		}
+
+		if withBody {
+			r["body"] = rawData([]byte(letter.Body))
+		}
+		l.add(r)
+	}
+
+	return l
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/config"
+	"github.com/opsee/fieri/importer"
+	"github.com/opsee/fieri/store"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const importUsage = `usage: fieri import [flags] -customer <id> [-account <id>] [-type <kind>] file.json...
+
+Imports the json output of aws describe commands. The kind defaults to the
+file's name, e.g. fixtures/instances.json imports instances; a file named -
+is read from stdin. The account defaults to the owner id in the output for
+kinds that have one.
+
+kinds: %s
+`
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	customerId := flags.String("customer", "", "customer id to import entities for")
+	accountId := flags.String("account", "", "aws account id to import entities under")
+	kind := flags.String("type", "", "kind of describe output")
+	dryRun := flags.Bool("dry-run", false, "parse and count entities without storing them")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, importUsage, strings.Join(importer.Kinds(), ", "))
+		flags.PrintDefaults()
+	}
+
+	cfg, err := config.Load(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("import: no files given")
+	}
+
+	if *customerId == "" {
+		return errors.New("import: -customer is required")
+	}
+
+	var db store.Store
+	if !*dryRun {
+		if err := cfg.ValidatePostgres(); err != nil {
+			return err
+		}
+
+		db, err = store.NewPostgres(cfg.Postgres())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	for _, path := range flags.Args() {
+		fileKind := *kind
+		if fileKind == "" {
+			fileKind = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+
+		if err := importFile(db, path, fileKind, *customerId, *accountId); err != nil {
+			return fmt.Errorf("import %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+func importFile(db store.Store, path, kind, customerId, accountId string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if db == nil {
+		entities, err := importer.Parse(kind, customerId, accountId, r)
+		if err != nil {
+			return err
+		}
+
+		accounts := make(map[string]int)
+		for _, e := range entities {
+			accounts[e.AccountId]++
+		}
+
+		for account, count := range accounts {
+			fmt.Printf("%s: would import %d %s for account %s\n", path, count, kind, account)
+		}
+		return nil
+	}
+
+	count, err := importer.Import(db, kind, customerId, accountId, r)
+	fmt.Printf("%s: imported %d %s\n", path, count, kind)
+
+	return err
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/config"
+	"github.com/opsee/fieri/service"
+	"github.com/opsee/fieri/store"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const inventoryUsage = `usage: fieri inventory [flags] -customer <id> <query>
+
+Prints what fieri knows about a customer, read from the database or, with
+-api, from a running fieri service.
+
+queries:
+  instances           instances, filtered by -type, -group, -group-type, -endpoint,
+                      -account, -changed-since and -seen-since
+  groups              groups, filtered by -type, -account, -changed-since and
+                      -seen-since
+  group <type> <id>   a group and its instances
+  customer            the customer and its aws accounts
+  counts              instances and groups by type
+`
+
+// inventory is the read side shared by store.Store and service.Client.
+type inventory interface {
+	ListInstances(*store.InstancesRequest) (*store.InstancesResponse, error)
+	ListGroups(*store.GroupsRequest) (*store.GroupsResponse, error)
+	GetGroup(*store.GroupRequest) (*store.GroupResponse, error)
+	GetCustomer(*store.CustomerRequest) (*store.CustomerResponse, error)
+	ListAccounts(*store.AccountsRequest) (*store.AccountsResponse, error)
+}
+
+type inventoryQuery struct {
+	customerId     string
+	accountId      string
+	entityType     string
+	groupId        string
+	groupType      string
+	endpoint       string
+	includeDeleted bool
+	changedSince   *time.Time
+	seenSince      *time.Time
+}
+
+func inventoryCommand(args []string) error {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	q := &inventoryQuery{}
+	flags.StringVar(&q.customerId, "customer", "", "customer id to query")
+	flags.StringVar(&q.accountId, "account", "", "only show entities in this aws account")
+	flags.StringVar(&q.entityType, "type", "", "only show entities of this type, e.g. ec2 or security")
+	flags.StringVar(&q.groupId, "group", "", "only show instances in this group")
+	flags.StringVar(&q.groupType, "group-type", "", "type of the -group filter")
+	flags.StringVar(&q.endpoint, "endpoint", "", "only show the rds instance with this endpoint hostname")
+	flags.BoolVar(&q.includeDeleted, "include-deleted", false, "include expired entities")
+	changedSince := flags.String("changed-since", "", "only show entities whose content changed at or after this RFC 3339 time")
+	seenSince := flags.String("seen-since", "", "only show entities reported at or after this RFC 3339 time")
+	api := flags.String("api", "", "fieri service to query, e.g. http://fieri:9092, instead of the database")
+	format := flags.String("output", "table", "output format: "+strings.Join(outputFormats, ", "))
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, inventoryUsage)
+		flags.PrintDefaults()
+	}
+
+	cfg, err := config.Load(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("inventory: missing query")
+	}
+
+	if q.customerId == "" {
+		return errors.New("inventory: -customer is required")
+	}
+
+	if q.changedSince, err = parseSince("changed-since", *changedSince); err != nil {
+		return err
+	}
+
+	if q.seenSince, err = parseSince("seen-since", *seenSince); err != nil {
+		return err
+	}
+
+	var source inventory
+	if *api != "" {
+		source = service.NewClient(*api, cfg.RequestTimeout)
+	} else {
+		if err := cfg.ValidatePostgres(); err != nil {
+			return err
+		}
+
+		db, err := store.NewPostgres(cfg.Postgres())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		source = db
+	}
+
+	var l *listing
+	switch query := flags.Arg(0); query {
+	case "instances":
+		l, err = listInstances(source, q)
+	case "groups":
+		l, err = listGroups(source, q)
+	case "group":
+		if flags.NArg() != 3 {
+			return errors.New("inventory: usage: group <type> <id>")
+		}
+		l, err = showGroup(source, q, flags.Arg(1), flags.Arg(2))
+	case "customer":
+		l, err = showCustomer(source, q)
+	case "counts":
+		l, err = countInventory(source, q)
+	default:
+		flags.Usage()
+		return fmt.Errorf("inventory: unknown query %q", query)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeListing(os.Stdout, *format, l)
+}
+
+func listInstances(source inventory, q *inventoryQuery) (*listing, error) {
+	response, err := source.ListInstances(&store.InstancesRequest{
+		CustomerId:      q.customerId,
+		AccountId:       q.accountId,
+		GroupId:         q.groupId,
+		GroupType:       q.groupType,
+		Type:            q.entityType,
+		EndpointAddress: q.endpoint,
+		IncludeDeleted:  q.includeDeleted,
+		ChangedSince:    q.changedSince,
+		SeenSince:       q.seenSince,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{columns: instanceColumns(q)}
+	for _, instance := range response.Instances {
+		l.add(instanceRecord(instance))
+	}
+
+	return l, nil
+}
+
+func listGroups(source inventory, q *inventoryQuery) (*listing, error) {
+	response, err := source.ListGroups(&store.GroupsRequest{
+		CustomerId:     q.customerId,
+		AccountId:      q.accountId,
+		Type:           q.entityType,
+		IncludeDeleted: q.includeDeleted,
+		ChangedSince:   q.changedSince,
+		SeenSince:      q.seenSince,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{columns: groupColumns(q)}
+	for _, group := range response.Groups {
+		l.add(groupRecord(group))
+	}
+
+	return l, nil
+}
+
+// showGroup lists a group followed by its instances.
+func showGroup(source inventory, q *inventoryQuery, groupType, groupId string) (*listing, error) {
+	response, err := source.GetGroup(&store.GroupRequest{
+		CustomerId:     q.customerId,
+		AccountId:      q.accountId,
+		GroupId:        groupId,
+		Type:           groupType,
+		IncludeDeleted: q.includeDeleted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	group := groupRecord(response)
+	group["kind"] = "group"
+	l := &listing{columns: append([]string{"kind"}, groupColumns(q)...)}
+	l.add(group)
+
+	for _, instance := range response.Instances {
+		r := instanceRecord(instance)
+		r["kind"] = "instance"
+		r["name"] = r["id"]
+		l.add(r)
+	}
+
+	return l, nil
+}
+
+func showCustomer(source inventory, q *inventoryQuery) (*listing, error) {
+	customer, err := source.GetCustomer(&store.CustomerRequest{Id: q.customerId})
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := source.ListAccounts(&store.AccountsRequest{CustomerId: q.customerId})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{columns: []string{"kind", "id", "last_sync", "created_at"}}
+	l.add(record{
+		"kind":       "customer",
+		"id":         customer.Customer.Id,
+		"last_sync":  timeField(customer.Customer.LastSync),
+		"created_at": timeField(customer.Customer.CreatedAt),
+		"updated_at": timeField(customer.Customer.UpdatedAt),
+	})
+
+	for _, account := range accounts.Accounts {
+		l.add(record{
+			"kind":       "account",
+			"id":         account.Id,
+			"last_sync":  timeField(account.LastSync),
+			"created_at": timeField(account.CreatedAt),
+			"updated_at": timeField(account.UpdatedAt),
+		})
+	}
+
+	return l, nil
+}
+
+// countInventory counts instances and groups by type, honoring the same
+// filters as instances and groups.
+func countInventory(source inventory, q *inventoryQuery) (*listing, error) {
+	instances, err := listInstances(source, q)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := listGroups(source, q)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{columns: []string{"kind", "type", "count"}}
+	for _, counted := range []struct {
+		kind string
+		l    *listing
+	}{{"instance", instances}, {"group", groups}} {
+		counts := make(map[string]int)
+		for _, r := range counted.l.records {
+			counts[r["type"].(string)]++
+		}
+
+		types := make([]string, 0, len(counts))
+		for t := range counts {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+
+		for _, t := range types {
+			l.add(record{"kind": counted.kind, "type": t, "count": counts[t]})
+		}
+	}
+
+	return l, nil
+}
+
+func instanceColumns(q *inventoryQuery) []string {
+	columns := []string{"type", "id", "account_id", "changed_at", "last_seen_at"}
+	if q.entityType == store.DBInstanceStoreType || q.endpoint != "" {
+		columns = append(columns, "endpoint")
+	}
+	if q.includeDeleted {
+		columns = append(columns, "deleted_at")
+	}
+
+	return columns
+}
+
+func groupColumns(q *inventoryQuery) []string {
+	columns := []string{"type", "name", "account_id", "instance_count", "changed_at", "last_seen_at"}
+	if q.includeDeleted {
+		columns = append(columns, "deleted_at")
+	}
+
+	return columns
+}
+
+func instanceRecord(response *store.InstanceResponse) record {
+	r := record{
+		"type":         response.Type,
+		"account_id":   response.AccountId,
+		"changed_at":   timeField(response.ChangedAt),
+		"last_seen_at": timeField(response.LastSeenAt),
+		"deleted_at":   response.DeletedAt,
+	}
+
+	if instance := response.Instance; instance != nil {
+		r["id"] = instance.Id
+		r["created_at"] = timeField(instance.CreatedAt)
+		r["updated_at"] = timeField(instance.UpdatedAt)
+		r["data"] = rawData(instance.Data)
+		if instance.EndpointAddress != nil && instance.EndpointPort != nil {
+			r["endpoint"] = fmt.Sprintf("%s:%d", *instance.EndpointAddress, *instance.EndpointPort)
+		}
+	}
+
+	return r
+}
+
+func groupRecord(response *store.GroupResponse) record {
+	r := record{
+		"type":           response.Type,
+		"account_id":     response.AccountId,
+		"changed_at":     timeField(response.ChangedAt),
+		"last_seen_at":   timeField(response.LastSeenAt),
+		"deleted_at":     response.DeletedAt,
+		"instance_count": response.InstanceCount,
+	}
+
+	if group := response.Group; group != nil {
+		r["name"] = group.Name
+		r["created_at"] = timeField(group.CreatedAt)
+		r["updated_at"] = timeField(group.UpdatedAt)
+		r["data"] = rawData(group.Data)
+	}
+
+	return r
+}
+
+// parseSince parses the RFC 3339 time given to the named flag, if any.
+func parseSince(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("inventory: invalid -%s: %s", name, err)
+	}
+
+	return &t, nil
+}
+
+// timeField leaves out times the source doesn't know, such as entity
+// timestamps when reading through the http service.
+func timeField(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
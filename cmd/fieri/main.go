@@ -1,58 +1,151 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/opsee/fieri/config"
 	"github.com/opsee/fieri/consumer"
 	"github.com/opsee/fieri/service"
 	"github.com/opsee/fieri/store"
 	"github.com/yeller/yeller-golang"
 	"os"
 	"os/signal"
-	"strings"
+	"syscall"
 )
 
+// commands are the subcommands fieri runs instead of serving when named as
+// its first argument.
+var commands = map[string]func(args []string) error{
+	"dead-letters": deadLettersCommand,
+	"import":       importCommand,
+	"inventory":    inventoryCommand,
+	"migrate":      migrateCommand,
+	"replay":       replayCommand,
+}
+
 func main() {
-	yeller.StartWithErrorHandlerEnvApplicationRoot(os.Getenv("YELLER_KEY"), "production", "/build/src/github.com/opsee/fieri", yeller.NewSilentErrorHandler())
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "fieri:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 
-	pgConnection := os.Getenv("POSTGRES_CONN")
-	if pgConnection == "" {
-		log.Fatal("You have to give me a postgres connection by setting the POSTGRES_CONN env var")
+	if cfg.SchemaCheck {
+		if err := checkSchema(cfg); err != nil {
+			log.Fatal(err, "; run fieri migrate up or set schema_check to false")
+		}
 	}
 
-	db, err := store.NewPostgres(pgConnection, 60, 120)
+	printed := &bytes.Buffer{}
+	cfg.Print(printed)
+	log.Info("effective configuration:\n", printed.String())
+
+	yeller.StartWithErrorHandlerEnvApplicationRoot(cfg.YellerKey, "production", "/build/src/github.com/opsee/fieri", yeller.NewSilentErrorHandler())
+
+	db, err := store.NewPostgres(cfg.Postgres())
 	if err != nil {
 		log.Fatal("Error initializing postgres:", err)
 	}
 
-	lookupdHosts := os.Getenv("LOOKUPD_HOSTS")
-	if lookupdHosts == "" {
-		log.Fatal("You'll need to give me a nsqlookupd connection(s) by setting the LOOKUPD_HOSTS env var (comma-separated)")
+	pipeline := consumer.NewPipeline(db, consumer.PipelineConfig{
+		MaxAttempts:  cfg.MaxAttempts,
+		RequeueDelay: cfg.RequeueDelay,
+		BatchSize:    cfg.BatchSize,
+		BatchTimeout: cfg.BatchTimeout,
+	})
+
+	var (
+		sources []consumer.Source
+		events  *consumer.HTTP
+	)
+
+	if cfg.HasSource(config.NsqSource) {
+		nsqSource, err := consumer.NewNsq(consumer.NsqConfig{
+			LookupdHosts:  cfg.LookupdHosts,
+			Topic:         cfg.DiscoveryTopic,
+			Concurrency:   cfg.Concurrency,
+			MaxInFlight:   cfg.MaxInFlight,
+			MinInFlight:   cfg.MinInFlight,
+			AdaptInFlight: cfg.AdaptInFlight,
+			TargetLatency: cfg.TargetLatency,
+			StopTimeout:   cfg.ShutdownTimeout,
+		})
+		if err != nil {
+			log.Fatal("Error initializing nsq consumer:", err)
+		}
+		sources = append(sources, nsqSource)
 	}
 
-	bastionDiscoveryTopic := os.Getenv("BASTION_DISCOVERY_TOPIC")
-	if bastionDiscoveryTopic == "" {
-		log.Fatal("You have to give me a topic to consume by setting the BASTION_DISCOVERY_TOPIC env var")
+	if cfg.HasSource(config.HTTPSource) {
+		events = consumer.NewHTTP(cfg.ShutdownTimeout)
+		sources = append(sources, events)
 	}
 
-	lookupds := strings.Split(lookupdHosts, ",")
-	nsqConsumer, err := consumer.NewNsq(lookupds, db, bastionDiscoveryTopic)
-	if err != nil {
-		log.Fatal("Error initializing nsq consumer:", err)
+	if cfg.HasSource(config.QueueSource) {
+		sources = append(sources, consumer.NewQueue(db, consumer.QueueConfig{
+			Connection:  cfg.PostgresConn,
+			MaxInFlight: cfg.MaxInFlight,
+			StopTimeout: cfg.ShutdownTimeout,
+		}))
 	}
 
-	addr := os.Getenv("FIERI_HTTP_ADDR")
-	if addr == "" {
-		log.Fatal("You have to give me a listening address by setting the FIERI_HTTP_ADDR env var")
+	if err := pipeline.Start(sources...); err != nil {
+		log.Fatal("Error starting event sources:", err)
 	}
 
-	service := service.NewService(db)
-	go service.StartHTTP(addr)
-	go db.Start()
+	server := service.NewService(db, cfg.RequestTimeout).NewHTTPServer(cfg.HTTPAddr, events)
+
+	sup := newSupervisor(cfg.ShutdownTimeout)
+	sup.add(&component{
+		name: "store",
+		run: func() error {
+			db.Start()
+			return nil
+		},
+		stop: func() error {
+			db.Stop()
+			return db.Close()
+		},
+	})
+	sup.add(&component{
+		name: "consumer",
+		run:  pipeline.Wait,
+		stop: pipeline.Stop,
+	})
+	sup.add(&component{
+		name: "http",
+		run:  server.ListenAndServe,
+		stop: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			return server.Shutdown(ctx)
+		},
+	})
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
-	<-interrupt
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	if err := sup.run(signals); err != nil {
+		log.WithError(err).Error("fieri exited with an error")
+		os.Exit(1)
+	}
 
-	nsqConsumer.Stop()
+	log.Info("fieri stopped")
 }
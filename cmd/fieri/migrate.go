@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/opsee/fieri/config"
+	"github.com/opsee/fieri/migrations"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = `usage: fieri migrate [flags] up|down [n|all]|status|version
+
+  up       apply every pending migration
+  down     revert the last n migrations (default 1), or all of them
+  status   list migrations and whether each is applied
+  version  print the database's schema version and the one fieri expects
+`
+
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		flags.PrintDefaults()
+	}
+
+	cfg, err := config.Load(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.ValidatePostgres(); err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch flags.Arg(0) {
+	case "up":
+		ran, err := migrations.Up(db)
+		for _, m := range ran {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(ran) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		switch n := flags.Arg(1); n {
+		case "":
+		case "all":
+			all, err := migrations.All()
+			if err != nil {
+				return err
+			}
+			steps = len(all)
+		default:
+			steps, err = strconv.Atoi(n)
+			if err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: %q is not a positive number of steps", n)
+			}
+		}
+
+		ran, err := migrations.Down(db, steps)
+		for _, m := range ran {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := migrations.StatusOf(db)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%-32s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+
+	case "version":
+		latest, err := migrations.Latest()
+		if err != nil {
+			return err
+		}
+
+		version, err := migrations.Version(db)
+		if err == migrations.ErrNoMigrations {
+			fmt.Printf("database: none\nexpected: %d\n", latest)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("database: %d\nexpected: %d\n", version, latest)
+		return nil
+	}
+
+	flags.Usage()
+	return errors.New("migrate: missing or unknown action")
+}
+
+// openDB connects to the configured database for commands that don't need a
+// whole store.
+func openDB(cfg *config.Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.PostgresConn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// checkSchema refuses to serve against a database whose schema isn't the
+// version this binary was built with.
+func checkSchema(cfg *config.Config) error {
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrations.Check(db)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var outputFormats = []string{"table", "json", "yaml"}
+
+// record is one row of command output. Table output shows the listed columns
+// of each record; json and yaml show all of their fields.
+type record map[string]interface{}
+
+type listing struct {
+	columns []string
+	records []record
+}
+
+func (l *listing) add(r record) {
+	l.records = append(l.records, r)
+}
+
+func writeListing(w io.Writer, format string, l *listing) error {
+	switch format {
+	case "table":
+		return writeTable(w, l)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(l.records)
+	case "yaml":
+		records := make([]interface{}, len(l.records))
+		for i, r := range l.records {
+			records[i] = map[string]interface{}(r)
+		}
+		writeYAML(w, records, 0)
+		return nil
+	}
+
+	return fmt.Errorf("unknown output format %q, must be one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+func writeTable(w io.Writer, l *listing) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(l.columns, "\t")))
+
+	for _, r := range l.records {
+		cells := make([]string, len(l.columns))
+		for i, column := range l.columns {
+			cells[i] = tableCell(r[column])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func tableCell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		if t == "" {
+			return "-"
+		}
+		return t
+	case time.Time:
+		return t.UTC().Format(time.RFC3339)
+	case *time.Time:
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// rawData decodes an entity's json blob so it's shown as a document rather
+// than base64.
+func rawData(data []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return string(data)
+	}
+
+	return v
+}
+
+// writeYAML writes the json-like value v as block style yaml. Strings are
+// written double quoted when needed, which yaml reads the same as json.
+func writeYAML(w io.Writer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			fmt.Fprintf(w, "%s{}\n", pad)
+			return
+		}
+
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if isYAMLScalar(t[k]) {
+				fmt.Fprintf(w, "%s%s: %s\n", pad, yamlString(k), yamlScalar(t[k]))
+				continue
+			}
+
+			fmt.Fprintf(w, "%s%s:\n", pad, yamlString(k))
+			writeYAML(w, t[k], indent+1)
+		}
+
+	case []interface{}:
+		if len(t) == 0 {
+			fmt.Fprintf(w, "%s[]\n", pad)
+			return
+		}
+
+		for _, item := range t {
+			if isYAMLScalar(item) {
+				fmt.Fprintf(w, "%s- %s\n", pad, yamlScalar(item))
+				continue
+			}
+
+			// write the item one level in, then hang its first line off the dash.
+			var b strings.Builder
+			writeYAML(&b, item, indent+1)
+			fmt.Fprintf(w, "%s- %s", pad, strings.TrimPrefix(b.String(), pad+"  "))
+		}
+
+	default:
+		fmt.Fprintf(w, "%s%s\n", pad, yamlScalar(v))
+	}
+}
+
+func isYAMLScalar(v interface{}) bool {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	}
+
+	return true
+}
+
+func yamlScalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return yamlString(t)
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case *time.Time:
+		if t == nil {
+			return "null"
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+
+	return yamlString(fmt.Sprint(v))
+}
+
+func yamlString(s string) string {
+	if s == "" || strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n\t") || strings.TrimSpace(s) != s {
+		return strconv.Quote(s)
+	}
+
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~", "-":
+		return strconv.Quote(s)
+	}
+
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/config"
+	"github.com/opsee/fieri/consumer"
+	"github.com/opsee/fieri/store"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const replayUsage = `usage: fieri replay [flags] events.ndjson...
+
+Replays newline-delimited discovery events, one consumer.Event json object
+per line, through the pipeline the nsq, http and queue sources feed. Events
+failing with a transient error are retried after -requeue-delay, up to
+-max-attempts, and others are dead-lettered. A file named - is read from
+stdin. Events are stored in batches of -batch-size, as from any source.
+`
+
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	rate := flags.Float64("rate", 0, "events per second to replay, or 0 for as fast as possible")
+	dryRun := flags.Bool("dry-run", false, "decode and validate events without storing them")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+
+	cfg, err := config.Load(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("replay: no files given")
+	}
+
+	var db store.Store
+	if !*dryRun {
+		if err := cfg.ValidatePostgres(); err != nil {
+			return err
+		}
+
+		db, err = store.NewPostgres(cfg.Postgres())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if cfg.BatchSize < 1 {
+		return errors.New("replay: -batch-size must be at least 1")
+	}
+
+	pipeline := consumer.NewPipeline(db, consumer.PipelineConfig{
+		MaxAttempts:  cfg.MaxAttempts,
+		RequeueDelay: cfg.RequeueDelay,
+		BatchSize:    cfg.BatchSize,
+		BatchTimeout: cfg.BatchTimeout,
+		DryRun:       *dryRun,
+	})
+
+	start := time.Now()
+	read := 0
+	for _, path := range flags.Args() {
+		n, err := replayFile(pipeline, path, consumer.FileConfig{Name: path, Rate: *rate}, signals)
+		read += n
+
+		if err != nil {
+			pipeline.Stop()
+			return fmt.Errorf("replay %s: %s", path, err)
+		}
+	}
+
+	if err := pipeline.Stop(); err != nil {
+		return err
+	}
+
+	stored := "stored"
+	if *dryRun {
+		stored = "would be stored"
+	}
+
+	stats := pipeline.Stats()
+	elapsed := time.Since(start)
+	fmt.Printf("read %d events: %d %s, %d stale, %d failed, %d requeues\n", read, stats.Stored, stored, stats.Stale, stats.Failed, stats.Requeued)
+	fmt.Printf("took %s, %.1f events/s\n", elapsed, float64(read)/elapsed.Seconds())
+	if stats.Failed > 0 {
+		return fmt.Errorf("replay: %d events failed", stats.Failed)
+	}
+
+	return nil
+}
+
+// replayFile delivers a file's events to the pipeline, returning once each
+// has been handled and how many were read.
+func replayFile(pipeline *consumer.Pipeline, path string, config consumer.FileConfig, signals <-chan os.Signal) (int, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	events, err := consumer.NewFile(r, config)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := pipeline.Start(events); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-events.Done():
+	case <-signals:
+		events.Stop()
+		return events.Delivered(), errors.New("interrupted")
+	}
+
+	return events.Delivered(), events.Err()
+}
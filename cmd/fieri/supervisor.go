@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// component is a long running part of the process managed by a supervisor.
+// run blocks for as long as the component is up and may be nil for
+// components that run in the background; returning from run before the
+// supervisor stops the component means it died. stop asks the component to
+// finish its in-flight work and stop.
+type component struct {
+	name string
+	run  func() error
+	stop func() error
+}
+
+type componentExit struct {
+	name string
+	err  error
+}
+
+// supervisor starts a set of components and stops all of them, in reverse
+// order, when the process is signalled or any one of them dies.
+type supervisor struct {
+	components []*component
+	timeout    time.Duration
+}
+
+var errShutdownTimeout = errors.New("timed out waiting for shutdown")
+
+func newSupervisor(timeout time.Duration) *supervisor {
+	return &supervisor{timeout: timeout}
+}
+
+func (s *supervisor) add(c *component) {
+	s.components = append(s.components, c)
+}
+
+// run starts every component and blocks until a signal arrives or a
+// component exits, then shuts everything down. It returns an error if a
+// component died or the shutdown didn't finish cleanly within the timeout.
+func (s *supervisor) run(signals <-chan os.Signal) error {
+	exits := make(chan componentExit, len(s.components))
+
+	for _, c := range s.components {
+		if c.run == nil {
+			continue
+		}
+
+		log.WithField("component", c.name).Info("starting component")
+		go func(c *component) {
+			exits <- componentExit{c.name, c.run()}
+		}(c)
+	}
+
+	var died error
+
+	select {
+	case sig := <-signals:
+		log.WithField("signal", sig).Info("received signal, shutting down")
+
+	case exit := <-exits:
+		died = fmt.Errorf("component %s exited: %v", exit.name, exit.err)
+		log.WithError(died).Error("component died, shutting down")
+	}
+
+	err := s.shutdown()
+	if died != nil {
+		return died
+	}
+
+	return err
+}
+
+func (s *supervisor) shutdown() error {
+	done := make(chan error, 1)
+	go func() {
+		var firstErr error
+
+		for i := len(s.components) - 1; i >= 0; i-- {
+			c := s.components[i]
+			logger := log.WithField("component", c.name)
+			logger.Info("stopping component")
+
+			if err := c.stop(); err != nil {
+				logger.WithError(err).Error("error stopping component")
+				if firstErr == nil {
+					firstErr = fmt.Errorf("component %s: %v", c.name, err)
+				}
+			}
+		}
+
+		done <- firstErr
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(s.timeout):
+		return errShutdownTimeout
+	}
+}
@@ -0,0 +1,641 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every tunable of a fieri process. Values are loaded, from
+// lowest to highest precedence, from defaults, an optional JSON or YAML file,
+// environment variables and command line flags.
+type Config struct {
+	File string
+
+	PostgresConn         string
+	PostgresMaxOpenConns int
+	PostgresMaxIdleConns int
+
+	Sources        []string
+	LookupdHosts   []string
+	DiscoveryTopic string
+	Concurrency    int
+	MaxInFlight    int
+	MinInFlight    int
+	AdaptInFlight  bool
+	TargetLatency  time.Duration
+	MaxAttempts    int
+	RequeueDelay   time.Duration
+	BatchSize      int
+	BatchTimeout   time.Duration
+
+	HTTPAddr        string
+	RequestTimeout  time.Duration
+	ShutdownTimeout time.Duration
+
+	ExpireInterval time.Duration
+	ExpireTTL      time.Duration
+	ExpireTTLs     map[string]time.Duration
+	Retention      time.Duration
+
+	SchemaCheck bool
+
+	YellerKey string
+}
+
+// setting describes one configuration knob. Its key names it in config files
+// and, with underscores replaced by dashes, as a command line flag.
+type setting struct {
+	key    string
+	env    string
+	usage  string
+	secret bool
+	set    func(c *Config, v string) error
+	get    func(c *Config) string
+}
+
+var settings = []*setting{
+	{
+		key:   "postgres_conn",
+		env:   "POSTGRES_CONN",
+		usage: "postgres connection url or key=value string",
+		set:   func(c *Config, v string) error { c.PostgresConn = v; return nil },
+		get:   func(c *Config) string { return redactConn(c.PostgresConn) },
+	},
+	{
+		key:   "postgres_max_open_conns",
+		env:   "FIERI_POSTGRES_MAX_OPEN_CONNS",
+		usage: "maximum open postgres connections",
+		set:   func(c *Config, v string) error { return setInt(&c.PostgresMaxOpenConns, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.PostgresMaxOpenConns) },
+	},
+	{
+		key:   "postgres_max_idle_conns",
+		env:   "FIERI_POSTGRES_MAX_IDLE_CONNS",
+		usage: "maximum idle postgres connections",
+		set:   func(c *Config, v string) error { return setInt(&c.PostgresMaxIdleConns, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.PostgresMaxIdleConns) },
+	},
+	{
+		key:   "sources",
+		env:   "FIERI_SOURCES",
+		usage: "comma-separated event sources: " + strings.Join(Sources, ", "),
+		set:   func(c *Config, v string) error { c.Sources = splitList(v); return nil },
+		get:   func(c *Config) string { return strings.Join(c.Sources, ",") },
+	},
+	{
+		key:   "lookupd_hosts",
+		env:   "LOOKUPD_HOSTS",
+		usage: "comma-separated nsqlookupd http addresses",
+		set:   func(c *Config, v string) error { c.LookupdHosts = splitList(v); return nil },
+		get:   func(c *Config) string { return strings.Join(c.LookupdHosts, ",") },
+	},
+	{
+		key:   "discovery_topic",
+		env:   "BASTION_DISCOVERY_TOPIC",
+		usage: "nsq topic of bastion discovery events",
+		set:   func(c *Config, v string) error { c.DiscoveryTopic = v; return nil },
+		get:   func(c *Config) string { return c.DiscoveryTopic },
+	},
+	{
+		key:   "concurrency",
+		env:   "FIERI_CONCURRENCY",
+		usage: "number of concurrent nsq message handlers",
+		set:   func(c *Config, v string) error { return setInt(&c.Concurrency, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.Concurrency) },
+	},
+	{
+		key:   "max_in_flight",
+		env:   "FIERI_MAX_IN_FLIGHT",
+		usage: "maximum nsq messages in flight",
+		set:   func(c *Config, v string) error { return setInt(&c.MaxInFlight, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.MaxInFlight) },
+	},
+	{
+		key:   "adapt_in_flight",
+		env:   "FIERI_ADAPT_IN_FLIGHT",
+		usage: "adjust nsq messages in flight between min_in_flight and max_in_flight by write latency and errors",
+		set:   func(c *Config, v string) error { return setBool(&c.AdaptInFlight, v) },
+		get:   func(c *Config) string { return strconv.FormatBool(c.AdaptInFlight) },
+	},
+	{
+		key:   "min_in_flight",
+		env:   "FIERI_MIN_IN_FLIGHT",
+		usage: "fewest nsq messages in flight when adapting",
+		set:   func(c *Config, v string) error { return setInt(&c.MinInFlight, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.MinInFlight) },
+	},
+	{
+		key:   "target_latency",
+		env:   "FIERI_TARGET_LATENCY",
+		usage: "average write latency above which messages in flight are cut when adapting",
+		set:   func(c *Config, v string) error { return setDuration(&c.TargetLatency, v) },
+		get:   func(c *Config) string { return c.TargetLatency.String() },
+	},
+	{
+		key:   "max_attempts",
+		env:   "FIERI_MAX_ATTEMPTS",
+		usage: "attempts at a message failing with transient errors before it's dead-lettered",
+		set:   func(c *Config, v string) error { return setInt(&c.MaxAttempts, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.MaxAttempts) },
+	},
+	{
+		key:   "requeue_delay",
+		env:   "FIERI_REQUEUE_DELAY",
+		usage: "delay before retrying a message, doubled with each attempt",
+		set:   func(c *Config, v string) error { return setDuration(&c.RequeueDelay, v) },
+		get:   func(c *Config) string { return c.RequeueDelay.String() },
+	},
+	{
+		key:   "batch_size",
+		env:   "FIERI_BATCH_SIZE",
+		usage: "nsq messages written together in one transaction, or 1 to write each on its own",
+		set:   func(c *Config, v string) error { return setInt(&c.BatchSize, v) },
+		get:   func(c *Config) string { return strconv.Itoa(c.BatchSize) },
+	},
+	{
+		key:   "batch_timeout",
+		env:   "FIERI_BATCH_TIMEOUT",
+		usage: "longest a message waits for its batch to fill before it's written",
+		set:   func(c *Config, v string) error { return setDuration(&c.BatchTimeout, v) },
+		get:   func(c *Config) string { return c.BatchTimeout.String() },
+	},
+	{
+		key:   "http_addr",
+		env:   "FIERI_HTTP_ADDR",
+		usage: "http listen address",
+		set:   func(c *Config, v string) error { c.HTTPAddr = v; return nil },
+		get:   func(c *Config) string { return c.HTTPAddr },
+	},
+	{
+		key:   "request_timeout",
+		env:   "FIERI_REQUEST_TIMEOUT",
+		usage: "time allowed for an http request to be handled",
+		set:   func(c *Config, v string) error { return setDuration(&c.RequestTimeout, v) },
+		get:   func(c *Config) string { return c.RequestTimeout.String() },
+	},
+	{
+		key:   "shutdown_timeout",
+		env:   "FIERI_SHUTDOWN_TIMEOUT",
+		usage: "time allowed to drain in-flight work on shutdown",
+		set:   func(c *Config, v string) error { return setDuration(&c.ShutdownTimeout, v) },
+		get:   func(c *Config) string { return c.ShutdownTimeout.String() },
+	},
+	{
+		key:   "expire_interval",
+		env:   "FIERI_EXPIRE_INTERVAL",
+		usage: "time between expiry sweeps",
+		set:   func(c *Config, v string) error { return setDuration(&c.ExpireInterval, v) },
+		get:   func(c *Config) string { return c.ExpireInterval.String() },
+	},
+	{
+		key:   "expire_ttl",
+		env:   "FIERI_EXPIRE_TTL",
+		usage: "default time an entity may go unseen before it's expired",
+		set:   func(c *Config, v string) error { return setDuration(&c.ExpireTTL, v) },
+		get:   func(c *Config) string { return c.ExpireTTL.String() },
+	},
+	{
+		key:   "expire_ttls",
+		env:   "FIERI_EXPIRE_TTLS",
+		usage: "comma-separated per-type ttls, e.g. autoscaling=5m,rds=1h",
+		set: func(c *Config, v string) error {
+			ttls, err := store.ParseTTLs(v)
+			if err != nil {
+				return err
+			}
+
+			c.ExpireTTLs = ttls
+			return nil
+		},
+		get: func(c *Config) string { return formatTTLs(c.ExpireTTLs) },
+	},
+	{
+		key:   "retention",
+		env:   "FIERI_RETENTION",
+		usage: "time expired entities are kept before they're purged",
+		set:   func(c *Config, v string) error { return setDuration(&c.Retention, v) },
+		get:   func(c *Config) string { return c.Retention.String() },
+	},
+	{
+		key:   "schema_check",
+		env:   "FIERI_SCHEMA_CHECK",
+		usage: "refuse to serve unless the database schema matches this binary",
+		set:   func(c *Config, v string) error { return setBool(&c.SchemaCheck, v) },
+		get:   func(c *Config) string { return strconv.FormatBool(c.SchemaCheck) },
+	},
+	{
+		key:    "yeller_key",
+		env:    "YELLER_KEY",
+		usage:  "yeller api key",
+		secret: true,
+		set:    func(c *Config, v string) error { c.YellerKey = v; return nil },
+		get:    func(c *Config) string { return c.YellerKey },
+	},
+}
+
+// the event sources fieri can take events from.
+const (
+	NsqSource   = "nsq"
+	HTTPSource  = "http"
+	QueueSource = "postgres"
+)
+
+var Sources = []string{NsqSource, HTTPSource, QueueSource}
+
+const (
+	configFileEnv  = "FIERI_CONFIG"
+	configFileFlag = "config"
+)
+
+// Default returns the configuration used when nothing overrides it.
+func Default() *Config {
+	return &Config{
+		PostgresMaxOpenConns: 64,
+		PostgresMaxIdleConns: 8,
+		Sources:              []string{NsqSource},
+		Concurrency:          4,
+		MaxInFlight:          4,
+		MinInFlight:          1,
+		TargetLatency:        250 * time.Millisecond,
+		MaxAttempts:          5,
+		RequeueDelay:         5 * time.Second,
+		BatchSize:            1,
+		BatchTimeout:         100 * time.Millisecond,
+		RequestTimeout:       5 * time.Second,
+		ShutdownTimeout:      30 * time.Second,
+		ExpireInterval:       60 * time.Second,
+		ExpireTTL:            120 * time.Second,
+		ExpireTTLs:           map[string]time.Duration{},
+		Retention:            7 * 24 * time.Hour,
+		SchemaCheck:          true,
+	}
+}
+
+// Load builds a configuration from defaults, the config file named by the
+// -config flag or FIERI_CONFIG, the environment and flags. It registers the
+// configuration flags on flags before parsing args with it, so callers may
+// add flags of their own and read the remaining arguments afterwards. It
+// does not validate the result.
+func Load(flags *flag.FlagSet, args []string) (*Config, error) {
+	flagValues := make(map[string]string)
+
+	configFile := flags.String(configFileFlag, os.Getenv(configFileEnv), "path to a json or yaml config file")
+	for _, s := range settings {
+		flags.Var(&flagValue{key: s.key, values: flagValues}, flagName(s.key), fmt.Sprintf("%s (%s)", s.usage, s.env))
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	c.File = *configFile
+
+	if c.File != "" {
+		values, err := readFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.apply(values, "config file "+c.File); err != nil {
+			return nil, err
+		}
+	}
+
+	env := make(map[string]string)
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			env[s.key] = v
+		}
+	}
+
+	if err := c.apply(env, "environment"); err != nil {
+		return nil, err
+	}
+
+	if err := c.apply(flagValues, "flags"); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) apply(values map[string]string, source string) error {
+	known := make(map[string]bool, len(settings))
+
+	for _, s := range settings {
+		known[s.key] = true
+
+		v, ok := values[s.key]
+		if !ok {
+			continue
+		}
+
+		if err := s.set(c, v); err != nil {
+			return fmt.Errorf("%s: invalid %s: %s", source, s.key, err)
+		}
+	}
+
+	for key := range values {
+		if !known[key] {
+			return fmt.Errorf("%s: unknown setting %s", source, key)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the configuration needed to run the fieri service,
+// returning every problem found at once.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if len(c.Sources) == 0 {
+		problems = append(problems, "sources (FIERI_SOURCES) is required")
+	}
+
+	for _, source := range c.Sources {
+		if !isSource(source) {
+			problems = append(problems, fmt.Sprintf("sources: unknown source %q, must be one of %s", source, strings.Join(Sources, ", ")))
+		}
+	}
+
+	if c.HasSource(NsqSource) {
+		if len(c.LookupdHosts) == 0 {
+			problems = append(problems, "lookupd_hosts (LOOKUPD_HOSTS) is required")
+		}
+
+		for _, host := range c.LookupdHosts {
+			if _, err := url.Parse(host); err != nil {
+				problems = append(problems, fmt.Sprintf("lookupd_hosts: invalid address %q", host))
+			}
+		}
+
+		if c.DiscoveryTopic == "" {
+			problems = append(problems, "discovery_topic (BASTION_DISCOVERY_TOPIC) is required")
+		}
+	}
+
+	if c.HTTPAddr == "" {
+		problems = append(problems, "http_addr (FIERI_HTTP_ADDR) is required")
+	}
+
+	if c.Concurrency < 1 {
+		problems = append(problems, "concurrency must be at least 1")
+	}
+
+	if c.MaxInFlight < c.Concurrency {
+		problems = append(problems, "max_in_flight must be at least concurrency")
+	}
+
+	if c.AdaptInFlight {
+		if c.MinInFlight < 1 || c.MinInFlight > c.MaxInFlight {
+			problems = append(problems, "min_in_flight must be between 1 and max_in_flight")
+		}
+
+		if c.BatchSize > 1 && c.MinInFlight < c.BatchSize {
+			problems = append(problems, "min_in_flight must be at least batch_size")
+		}
+
+		if c.TargetLatency <= 0 {
+			problems = append(problems, "target_latency must be positive")
+		}
+	}
+
+	if c.MaxAttempts < 1 {
+		problems = append(problems, "max_attempts must be at least 1")
+	}
+
+	if c.RequeueDelay <= 0 {
+		problems = append(problems, "requeue_delay must be positive")
+	}
+
+	if c.BatchSize < 1 {
+		problems = append(problems, "batch_size must be at least 1")
+	}
+
+	if c.BatchSize > 1 && c.MaxInFlight < c.BatchSize {
+		problems = append(problems, "max_in_flight must be at least batch_size")
+	}
+
+	if c.BatchTimeout <= 0 {
+		problems = append(problems, "batch_timeout must be positive")
+	}
+
+	if c.RequestTimeout <= 0 {
+		problems = append(problems, "request_timeout must be positive")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+
+	if c.ExpireInterval <= 0 {
+		problems = append(problems, "expire_interval must be positive")
+	}
+
+	if c.ExpireTTL <= 0 {
+		problems = append(problems, "expire_ttl must be positive")
+	}
+
+	if c.Retention < 0 {
+		problems = append(problems, "retention must not be negative")
+	}
+
+	if err := c.ValidatePostgres(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// ValidatePostgres checks only the database configuration, for commands that
+// need nothing else.
+func (c *Config) ValidatePostgres() error {
+	var problems []string
+
+	if c.PostgresConn == "" {
+		problems = append(problems, "postgres_conn (POSTGRES_CONN) is required")
+	} else if _, err := url.Parse(c.PostgresConn); err != nil {
+		problems = append(problems, "postgres_conn is not a valid url")
+	}
+
+	if c.PostgresMaxOpenConns < 1 {
+		problems = append(problems, "postgres_max_open_conns must be at least 1")
+	}
+
+	if c.PostgresMaxIdleConns < 0 || c.PostgresMaxIdleConns > c.PostgresMaxOpenConns {
+		problems = append(problems, "postgres_max_idle_conns must be between 0 and postgres_max_open_conns")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Print writes the effective configuration with secrets redacted.
+func (c *Config) Print(w io.Writer) {
+	if c.File != "" {
+		fmt.Fprintf(w, "%s = %s\n", configFileFlag, c.File)
+	}
+
+	for _, s := range settings {
+		v := s.get(c)
+		if s.secret && v != "" {
+			v = "<redacted>"
+		}
+
+		fmt.Fprintf(w, "%s = %s\n", s.key, v)
+	}
+}
+
+// Postgres returns the store configuration.
+func (c *Config) Postgres() store.PostgresConfig {
+	return store.PostgresConfig{
+		Connection:   c.PostgresConn,
+		MaxOpenConns: c.PostgresMaxOpenConns,
+		MaxIdleConns: c.PostgresMaxIdleConns,
+		Expiry: store.ExpiryConfig{
+			Interval:   c.ExpireInterval,
+			DefaultTTL: c.ExpireTTL,
+			TTLs:       c.ExpireTTLs,
+			Retention:  c.Retention,
+		},
+	}
+}
+
+type flagValue struct {
+	key    string
+	values map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f.values == nil {
+		return ""
+	}
+
+	return f.values[f.key]
+}
+
+func (f *flagValue) Set(v string) error {
+	f.values[f.key] = v
+	return nil
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+func setInt(dst *int, v string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", v)
+	}
+
+	*dst = i
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", v)
+	}
+
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration, e.g. 30s or 5m", v)
+	}
+
+	*dst = d
+	return nil
+}
+
+// HasSource reports whether events are taken from the named source.
+func (c *Config) HasSource(source string) bool {
+	for _, s := range c.Sources {
+		if s == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSource(source string) bool {
+	for _, s := range Sources {
+		if s == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitList(v string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+func formatTTLs(ttls map[string]time.Duration) string {
+	pairs := make([]string, 0, len(ttls))
+	for entityType, ttl := range ttls {
+		pairs = append(pairs, entityType+"="+ttl.String())
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// connPassword matches the password of a key=value connection string,
+// quoted or not.
+var connPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactConn hides the password of a postgres connection, given either as a
+// url or as a lib/pq key=value string.
+func redactConn(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return connPassword.ReplaceAllString(raw, "${1}redacted")
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		}
+	}
+
+	if query := u.Query(); query.Get("password") != "" {
+		query.Set("password", "redacted")
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
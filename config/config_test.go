@@ -0,0 +1,39 @@
+package config
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedactConn(t *testing.T) {
+	tests := []struct {
+		name string
+		conn string
+		want string
+	}{
+		{"url", "postgres://fieri:secret@db:5432/fieri?sslmode=disable", "postgres://fieri:redacted@db:5432/fieri?sslmode=disable"},
+		{"url without password", "postgres://fieri@db/fieri", "postgres://fieri@db/fieri"},
+		{"url with password parameter", "postgres://db/fieri?password=secret&user=fieri", "postgres://db/fieri?password=redacted&user=fieri"},
+		{"key=value", "host=db user=fieri password=secret dbname=fieri", "host=db user=fieri password=redacted dbname=fieri"},
+		{"key=value quoted", "host=db password='sec ret \\' x' dbname=fieri", "host=db password=redacted dbname=fieri"},
+		{"key=value spaced", "host=db password = secret", "host=db password = redacted"},
+		{"key=value without password", "host=db user=fieri sslmode=disable", "host=db user=fieri sslmode=disable"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, redactConn(test.conn), test.name)
+	}
+}
+
+func TestPrintRedactsPostgresConn(t *testing.T) {
+	for _, conn := range []string{"postgres://fieri:secret@db/fieri", "host=db user=fieri password=secret"} {
+		c := Default()
+		c.PostgresConn = conn
+
+		var out bytes.Buffer
+		c.Print(&out)
+		assert.NotContains(t, out.String(), "secret", conn)
+		assert.Contains(t, out.String(), "redacted", conn)
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readFile reads a config file into setting values keyed by setting key.
+// Files ending in .json are parsed as a JSON object; anything else as YAML.
+func readFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		values, err = parseJSON(data)
+	} else {
+		values, err = parseYAML(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %s", path, err)
+	}
+
+	return values, nil
+}
+
+// parseJSON flattens a JSON object into setting values. Arrays become
+// comma-separated lists and objects become comma-separated key=value pairs,
+// matching the environment variable syntax.
+func parseJSON(data []byte) (map[string]string, error) {
+	raw := make(map[string]interface{})
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		s, err := jsonString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+
+		values[key] = s
+	}
+
+	return values, nil
+}
+
+func jsonString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+
+	case json.Number:
+		return t.String(), nil
+
+	case bool:
+		return strconv.FormatBool(t), nil
+
+	case []interface{}:
+		items := make([]string, len(t))
+		for i, item := range t {
+			s, err := jsonString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+
+		return strings.Join(items, ","), nil
+
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(t))
+		for key, item := range t {
+			s, err := jsonString(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+
+		return strings.Join(pairs, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// parseYAML parses the flat subset of YAML fieri's settings need: top level
+// "key: value" pairs, where a value may be a scalar, an inline [a, b] list,
+// a block list of "- item" lines, or a block mapping of indented
+// "name: value" lines. A key with no value and nothing under it is set
+// empty. Comments and blank lines are ignored.
+func parseYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+
+	var (
+		key   string
+		items []string
+		pairs []string
+	)
+
+	flush := func() {
+		if key == "" {
+			return
+		}
+
+		switch {
+		case len(items) > 0:
+			values[key] = strings.Join(items, ",")
+		case len(pairs) > 0:
+			values[key] = strings.Join(pairs, ",")
+		default:
+			values[key] = ""
+		}
+
+		key, items, pairs = "", nil, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		trimmed := strings.TrimSpace(line)
+
+		if indented {
+			if key == "" {
+				return nil, fmt.Errorf("line %d: unexpected indentation", n)
+			}
+
+			if strings.HasPrefix(trimmed, "- ") && len(pairs) == 0 {
+				items = append(items, unquote(strings.TrimSpace(trimmed[2:])))
+				continue
+			}
+
+			name, value, ok := splitYAMLPair(trimmed)
+			if !ok || len(items) > 0 {
+				return nil, fmt.Errorf("line %d: expected \"- item\" or \"name: value\"", n)
+			}
+
+			pairs = append(pairs, name+"="+value)
+			continue
+		}
+
+		flush()
+
+		name, value, ok := splitYAMLPair(trimmed)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+
+		if value == "" {
+			key = name
+			continue
+		}
+
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			list := make([]string, 0)
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = unquote(strings.TrimSpace(item)); item != "" {
+					list = append(list, item)
+				}
+			}
+			value = strings.Join(list, ",")
+		}
+
+		values[name] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush()
+
+	return values, nil
+}
+
+func splitYAMLPair(s string) (string, string, bool) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", false
+	}
+
+	return strings.TrimSpace(parts[0]), unquote(strings.TrimSpace(parts[1])), true
+}
+
+func stripComment(line string) string {
+	inQuote := rune(0)
+	for i, r := range line {
+		switch {
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		values map[string]string
+		err    string
+	}{
+		{
+			name:   "scalars",
+			yaml:   "postgres_conn: postgres://db/fieri\nmax_in_flight: 8\nadapt_in_flight: true\n",
+			values: map[string]string{"postgres_conn": "postgres://db/fieri", "max_in_flight": "8", "adapt_in_flight": "true"},
+		},
+		{
+			name:   "quotes and comments",
+			yaml:   "---\n# fieri\ndiscovery_topic: \"_.discovery\" # bastions\n\nhttp_addr: ':9092'\nyeller_key: a#b\n",
+			values: map[string]string{"discovery_topic": "_.discovery", "http_addr": ":9092", "yeller_key": "a#b"},
+		},
+		{
+			name:   "inline list",
+			yaml:   "lookupd_hosts: [http://a:4161, 'http://b:4161', ]\n",
+			values: map[string]string{"lookupd_hosts": "http://a:4161,http://b:4161"},
+		},
+		{
+			name:   "block list",
+			yaml:   "lookupd_hosts:\n  - http://a:4161\n  - \"http://b:4161\"\nsources: nsq\n",
+			values: map[string]string{"lookupd_hosts": "http://a:4161,http://b:4161", "sources": "nsq"},
+		},
+		{
+			name:   "block mapping",
+			yaml:   "expire_ttls:\n  autoscaling: 5m\n  rds: 1h\n",
+			values: map[string]string{"expire_ttls": "autoscaling=5m,rds=1h"},
+		},
+		{
+			name:   "empty keys",
+			yaml:   "lookupd_hosts:\nsources: http\nexpire_ttls:\n",
+			values: map[string]string{"lookupd_hosts": "", "sources": "http", "expire_ttls": ""},
+		},
+		{
+			name: "indentation without a key",
+			yaml: "  - http://a:4161\n",
+			err:  "line 1: unexpected indentation",
+		},
+		{
+			name: "list and mapping mixed",
+			yaml: "expire_ttls:\n  - rds\n  autoscaling: 5m\n",
+			err:  "line 3: expected \"- item\" or \"name: value\"",
+		},
+		{
+			name: "not a pair",
+			yaml: "postgres_conn\n",
+			err:  "line 1: expected \"key: value\"",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := parseYAML([]byte(test.yaml))
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.values, values)
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	values, err := parseJSON([]byte(`{"max_in_flight": 8, "adapt_in_flight": true, "lookupd_hosts": ["http://a:4161", "http://b:4161"], "expire_ttls": {"rds": "1h", "autoscaling": "5m"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"max_in_flight":   "8",
+		"adapt_in_flight": "true",
+		"lookupd_hosts":   "http://a:4161,http://b:4161",
+		"expire_ttls":     "autoscaling=5m,rds=1h",
+	}, values)
+
+	_, err = parseJSON([]byte(`{"lookupd_hosts": [null]}`))
+	assert.EqualError(t, err, "lookupd_hosts: unsupported value <nil>")
+}
+
+func TestApplyEmptyFileValue(t *testing.T) {
+	c := Default()
+	c.LookupdHosts = []string{"http://a:4161"}
+
+	values, err := parseYAML([]byte("lookupd_hosts:\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.apply(values, "config file"))
+	assert.Empty(t, c.LookupdHosts)
+}
@@ -0,0 +1,135 @@
+package consumer
+
+import (
+	"expvar"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/store"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptInterval is how often messages in flight are adjusted, from the
+	// writes made since the last adjustment.
+	adaptInterval = 2 * time.Second
+
+	// maxErrorRate is the share of writes failing with transient database
+	// errors above which messages in flight are cut.
+	maxErrorRate = 0.05
+)
+
+// these are served with the other expvars at /debug/vars.
+var (
+	maxInFlight    = expvar.NewInt("nsq_max_in_flight")
+	writeLatency   = expvar.NewFloat("nsq_write_latency_ms")
+	writeErrorRate = expvar.NewFloat("nsq_write_error_rate")
+)
+
+// inFlightController adapts a source's max in flight to how postgres is
+// coping, AIMD style: it grows by one each interval while writes are
+// faster than the target latency and rarely fail, and halves when they're
+// slower or fail more often, staying between min and max. A batch counts as
+// a single write.
+type inFlightController struct {
+	set    func(int)
+	min    int
+	max    int
+	target time.Duration
+
+	mut      sync.Mutex
+	current  int
+	writes   int
+	failures int
+	latency  time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newInFlightController(set func(int), min, max int, target time.Duration) *inFlightController {
+	c := &inFlightController{
+		set:     set,
+		min:     min,
+		max:     max,
+		target:  target,
+		current: min,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	set(c.current)
+	maxInFlight.Set(int64(c.current))
+	go c.run()
+
+	return c
+}
+
+// observe records a write and its result. Only transient errors count
+// against the error rate, since other failures say nothing about load.
+func (c *inFlightController) observe(latency time.Duration, err error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.writes++
+	c.latency += latency
+	if store.IsTransient(err) {
+		c.failures++
+	}
+}
+
+func (c *inFlightController) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+func (c *inFlightController) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.adapt()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// adapt adjusts max in flight from the writes since it last ran. Without
+// writes there's nothing to go on, so it's left as it is.
+func (c *inFlightController) adapt() {
+	c.mut.Lock()
+	writes, failures, latency := c.writes, c.failures, c.latency
+	c.writes, c.failures, c.latency = 0, 0, 0
+	c.mut.Unlock()
+
+	if writes == 0 {
+		return
+	}
+
+	average := latency / time.Duration(writes)
+	errorRate := float64(failures) / float64(writes)
+	writeLatency.Set(average.Seconds() * 1000)
+	writeErrorRate.Set(errorRate)
+
+	next := c.current
+	if average > c.target || errorRate > maxErrorRate {
+		next = c.current / 2
+		if next < c.min {
+			next = c.min
+		}
+	} else if c.current < c.max {
+		next = c.current + 1
+	}
+
+	if next == c.current {
+		return
+	}
+
+	log.WithFields(log.Fields{"from": c.current, "to": next, "latency": average, "error_rate": errorRate}).Info("adjusting nsq max in flight")
+	c.current = next
+	c.set(next)
+	maxInFlight.Set(int64(next))
+}
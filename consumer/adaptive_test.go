@@ -0,0 +1,72 @@
+package consumer
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// observedWrite is a write observed by the controller, repeated n times.
+type observedWrite struct {
+	n       int
+	latency time.Duration
+	err     error
+}
+
+func TestInFlightAdapt(t *testing.T) {
+	transient := &pq.Error{Code: "40001"}
+
+	tests := []struct {
+		name    string
+		current int
+		writes  []observedWrite
+		next    int
+	}{
+		{"no writes", 8, nil, 8},
+		{"fast writes grow by one", 8, []observedWrite{{10, 20 * time.Millisecond, nil}}, 9},
+		{"fast writes at max", 16, []observedWrite{{10, 20 * time.Millisecond, nil}}, 16},
+		{"slow writes halve", 9, []observedWrite{{10, 200 * time.Millisecond, nil}}, 4},
+		{"slow on average halves", 8, []observedWrite{{9, 20 * time.Millisecond, nil}, {1, time.Second, nil}}, 4},
+		{"halving stops at min", 3, []observedWrite{{10, 200 * time.Millisecond, nil}}, 2},
+		{"transient errors over the rate halve", 8, []observedWrite{{9, 20 * time.Millisecond, nil}, {1, 20 * time.Millisecond, transient}}, 4},
+		{"transient errors at the rate grow", 8, []observedWrite{{19, 20 * time.Millisecond, nil}, {1, 20 * time.Millisecond, transient}}, 9},
+		{"other errors don't count", 8, []observedWrite{{5, 20 * time.Millisecond, nil}, {5, 20 * time.Millisecond, errors.New("malformed")}}, 9},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var set []int
+			c := &inFlightController{
+				set:     func(n int) { set = append(set, n) },
+				min:     2,
+				max:     16,
+				target:  100 * time.Millisecond,
+				current: test.current,
+			}
+			maxInFlight.Set(int64(test.current))
+
+			for _, w := range test.writes {
+				for i := 0; i < w.n; i++ {
+					c.observe(w.latency, w.err)
+				}
+			}
+			c.adapt()
+
+			assert.Equal(t, test.next, c.current)
+			assert.Equal(t, int64(test.next), maxInFlight.Value())
+			if test.next == test.current {
+				assert.Empty(t, set)
+			} else {
+				assert.Equal(t, []int{test.next}, set)
+			}
+
+			// the writes were used up, so adapting again changes nothing.
+			calls := len(set)
+			c.adapt()
+			assert.Equal(t, test.next, c.current)
+			assert.Len(t, set, calls)
+		})
+	}
+}
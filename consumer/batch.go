@@ -0,0 +1,136 @@
+package consumer
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/store"
+	"time"
+)
+
+// batcher collects messages and writes their entities together with
+// store.PutEntities, once it has size of them or the first has waited
+// timeout. The whole batch is finished when it's written or requeued after a
+// transient error. Any other error may be down to a single entity, so the
+// batch's messages are then written one by one and handled as they would be
+// without batching.
+type batcher struct {
+	pipeline *Pipeline
+	size     int
+	timeout  time.Duration
+	messages chan *batchMessage
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type batchMessage struct {
+	message Message
+	entity  interface{}
+}
+
+func newBatcher(pipeline *Pipeline, size int, timeout time.Duration) *batcher {
+	b := &batcher{
+		pipeline: pipeline,
+		size:     size,
+		timeout:  timeout,
+		messages: make(chan *batchMessage),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+
+	return b
+}
+
+// add queues a message's entity for the next batch. Messages arriving after
+// the batcher has stopped are requeued.
+func (b *batcher) add(m Message, entity interface{}) {
+	select {
+	case b.messages <- &batchMessage{m, entity}:
+	case <-b.stop:
+		m.Requeue(b.pipeline.config.RequeueDelay)
+	}
+}
+
+// Stop writes the batch being collected and stops.
+func (b *batcher) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	var (
+		pending []*batchMessage
+		timer   *time.Timer
+		expired <-chan time.Time
+	)
+
+	for {
+		select {
+		case m := <-b.messages:
+			pending = append(pending, m)
+			if len(pending) == 1 {
+				timer = time.NewTimer(b.timeout)
+				expired = timer.C
+			}
+
+			if len(pending) < b.size {
+				continue
+			}
+
+		case <-expired:
+
+		case <-b.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			b.flush(pending)
+			return
+		}
+
+		timer.Stop()
+		expired = nil
+		b.flush(pending)
+		pending = nil
+	}
+}
+
+func (b *batcher) flush(pending []*batchMessage) {
+	if len(pending) == 0 {
+		return
+	}
+
+	entities := make([]interface{}, len(pending))
+	for i, p := range pending {
+		entities[i] = p.entity
+	}
+
+	db := b.pipeline.db
+	start := time.Now()
+	response, err := db.PutEntities(entities)
+	b.pipeline.observe(time.Since(start), err)
+	if err == nil {
+		log.WithFields(log.Fields{"messages": len(pending), "stored": response.Stored, "stale": response.Stale}).Debug("wrote batch")
+		b.pipeline.count(func(s *PipelineStats) {
+			s.Stored += response.Stored
+			s.Stale += response.Stale
+		})
+		for _, p := range pending {
+			p.message.Finish()
+		}
+		return
+	}
+
+	if store.IsTransient(err) {
+		for _, p := range pending {
+			b.pipeline.respond(p.message, err)
+		}
+		return
+	}
+
+	log.WithError(err).WithField("messages", len(pending)).Warn("error writing batch, writing its messages one by one")
+	for _, p := range pending {
+		b.pipeline.respond(p.message, b.pipeline.put(p.entity))
+	}
+}
@@ -1,15 +1,45 @@
 package consumer
 
+import (
+	"time"
+)
+
 type Consumer interface {
 	Stop() error
 }
 
+// Source delivers discovery events from a transport, such as nsq, to a
+// pipeline. Start begins passing the source's messages to the pipeline's
+// Handle. Stop stops taking new messages and waits for those in flight to be
+// finished or requeued.
+type Source interface {
+	Start(p *Pipeline) error
+	Stop() error
+}
+
+// Message is an event delivered by a source. The pipeline responds to each
+// message exactly once, with Finish once it's been handled or Requeue to
+// have the source deliver it again after delay. Attempts counts deliveries,
+// starting at one.
+type Message interface {
+	Body() []byte
+	Attempts() int
+	Source() string
+	Finish()
+	Requeue(delay time.Duration)
+}
+
 const (
 	Channel = "fieri"
 )
 
+// Event is a discovery message. Timestamp is when the source observed the
+// entity, in milliseconds since the unix epoch; when set, events observed
+// before the stored version of the entity are dropped.
 type Event struct {
 	CustomerId  string `json:"customer_id,omitempty"`
+	AccountId   string `json:"account_id,omitempty"`
 	MessageType string `json:"type"`
 	MessageBody string `json:"event"`
+	Timestamp   int64  `json:"timestamp,omitempty"`
 }
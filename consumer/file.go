@@ -0,0 +1,194 @@
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxEventSize bounds a single line of an event file. Discovery events for
+// large security groups and load balancers run to a few hundred kilobytes.
+const maxEventSize = 16 * 1024 * 1024
+
+// File is a source replaying newline-delimited Event json, such as captured
+// bastion traffic. Blank lines and lines starting with # are skipped. Events
+// requeued by the pipeline are delivered again once their delay is up, so a
+// file is done once each of its events has been stored or dead-lettered.
+type File struct {
+	reader   io.Reader
+	config   FileConfig
+	pipeline *Pipeline
+	inFlight sync.WaitGroup
+
+	mut       sync.Mutex
+	delivered int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// FileConfig configures a file source. Rate limits it to that many events
+// per second, or none when zero. Name identifies the file's events, with
+// their line numbers, in logs and dead letters.
+type FileConfig struct {
+	Name string
+	Rate float64
+}
+
+type fileMessage struct {
+	file     *File
+	source   string
+	body     []byte
+	attempts int
+}
+
+// NewFile returns a source reading events from r.
+func NewFile(r io.Reader, config FileConfig) (*File, error) {
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("rate must not be negative")
+	}
+
+	if config.Name == "" {
+		config.Name = "file"
+	}
+
+	return &File{
+		reader: r,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (f *File) Start(p *Pipeline) error {
+	f.pipeline = p
+	go f.run()
+
+	return nil
+}
+
+// Done is closed once every event has been handled or the source stopped.
+func (f *File) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error that ended reading early, if any, once Done is
+// closed. Events that fail to be handled are dead-lettered rather than
+// fatal.
+func (f *File) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Delivered returns how many events have been read so far.
+func (f *File) Delivered() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	return f.delivered
+}
+
+// Stop stops reading and waits for the events being handled. Events waiting
+// to be delivered again are dropped.
+func (f *File) Stop() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	<-f.done
+
+	return nil
+}
+
+func (f *File) run() {
+	defer close(f.done)
+	defer f.inFlight.Wait()
+
+	var tick <-chan time.Time
+	if f.config.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / f.config.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(f.reader)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		body := bytes.TrimSpace(scanner.Bytes())
+		if len(body) == 0 || body[0] == '#' {
+			continue
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-f.stop:
+				return
+			}
+		}
+
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		f.mut.Lock()
+		f.delivered++
+		f.mut.Unlock()
+
+		// the scanner reuses its buffer, so the body is copied to keep it
+		// while the event is batched or requeued.
+		f.inFlight.Add(1)
+		f.pipeline.Handle(&fileMessage{
+			file:     f,
+			source:   fmt.Sprintf("%s:%d", f.config.Name, line),
+			body:     append([]byte(nil), body...),
+			attempts: 1,
+		})
+	}
+
+	f.err = scanner.Err()
+}
+
+// redeliver hands a requeued message to the pipeline again after delay.
+func (f *File) redeliver(m *fileMessage, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		m.attempts++
+		f.pipeline.Handle(m)
+	case <-f.stop:
+		log.WithFields(log.Fields{"source": m.source, "attempts": m.attempts}).Warn("dropping requeued event, the replay was stopped")
+		f.inFlight.Done()
+	}
+}
+
+func (m *fileMessage) Body() []byte {
+	return m.body
+}
+
+func (m *fileMessage) Attempts() int {
+	return m.attempts
+}
+
+func (m *fileMessage) Source() string {
+	return m.source
+}
+
+func (m *fileMessage) Finish() {
+	m.file.inFlight.Done()
+}
+
+func (m *fileMessage) Requeue(delay time.Duration) {
+	go m.file.redeliver(m, delay)
+}
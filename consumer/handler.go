@@ -0,0 +1,98 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/store"
+	"github.com/yeller/yeller-golang"
+	"time"
+)
+
+// decodeEvent turns a raw event into the entity it describes.
+func decodeEvent(body []byte) (interface{}, error) {
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, err
+	}
+
+	entity, err := store.NewEntity(event.MessageType, event.CustomerId, event.AccountId, []byte(event.MessageBody))
+	if err == nil && entity == nil {
+		err = fmt.Errorf("unknown event type %q", event.MessageType)
+	}
+
+	if err == nil && event.Timestamp > 0 {
+		store.SetSourceTimestamp(entity, time.Unix(0, event.Timestamp*int64(time.Millisecond)))
+	}
+
+	return entity, err
+}
+
+// handleEvent decodes an event and stores its entity, as a pipeline does,
+// for events handled outside of one.
+func handleEvent(db store.Store, body []byte) error {
+	entity, err := decodeEvent(body)
+	if err != nil || entity == nil {
+		return err
+	}
+
+	return putEntity(db, entity)
+}
+
+// putEntity stores a decoded entity.
+func putEntity(db store.Store, entity interface{}) error {
+	_, err := db.PutEntity(entity)
+	if err == store.ErrStaleEntity {
+		// nsq doesn't order messages, so older versions are expected and
+		// only counted.
+		log.Debug("dropped stale entity")
+		return nil
+	}
+
+	return err
+}
+
+// handleError reports an event that couldn't be handled before it's
+// dead-lettered, since retrying it can't succeed.
+func handleError(source string, body []byte, err error) {
+	logEventError(source, body, err)
+	yeller.NotifyInfo(err, map[string]interface{}{"message": string(body)})
+}
+
+func logEventError(source string, body []byte, err error) {
+	log.WithFields(log.Fields{"err": err.Error(), "source": source, "message": string(body)}).Warn("error processing event")
+}
+
+// newDeadLetter captures a failed event, picking out whatever identifying
+// fields can still be decoded from it.
+func newDeadLetter(source string, body []byte, err error, attempts int) *store.DeadLetter {
+	event := &Event{}
+	json.Unmarshal(body, event)
+
+	return &store.DeadLetter{
+		CustomerId: event.CustomerId,
+		AccountId:  event.AccountId,
+		Type:       event.MessageType,
+		Source:     source,
+		Body:       string(body),
+		Error:      err.Error(),
+		Attempts:   attempts,
+	}
+}
+
+// ReplayDeadLetter handles a dead letter's event again, deleting the letter
+// once it's stored or recording the new error and attempt when it isn't.
+func ReplayDeadLetter(db store.Store, letter *store.DeadLetter) error {
+	err := handleEvent(db, []byte(letter.Body))
+	if err != nil {
+		letter.Error = err.Error()
+		letter.Attempts++
+		if _, putErr := db.PutDeadLetter(letter); putErr != nil {
+			log.WithError(putErr).WithField("id", letter.Id).Error("error updating dead letter")
+		}
+
+		return err
+	}
+
+	return db.DeleteDeadLetter(&store.DeadLetterRequest{Id: letter.Id})
+}
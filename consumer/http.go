@@ -0,0 +1,143 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTP is a source taking discovery events pushed over http, one Event json
+// object per request, for installs without nsq. It answers once the event
+// has been handled: 202 when it's been stored, skipped or dead-lettered, or
+// 503 with a Retry-After header when it should be pushed again later.
+// Pushers may count their attempts in a Delivery-Attempt header, so that
+// events that keep failing are eventually dead-lettered.
+type HTTP struct {
+	mut         sync.RWMutex
+	pipeline    *Pipeline
+	stopped     bool
+	inFlight    sync.WaitGroup
+	stopTimeout time.Duration
+}
+
+type httpMessage struct {
+	body     []byte
+	attempts int
+	requeued bool
+	delay    time.Duration
+	done     chan struct{}
+}
+
+type httpResponse struct {
+	Message string `json:"message"`
+}
+
+// NewHTTP returns an http source whose Stop waits up to stopTimeout for the
+// requests being handled.
+func NewHTTP(stopTimeout time.Duration) *HTTP {
+	return &HTTP{stopTimeout: stopTimeout}
+}
+
+func (h *HTTP) Start(p *Pipeline) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.pipeline = p
+	return nil
+}
+
+// Stop turns away further events and waits for those being handled.
+func (h *HTTP) Stop() error {
+	h.mut.Lock()
+	h.stopped = true
+	h.mut.Unlock()
+
+	return waitTimeout(&h.inFlight, h.stopTimeout)
+}
+
+func (h *HTTP) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.mut.RLock()
+	if h.pipeline == nil || h.stopped {
+		h.mut.RUnlock()
+		writeHTTPResponse(rw, http.StatusServiceUnavailable, "Not accepting events.")
+		return
+	}
+	h.inFlight.Add(1)
+	pipeline := h.pipeline
+	h.mut.RUnlock()
+	defer h.inFlight.Done()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxEventSize))
+	if err != nil {
+		writeHTTPResponse(rw, http.StatusBadRequest, "Malformed request body.")
+		return
+	}
+
+	attempts := 1
+	if header := r.Header.Get("Delivery-Attempt"); header != "" {
+		attempts, err = strconv.Atoi(header)
+		if err != nil || attempts < 1 {
+			writeHTTPResponse(rw, http.StatusBadRequest, "Malformed Delivery-Attempt header, must be a positive number.")
+			return
+		}
+	}
+
+	m := &httpMessage{body: body, attempts: attempts, done: make(chan struct{})}
+	pipeline.Handle(m)
+	<-m.done
+
+	if m.requeued {
+		rw.Header().Set("Retry-After", strconv.Itoa(int((m.delay+time.Second-1)/time.Second)))
+		writeHTTPResponse(rw, http.StatusServiceUnavailable, fmt.Sprintf("Event not stored, retry after %s.", m.delay))
+		return
+	}
+
+	writeHTTPResponse(rw, http.StatusAccepted, "Event accepted.")
+}
+
+func writeHTTPResponse(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(httpResponse{message})
+}
+
+func (m *httpMessage) Body() []byte {
+	return m.body
+}
+
+func (m *httpMessage) Attempts() int {
+	return m.attempts
+}
+
+func (m *httpMessage) Source() string {
+	return "http"
+}
+
+func (m *httpMessage) Finish() {
+	close(m.done)
+}
+
+func (m *httpMessage) Requeue(delay time.Duration) {
+	m.requeued, m.delay = true, delay
+	close(m.done)
+}
+
+// waitTimeout waits for wg, giving up after timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for in-flight messages")
+	}
+}
@@ -1,39 +1,95 @@
 package consumer
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/nsqio/go-nsq"
-	"github.com/opsee/fieri/store"
-	"github.com/yeller/yeller-golang"
 	"time"
 )
 
+// Nsq is a source reading discovery events from an nsq topic.
 type Nsq struct {
-	consumer *nsq.Consumer
+	consumer    *nsq.Consumer
+	config      NsqConfig
+	controller  *inFlightController
+	stopTimeout time.Duration
+	stop        chan struct{}
 }
 
+var errNsqStopped = errors.New("nsq consumer stopped")
+
+// NsqConfig configures an nsq source. Concurrency is the number of messages
+// handled at once, MaxInFlight the number nsqd may send before they're
+// acknowledged. Stop waits up to StopTimeout for in-flight messages. With
+// AdaptInFlight, the messages in flight are adjusted between MinInFlight and
+// MaxInFlight to keep writes within TargetLatency, with as many handlers as
+// MaxInFlight so that they're what limits concurrency.
+type NsqConfig struct {
+	LookupdHosts  []string
+	Topic         string
+	Concurrency   int
+	MaxInFlight   int
+	MinInFlight   int
+	AdaptInFlight bool
+	TargetLatency time.Duration
+	StopTimeout   time.Duration
+}
+
+// nsqHandler passes nsq messages to a pipeline, which responds to them.
 type nsqHandler struct {
-	db store.Store
+	pipeline *Pipeline
+}
+
+// nsqMessage is an nsq message whose response is left to the pipeline.
+type nsqMessage struct {
+	*nsq.Message
 }
 
-func NewNsq(lookupds []string, db store.Store, topic string) (Consumer, error) {
-	config := nsq.NewConfig()
-	config.MaxInFlight = 4
-	consumer, err := nsq.NewConsumer(topic, Channel, config)
+func NewNsq(config NsqConfig) (*Nsq, error) {
+	nsqConfig := nsq.NewConfig()
+	nsqConfig.MaxInFlight = config.MaxInFlight
+	// attempts are counted by the pipeline, which dead-letters rather than
+	// drops messages that run out of them.
+	nsqConfig.MaxAttempts = 0
+	consumer, err := nsq.NewConsumer(config.Topic, Channel, nsqConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	handler := &nsqHandler{db: db}
-	consumer.AddConcurrentHandlers(handler, 4)
-	consumer.ConnectToNSQLookupds(lookupds)
+	return &Nsq{consumer: consumer, config: config, stopTimeout: config.StopTimeout, stop: make(chan struct{})}, nil
+}
+
+func (c *Nsq) Start(p *Pipeline) error {
+	concurrency := c.config.Concurrency
+	if c.config.AdaptInFlight {
+		c.controller = newInFlightController(c.consumer.ChangeMaxInFlight, c.config.MinInFlight, c.config.MaxInFlight, c.config.TargetLatency)
+		p.observeWrites(c.controller.observe)
+		if concurrency < c.config.MaxInFlight {
+			concurrency = c.config.MaxInFlight
+		}
+	} else {
+		maxInFlight.Set(int64(c.config.MaxInFlight))
+	}
 
-	return &Nsq{consumer: consumer}, nil
+	c.consumer.AddConcurrentHandlers(&nsqHandler{p}, concurrency)
+	if err := c.consumer.ConnectToNSQLookupds(c.config.LookupdHosts); err != nil {
+		return err
+	}
+
+	go func() {
+		<-c.consumer.StopChan
+		select {
+		case <-c.stop:
+		default:
+			p.fail("nsq", errNsqStopped)
+		}
+	}()
+
+	return nil
 }
 
 func (c *Nsq) Stop() error {
+	close(c.stop)
 	c.consumer.Stop()
 
 	var err error
@@ -41,44 +97,31 @@ func (c *Nsq) Stop() error {
 	select {
 	case <-c.consumer.StopChan:
 		err = nil
-	case <-time.After(5 * time.Second):
+	case <-time.After(c.stopTimeout):
 		err = fmt.Errorf("timed out waiting for consumer shutdown")
 	}
 
+	if c.controller != nil {
+		c.controller.Stop()
+	}
+
 	return err
 }
 
 func (h *nsqHandler) HandleMessage(m *nsq.Message) error {
+	m.DisableAutoResponse()
+	h.pipeline.Handle(&nsqMessage{m})
 	return nil
+}
 
-	event := &Event{}
-	err := json.Unmarshal(m.Body, event)
-	if err != nil {
-		h.handleError(m, err)
-		return nil
-	}
-
-	// skip db security groups which are being sent by bastions erroneously
-	if event.MessageType == store.DBSecurityGroupEntityType {
-		return nil
-	}
-
-	entity, err := store.NewEntity(event.MessageType, event.CustomerId, []byte(event.MessageBody))
-	if err != nil {
-		h.handleError(m, err)
-		return nil
-	}
-
-	_, err = h.db.PutEntity(entity)
-	if err != nil {
-		h.handleError(m, err)
-		return nil
-	}
+func (m *nsqMessage) Body() []byte {
+	return m.Message.Body
+}
 
-	return nil
+func (m *nsqMessage) Attempts() int {
+	return int(m.Message.Attempts)
 }
 
-func (h *nsqHandler) handleError(m *nsq.Message, err error) {
-	log.WithFields(log.Fields{"err": err.Error(), "message": string(m.Body)}).Warn("error processing nsq message")
-	yeller.NotifyInfo(err, map[string]interface{}{"message": string(m.Body)})
+func (m *nsqMessage) Source() string {
+	return "nsq"
 }
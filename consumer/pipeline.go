@@ -0,0 +1,241 @@
+package consumer
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/fieri/store"
+	"sync"
+	"time"
+)
+
+// defaultMaxRequeueDelay matches nsq's limit on requeue delays.
+const defaultMaxRequeueDelay = 15 * time.Minute
+
+// PipelineConfig configures how a pipeline handles messages. Messages
+// failing with a transient database error are requeued after RequeueDelay,
+// doubling with each attempt up to MaxRequeueDelay, or 15 minutes when
+// unset, and dead-lettered after MaxAttempts. When BatchSize is more than
+// one, entities are written in batches of up to that many, each waiting up
+// to BatchTimeout for its batch to fill. With DryRun events are decoded and
+// validated but not stored, and those that fail are logged rather than
+// dead-lettered.
+type PipelineConfig struct {
+	MaxAttempts     int
+	RequeueDelay    time.Duration
+	MaxRequeueDelay time.Duration
+	BatchSize       int
+	BatchTimeout    time.Duration
+	DryRun          bool
+}
+
+// PipelineStats counts how a pipeline's messages were handled. In a dry run
+// Stored counts the entities that would have been stored. Requeued counts
+// every requeue, so a message may be counted more than once.
+type PipelineStats struct {
+	Stored   int `json:"stored"`
+	Stale    int `json:"stale"`
+	Requeued int `json:"requeued"`
+	Failed   int `json:"failed"`
+}
+
+// Pipeline decodes, validates and stores the events its sources deliver,
+// whatever their transport, and responds to each message with the result.
+type Pipeline struct {
+	db        store.Store
+	config    PipelineConfig
+	sources   []Source
+	batcher   *batcher
+	observers []func(time.Duration, error)
+	failed    chan error
+	stopped   chan struct{}
+	stopOnce  sync.Once
+
+	mut   sync.Mutex
+	stats PipelineStats
+}
+
+func NewPipeline(db store.Store, config PipelineConfig) *Pipeline {
+	if config.MaxRequeueDelay == 0 {
+		config.MaxRequeueDelay = defaultMaxRequeueDelay
+	}
+
+	p := &Pipeline{db: db, config: config, failed: make(chan error, 1), stopped: make(chan struct{})}
+	if config.BatchSize > 1 && !config.DryRun {
+		p.batcher = newBatcher(p, config.BatchSize, config.BatchTimeout)
+	}
+
+	return p
+}
+
+// Start starts each source in turn. If one fails to start, those already
+// started are stopped again.
+func (p *Pipeline) Start(sources ...Source) error {
+	for _, source := range sources {
+		if err := source.Start(p); err != nil {
+			p.Stop()
+			return err
+		}
+		p.sources = append(p.sources, source)
+	}
+
+	return nil
+}
+
+// Stop stops the sources, then writes the batch being collected. Sources
+// wait for their in-flight messages, so batches are written until they've
+// all stopped.
+func (p *Pipeline) Stop() error {
+	p.stopOnce.Do(func() { close(p.stopped) })
+
+	var err error
+	for _, source := range p.sources {
+		if stopErr := source.Stop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	if p.batcher != nil {
+		p.batcher.Stop()
+	}
+
+	return err
+}
+
+// Wait blocks until the pipeline is stopped, returning nil, or until one of
+// its sources can no longer deliver messages, returning why.
+func (p *Pipeline) Wait() error {
+	select {
+	case err := <-p.failed:
+		return err
+	case <-p.stopped:
+		return nil
+	}
+}
+
+// fail is called by a source that stopped delivering messages without being
+// stopped. Only the first failure is kept.
+func (p *Pipeline) fail(source string, err error) {
+	select {
+	case p.failed <- fmt.Errorf("%s source failed: %s", source, err):
+	default:
+	}
+}
+
+// Handle handles a message and responds to it, once its entity is stored
+// when batching.
+func (p *Pipeline) Handle(m Message) {
+	entity, err := decodeEvent(m.Body())
+	if err != nil || entity == nil {
+		p.respond(m, err)
+		return
+	}
+
+	if p.batcher != nil {
+		p.batcher.add(m, entity)
+		return
+	}
+
+	p.respond(m, p.put(entity))
+}
+
+// Stats returns the counts so far.
+func (p *Pipeline) Stats() PipelineStats {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	return p.stats
+}
+
+func (p *Pipeline) count(f func(stats *PipelineStats)) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	f(&p.stats)
+}
+
+// put stores an entity and counts it. Stale versions are dropped without an
+// error, as putEntity drops them.
+func (p *Pipeline) put(entity interface{}) error {
+	if p.config.DryRun {
+		p.count(func(s *PipelineStats) { s.Stored++ })
+		return nil
+	}
+
+	start := time.Now()
+	_, err := p.db.PutEntity(entity)
+	switch err {
+	case nil:
+		p.count(func(s *PipelineStats) { s.Stored++ })
+	case store.ErrStaleEntity:
+		log.Debug("dropped stale entity")
+		p.count(func(s *PipelineStats) { s.Stale++ })
+		err = nil
+	}
+	p.observe(time.Since(start), err)
+
+	return err
+}
+
+// observeWrites has f called with the latency and result of every write.
+func (p *Pipeline) observeWrites(f func(time.Duration, error)) {
+	p.observers = append(p.observers, f)
+}
+
+func (p *Pipeline) observe(latency time.Duration, err error) {
+	for _, f := range p.observers {
+		f(latency, err)
+	}
+}
+
+// respond finishes a message whose event was handled with err, requeueing it
+// after transient errors and dead-lettering it after others.
+func (p *Pipeline) respond(m Message, err error) {
+	if err == nil {
+		m.Finish()
+		return
+	}
+
+	if store.IsTransient(err) && m.Attempts() < p.config.MaxAttempts {
+		delay := p.backoff(m.Attempts())
+		log.WithError(err).WithFields(log.Fields{"source": m.Source(), "attempts": m.Attempts(), "delay": delay}).Warn("requeueing message after transient error")
+		p.count(func(s *PipelineStats) { s.Requeued++ })
+		m.Requeue(delay)
+		return
+	}
+
+	if p.config.DryRun {
+		// dry runs are run by hand and have nowhere to write dead letters,
+		// so failures are only logged.
+		logEventError(m.Source(), m.Body(), err)
+		p.count(func(s *PipelineStats) { s.Failed++ })
+		m.Finish()
+		return
+	}
+
+	handleError(m.Source(), m.Body(), err)
+	if _, err := p.db.PutDeadLetter(newDeadLetter(m.Source(), m.Body(), err, m.Attempts())); err != nil {
+		// the message is requeued rather than lost while the dead letter
+		// can't be written.
+		log.WithError(err).Error("error writing dead letter")
+		p.count(func(s *PipelineStats) { s.Requeued++ })
+		m.Requeue(p.backoff(m.Attempts()))
+		return
+	}
+
+	p.count(func(s *PipelineStats) { s.Failed++ })
+	m.Finish()
+}
+
+// backoff doubles the requeue delay with each attempt, up to the maximum.
+func (p *Pipeline) backoff(attempts int) time.Duration {
+	delay := p.config.RequeueDelay
+	for i := 1; i < attempts && delay < p.config.MaxRequeueDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.config.MaxRequeueDelay {
+		delay = p.config.MaxRequeueDelay
+	}
+
+	return delay
+}
@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// failingSource fails as soon as it's started, as a source whose transport
+// went away would.
+type failingSource struct {
+	err error
+}
+
+func (s *failingSource) Start(p *Pipeline) error {
+	go p.fail("test", s.err)
+	return nil
+}
+
+func (s *failingSource) Stop() error {
+	return nil
+}
+
+func TestPipelineWait(t *testing.T) {
+	t.Run("source fails", func(t *testing.T) {
+		p := NewPipeline(nil, PipelineConfig{})
+		require.NoError(t, p.Start(&failingSource{errors.New("gone")}))
+
+		err := waitFor(t, p)
+		assert.EqualError(t, err, "test source failed: gone")
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		p := NewPipeline(nil, PipelineConfig{})
+		require.NoError(t, p.Start())
+		require.NoError(t, p.Stop())
+
+		assert.NoError(t, waitFor(t, p))
+	})
+}
+
+func waitFor(t *testing.T, p *Pipeline) error {
+	done := make(chan error, 1)
+	go func() { done <- p.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return")
+		return nil
+	}
+}
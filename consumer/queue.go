@@ -0,0 +1,187 @@
+package consumer
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/opsee/fieri/store"
+	"sync"
+	"time"
+)
+
+const (
+	// queueChannel is notified by a trigger on event_queue inserts.
+	queueChannel = "fieri_events"
+
+	// queuePollInterval is how often the queue is checked without a
+	// notification, for events requeued or left by a fieri that died.
+	queuePollInterval = 5 * time.Second
+
+	// queueLease is how long a claimed event is hidden from other claims
+	// before it's delivered again.
+	queueLease = 5 * time.Minute
+)
+
+// Queue is a source taking discovery events from the postgres event_queue
+// table, so that fieri can run with only postgres. Producers insert an Event
+// json object per row; a trigger notifies listening fieris, which claim the
+// rows, deleting them once handled.
+type Queue struct {
+	db       store.Store
+	config   QueueConfig
+	listener *pq.Listener
+	slots    chan struct{}
+	wake     chan struct{}
+	inFlight sync.WaitGroup
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// QueueConfig configures a postgres queue source. Connection is the postgres
+// url to listen for notifications on, and MaxInFlight the most events
+// claimed at once. Stop waits up to StopTimeout for in-flight events.
+type QueueConfig struct {
+	Connection  string
+	MaxInFlight int
+	StopTimeout time.Duration
+}
+
+var errListenerClosed = errors.New("event queue listener closed")
+
+type queueMessage struct {
+	queue *Queue
+	event *store.QueuedEvent
+}
+
+func NewQueue(db store.Store, config QueueConfig) *Queue {
+	return &Queue{
+		db:     db,
+		config: config,
+		slots:  make(chan struct{}, config.MaxInFlight),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (q *Queue) Start(p *Pipeline) error {
+	q.listener = pq.NewListener(q.config.Connection, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WithError(err).Warn("event queue listener error")
+		}
+	})
+
+	if err := q.listener.Listen(queueChannel); err != nil {
+		q.listener.Close()
+		return err
+	}
+
+	go q.run(p)
+	return nil
+}
+
+// Stop stops claiming events and waits for those in flight.
+func (q *Queue) Stop() error {
+	close(q.stop)
+	<-q.done
+
+	err := waitTimeout(&q.inFlight, q.config.StopTimeout)
+	q.listener.Close()
+
+	return err
+}
+
+func (q *Queue) run(p *Pipeline) {
+	defer close(q.done)
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.claim(p)
+
+		// the listener also sends a nil notification after reconnecting,
+		// when notifications may have been missed.
+		select {
+		case _, ok := <-q.listener.Notify:
+			if !ok {
+				p.fail("queue", errListenerClosed)
+				return
+			}
+		case <-q.wake:
+		case <-ticker.C:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// claim delivers available events until there are none left or as many are
+// in flight as allowed.
+func (q *Queue) claim(p *Pipeline) {
+	for {
+		free := cap(q.slots) - len(q.slots)
+		if free == 0 {
+			return
+		}
+
+		events, err := q.db.ClaimQueuedEvents(free, queueLease)
+		if err != nil {
+			log.WithError(err).Error("error claiming queued events")
+			return
+		}
+
+		for _, event := range events {
+			q.slots <- struct{}{}
+			q.inFlight.Add(1)
+			go p.Handle(&queueMessage{q, event})
+		}
+
+		if len(events) < free {
+			return
+		}
+	}
+}
+
+// release frees an in-flight slot, waking the claim loop in case it was
+// waiting for one.
+func (q *Queue) release() {
+	<-q.slots
+	q.inFlight.Done()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *queueMessage) Body() []byte {
+	return []byte(m.event.Body)
+}
+
+func (m *queueMessage) Attempts() int {
+	return m.event.Attempts
+}
+
+func (m *queueMessage) Source() string {
+	return "queue"
+}
+
+// Finish deletes the event. Should that fail, the event is delivered again
+// once its lease is up.
+func (m *queueMessage) Finish() {
+	defer m.queue.release()
+
+	if err := m.queue.db.FinishQueuedEvent(m.event.Id); err != nil {
+		log.WithError(err).WithField("id", m.event.Id).Error("error finishing queued event")
+	}
+}
+
+func (m *queueMessage) Requeue(delay time.Duration) {
+	defer m.queue.release()
+
+	if err := m.queue.db.RequeueQueuedEvent(m.event.Id, delay); err != nil {
+		log.WithError(err).WithField("id", m.event.Id).Error("error requeueing queued event")
+	}
+}
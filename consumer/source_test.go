@@ -0,0 +1,227 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/nsqio/go-nsq"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yeller/yeller-golang"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore stores entities and dead letters in memory, failing the first
+// write of each instance in transient with a serialization failure. Its
+// event queue hands out requeued events again straight away.
+type memoryStore struct {
+	store.Store
+
+	mut         sync.Mutex
+	transient   map[string]bool
+	stored      []string
+	deadLetters []*store.DeadLetter
+	queue       []*store.QueuedEvent
+	claimed     map[int64]*store.QueuedEvent
+}
+
+func newMemoryStore(transient ...string) *memoryStore {
+	s := &memoryStore{transient: make(map[string]bool), claimed: make(map[int64]*store.QueuedEvent)}
+	for _, id := range transient {
+		s.transient[id] = true
+	}
+
+	return s
+}
+
+func (s *memoryStore) PutEntity(entity interface{}) (*store.EntityResponse, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	id := entity.(*store.Instance).Id
+	if s.transient[id] {
+		delete(s.transient, id)
+		return nil, &pq.Error{Code: "40001"}
+	}
+
+	s.stored = append(s.stored, id)
+	return &store.EntityResponse{}, nil
+}
+
+func (s *memoryStore) PutDeadLetter(letter *store.DeadLetter) (*store.DeadLetter, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.deadLetters = append(s.deadLetters, letter)
+	return letter, nil
+}
+
+func (s *memoryStore) ClaimQueuedEvents(limit int, lease time.Duration) ([]*store.QueuedEvent, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if limit > len(s.queue) {
+		limit = len(s.queue)
+	}
+
+	claimed := s.queue[:limit]
+	s.queue = s.queue[limit:]
+	for _, event := range claimed {
+		event.Attempts++
+		s.claimed[event.Id] = event
+	}
+
+	return claimed, nil
+}
+
+func (s *memoryStore) FinishQueuedEvent(id int64) error {
+	return nil
+}
+
+func (s *memoryStore) RequeueQueuedEvent(id int64, delay time.Duration) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.queue = append(s.queue, s.claimed[id])
+	return nil
+}
+
+// nsqDelegate stands in for nsqd, delivering requeued messages again.
+type nsqDelegate struct {
+	handler *nsqHandler
+	wg      *sync.WaitGroup
+}
+
+func (d *nsqDelegate) OnFinish(m *nsq.Message) {
+	d.wg.Done()
+}
+
+func (d *nsqDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	redelivery := nsq.NewMessage(m.ID, m.Body)
+	redelivery.Attempts = m.Attempts + 1
+	redelivery.Delegate = d
+	go d.handler.HandleMessage(redelivery)
+}
+
+func (d *nsqDelegate) OnTouch(m *nsq.Message) {}
+
+func testEvent(t *testing.T, instanceId string) string {
+	body, err := json.Marshal(&Event{
+		CustomerId:  "8c3ec0e4-5a1f-4bd9-b5ff-a11b5ea7b5ad",
+		AccountId:   "933693344490",
+		MessageType: store.InstanceEntityType,
+		MessageBody: `{"InstanceId": "` + instanceId + `"}`,
+	})
+	require.NoError(t, err)
+
+	return string(body)
+}
+
+// TestSources runs the same events through each source: one stored, one
+// failing once with a transient error and then stored, and one malformed and
+// dead-lettered.
+func TestSources(t *testing.T) {
+	events := []string{testEvent(t, "i-39aae6fb"), testEvent(t, "i-7d3e2a01"), `{"type": "Instance", "event":`}
+
+	// dead letters are also reported to yeller, here to a collector that
+	// ignores them.
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	yeller.StartWithClient(yeller.NewClientHostnames("", "test", "", yeller.NewSilentErrorHandler(), []string{collector.URL}))
+
+	tests := []struct {
+		name    string
+		deliver func(t *testing.T, p *Pipeline, db *memoryStore, events []string)
+	}{
+		{"nsq", func(t *testing.T, p *Pipeline, db *memoryStore, events []string) {
+			var wg sync.WaitGroup
+			delegate := &nsqDelegate{&nsqHandler{p}, &wg}
+			for i, body := range events {
+				var id nsq.MessageID
+				copy(id[:], strconv.Itoa(i))
+
+				m := nsq.NewMessage(id, []byte(body))
+				m.Attempts = 1
+				m.Delegate = delegate
+
+				wg.Add(1)
+				require.NoError(t, delegate.handler.HandleMessage(m))
+			}
+			wg.Wait()
+		}},
+
+		{"http", func(t *testing.T, p *Pipeline, db *memoryStore, events []string) {
+			h := NewHTTP(time.Second)
+			require.NoError(t, p.Start(h))
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			for _, body := range events {
+				for attempt := 1; ; attempt++ {
+					request, err := http.NewRequest("POST", server.URL, strings.NewReader(body))
+					require.NoError(t, err)
+					request.Header.Set("Delivery-Attempt", strconv.Itoa(attempt))
+
+					response, err := http.DefaultClient.Do(request)
+					require.NoError(t, err)
+					response.Body.Close()
+
+					if response.StatusCode != http.StatusServiceUnavailable {
+						assert.Equal(t, http.StatusAccepted, response.StatusCode)
+						break
+					}
+				}
+			}
+		}},
+
+		{"queue", func(t *testing.T, p *Pipeline, db *memoryStore, events []string) {
+			for i, body := range events {
+				db.queue = append(db.queue, &store.QueuedEvent{Id: int64(i), Body: body})
+			}
+
+			// the queue is claimed from directly, as notifications would
+			// have it claimed, since listening needs postgres.
+			q := NewQueue(db, QueueConfig{MaxInFlight: 2})
+			for len(db.queue) > 0 {
+				q.claim(p)
+				q.inFlight.Wait()
+			}
+		}},
+
+		{"file", func(t *testing.T, p *Pipeline, db *memoryStore, events []string) {
+			f, err := NewFile(bytes.NewBufferString("# captured\n"+strings.Join(events, "\n")+"\n"), FileConfig{Name: "events.ndjson"})
+			require.NoError(t, err)
+			require.NoError(t, p.Start(f))
+
+			<-f.Done()
+			assert.NoError(t, f.Err())
+			assert.Equal(t, len(events), f.Delivered())
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newMemoryStore("i-7d3e2a01")
+			p := NewPipeline(db, PipelineConfig{MaxAttempts: 3})
+
+			test.deliver(t, p, db, events)
+			require.NoError(t, p.Stop())
+
+			sort.Strings(db.stored)
+			assert.Equal(t, []string{"i-39aae6fb", "i-7d3e2a01"}, db.stored)
+			assert.Equal(t, PipelineStats{Stored: 2, Requeued: 1, Failed: 1}, p.Stats())
+			if assert.Len(t, db.deadLetters, 1) {
+				assert.Equal(t, events[2], db.deadLetters[0].Body)
+				assert.Equal(t, 1, db.deadLetters[0].Attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Package importer reads the json output of aws Describe* calls, as saved by
+// the aws cli, and writes the entities in it to a store.
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	opsee_aws_rds "github.com/opsee/basic/schema/aws/rds"
+	"github.com/opsee/fieri/store"
+	"io"
+	"sort"
+	"time"
+)
+
+// Transient write failures, such as losing an insert race to a bastion
+// reporting the same entity, are retried this many times, waiting
+// retryDelay and then twice as long each time.
+const (
+	maxAttempts = 5
+	retryDelay  = 100 * time.Millisecond
+)
+
+var (
+	ErrUnknownKind     = errors.New("unknown import kind")
+	ErrMissingCustomer = errors.New("customer id is required")
+	ErrMissingAccount  = errors.New("account id is required for this kind")
+)
+
+// Entity is one entity read from a describe output, ready to be stored.
+type Entity struct {
+	AccountId string
+	Entity    interface{}
+}
+
+// String names the entity by its type and id, e.g. ec2/i-123.
+func (e *Entity) String() string {
+	switch entity := e.Entity.(type) {
+	case *store.Instance:
+		return entity.Type + "/" + entity.Id
+	case *store.Group:
+		return entity.Type + "/" + entity.Name
+	case *store.RouteTable:
+		return store.RouteTableStoreType + "/" + entity.Id
+	case *store.Subnet:
+		return store.SubnetStoreType + "/" + entity.Id
+	default:
+		return fmt.Sprintf("%T", e.Entity)
+	}
+}
+
+type parser func(dec *json.Decoder, customerId, accountId string) ([]*Entity, error)
+
+// kinds are named after the aws cli commands producing them, e.g. instances
+// for aws ec2 describe-instances.
+var kinds = map[string]parser{
+	"instances":           parseInstances,
+	"db-instances":        parseDBInstances,
+	"db-security-groups":  parseDBSecurityGroups,
+	"security-groups":     parseSecurityGroups,
+	"load-balancers":      parseLoadBalancers,
+	"auto-scaling-groups": parseAutoScalingGroups,
+	"route-tables":        parseRouteTables,
+	"subnets":             parseSubnets,
+}
+
+// Kinds returns the names of the describe outputs that can be imported.
+func Kinds() []string {
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Parse reads a describe output of the given kind. Entities are attributed
+// to accountId, or for kinds that carry one, to their owner's account when
+// accountId is empty.
+func Parse(kind, customerId, accountId string, r io.Reader) ([]*Entity, error) {
+	parse, ok := kinds[kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+
+	if customerId == "" {
+		return nil, ErrMissingCustomer
+	}
+
+	return parse(json.NewDecoder(r), customerId, accountId)
+}
+
+// Import parses a describe output and writes every entity in it to db,
+// returning the number stored. Transient failures are retried; any other
+// stops the import, naming the entity that couldn't be stored.
+func Import(db store.Store, kind, customerId, accountId string, r io.Reader) (int, error) {
+	entities, err := Parse(kind, customerId, accountId, r)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range entities {
+		if err := put(db, e); err != nil {
+			return i, fmt.Errorf("storing %s in account %s: %s", e, e.AccountId, err)
+		}
+	}
+
+	return len(entities), nil
+}
+
+func put(db store.Store, e *Entity) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		_, err := db.PutEntity(e.Entity)
+		if !store.IsTransient(err) || attempt == maxAttempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func parseInstances(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_ec2.DescribeInstancesOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	var entities []*Entity
+	for _, reservation := range output.Reservations {
+		account, err := owner(accountId, reservation.OwnerId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, data := range reservation.Instances {
+			instance, err := store.NewInstance(customerId, account, data)
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, &Entity{account, instance})
+		}
+	}
+
+	return entities, nil
+}
+
+func parseDBInstances(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_rds.DescribeDBInstancesOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	if accountId == "" {
+		return nil, ErrMissingAccount
+	}
+
+	entities := make([]*Entity, 0, len(output.DBInstances))
+	for _, data := range output.DBInstances {
+		instance, err := store.NewInstance(customerId, accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{accountId, instance})
+	}
+
+	return entities, nil
+}
+
+func parseSecurityGroups(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_ec2.DescribeSecurityGroupsOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	entities := make([]*Entity, 0, len(output.SecurityGroups))
+	for _, data := range output.SecurityGroups {
+		account, err := owner(accountId, data.OwnerId)
+		if err != nil {
+			return nil, err
+		}
+
+		group, err := store.NewGroup(customerId, account, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{account, group})
+	}
+
+	return entities, nil
+}
+
+// describeDBSecurityGroupsOutput is the output of aws rds
+// describe-db-security-groups, which the aws schema doesn't include.
+type describeDBSecurityGroupsOutput struct {
+	DBSecurityGroups []*store.DBSecurityGroup
+}
+
+func parseDBSecurityGroups(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &describeDBSecurityGroupsOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	entities := make([]*Entity, 0, len(output.DBSecurityGroups))
+	for _, data := range output.DBSecurityGroups {
+		account, err := owner(accountId, data.OwnerId)
+		if err != nil {
+			return nil, err
+		}
+
+		group, err := store.NewGroup(customerId, account, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{account, group})
+	}
+
+	return entities, nil
+}
+
+func parseLoadBalancers(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_elb.DescribeLoadBalancersOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	if accountId == "" {
+		return nil, ErrMissingAccount
+	}
+
+	entities := make([]*Entity, 0, len(output.LoadBalancerDescriptions))
+	for _, data := range output.LoadBalancerDescriptions {
+		group, err := store.NewGroup(customerId, accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{accountId, group})
+	}
+
+	return entities, nil
+}
+
+func parseAutoScalingGroups(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_autoscaling.DescribeAutoScalingGroupsOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	if accountId == "" {
+		return nil, ErrMissingAccount
+	}
+
+	entities := make([]*Entity, 0, len(output.AutoScalingGroups))
+	for _, data := range output.AutoScalingGroups {
+		group, err := store.NewGroup(customerId, accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{accountId, group})
+	}
+
+	return entities, nil
+}
+
+func parseRouteTables(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_ec2.DescribeRouteTablesOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	if accountId == "" {
+		return nil, ErrMissingAccount
+	}
+
+	entities := make([]*Entity, 0, len(output.RouteTables))
+	for _, data := range output.RouteTables {
+		routeTable, err := store.NewRouteTable(customerId, accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{accountId, routeTable})
+	}
+
+	return entities, nil
+}
+
+func parseSubnets(dec *json.Decoder, customerId, accountId string) ([]*Entity, error) {
+	output := &opsee_aws_ec2.DescribeSubnetsOutput{}
+	if err := dec.Decode(output); err != nil {
+		return nil, err
+	}
+
+	if accountId == "" {
+		return nil, ErrMissingAccount
+	}
+
+	entities := make([]*Entity, 0, len(output.Subnets))
+	for _, data := range output.Subnets {
+		subnet, err := store.NewSubnet(customerId, accountId, data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{accountId, subnet})
+	}
+
+	return entities, nil
+}
+
+// owner picks the account an entity is imported under: the one asked for, or
+// else the owner recorded in the describe output.
+func owner(accountId string, ownerId *string) (string, error) {
+	if accountId != "" {
+		return accountId, nil
+	}
+
+	if ownerId == nil || *ownerId == "" {
+		return "", fmt.Errorf("%s and the describe output has no owner id", ErrMissingAccount)
+	}
+
+	return *ownerId, nil
+}
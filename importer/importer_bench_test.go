@@ -0,0 +1,110 @@
+package importer
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"github.com/opsee/fieri/migrations"
+	"github.com/opsee/fieri/store"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkPutFixtures writes every entity in fixtures/*.json, as a bastion
+// reporting them would, one at a time with PutEntity and all at once with
+// PutEntities. After the first iteration the entities are already stored, so
+// most writes find them unchanged.
+func BenchmarkPutFixtures(b *testing.B) {
+	conn := os.Getenv("POSTGRES_CONN")
+	if conn == "" {
+		b.Skip("POSTGRES_CONN isn't set")
+	}
+
+	migrate, err := sql.Open("postgres", conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = migrations.Up(migrate)
+	migrate.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	db, err := store.NewPostgres(store.PostgresConfig{Connection: conn, MaxOpenConns: 10, MaxIdleConns: 10})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	b.Run("PutEntity", func(b *testing.B) {
+		entities := fixtureEntities(b)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for _, entity := range entities {
+				if _, err := db.PutEntity(entity); err != nil && err != store.ErrStaleEntity {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("PutEntities", func(b *testing.B) {
+		entities := fixtureEntities(b)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := db.PutEntities(entities); err != nil && err != store.ErrStaleEntity {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// fixtureEntities parses every fixture for a new customer, so that each
+// benchmark starts from an empty customer.
+func fixtureEntities(b *testing.B) []interface{} {
+	paths, err := filepath.Glob("../fixtures/*.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	customerId := newCustomerId(b)
+	var entities []interface{}
+	for _, path := range paths {
+		kind := strings.TrimSuffix(filepath.Base(path), ".json")
+		if _, ok := kinds[kind]; !ok {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		parsed, err := Parse(kind, customerId, "933693344490", f)
+		f.Close()
+		if err != nil {
+			b.Fatalf("%s: %s", path, err)
+		}
+
+		for _, e := range parsed {
+			entities = append(entities, e.Entity)
+		}
+	}
+
+	return entities
+}
+
+func newCustomerId(b *testing.B) string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		b.Fatal(err)
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
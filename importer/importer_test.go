@@ -0,0 +1,120 @@
+package importer
+
+import (
+	"errors"
+	"github.com/opsee/fieri/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testCustomerId = "8c3ec0e4-5a1f-4bd9-b5ff-a11b5ea7b5ad"
+	testAccountId  = "933693344490"
+)
+
+func parseFixture(t *testing.T, kind, accountId string) ([]*Entity, error) {
+	f, err := os.Open("../fixtures/" + kind + ".json")
+	require.NoError(t, err)
+	defer f.Close()
+
+	return Parse(kind, testCustomerId, accountId, f)
+}
+
+func TestParseFixtures(t *testing.T) {
+	counts := map[string]int{
+		"instances":           6,
+		"db-instances":        3,
+		"db-security-groups":  1,
+		"security-groups":     13,
+		"load-balancers":      10,
+		"auto-scaling-groups": 1,
+		"route-tables":        1,
+		"subnets":             3,
+	}
+	assert.Len(t, Kinds(), len(counts))
+
+	for _, kind := range Kinds() {
+		entities, err := parseFixture(t, kind, testAccountId)
+		require.NoError(t, err, kind)
+		assert.Len(t, entities, counts[kind], kind)
+
+		for _, e := range entities {
+			assert.Equal(t, testAccountId, e.AccountId, "%s %s", kind, e)
+		}
+	}
+}
+
+func TestParseAccounts(t *testing.T) {
+	// kinds without an owner id in their output need the account.
+	for _, kind := range []string{"load-balancers", "auto-scaling-groups", "db-instances", "route-tables", "subnets"} {
+		_, err := parseFixture(t, kind, "")
+		assert.Equal(t, ErrMissingAccount, err, kind)
+	}
+
+	// the others default to the owner, and are imported under the account
+	// asked for when it's another.
+	for _, kind := range []string{"instances", "security-groups", "db-security-groups"} {
+		entities, err := parseFixture(t, kind, "")
+		require.NoError(t, err, kind)
+		require.NotEmpty(t, entities, kind)
+		assert.Equal(t, "933693344490", entities[0].AccountId, kind)
+
+		entities, err = parseFixture(t, kind, "120589623411")
+		require.NoError(t, err, kind)
+		require.NotEmpty(t, entities, kind)
+		for _, e := range entities {
+			assert.Equal(t, "120589623411", e.AccountId, "%s %s", kind, e)
+		}
+	}
+
+	_, err := Parse("instances", testCustomerId, "", strings.NewReader(`{"Reservations": [{"Instances": [{"InstanceId": "i-39aae6fb"}]}]}`))
+	assert.EqualError(t, err, "account id is required for this kind and the describe output has no owner id")
+
+	_, err = Parse("instances", "", testAccountId, strings.NewReader(`{}`))
+	assert.Equal(t, ErrMissingCustomer, err)
+
+	_, err = Parse("volumes", testCustomerId, testAccountId, strings.NewReader(`{}`))
+	assert.Equal(t, ErrUnknownKind, err)
+}
+
+// failingStore fails writes of an entity with the errors queued for it.
+type failingStore struct {
+	store.Store
+
+	errs   map[string][]error
+	stored []string
+}
+
+func (s *failingStore) PutEntity(entity interface{}) (*store.EntityResponse, error) {
+	id := (&Entity{Entity: entity}).String()
+	if errs := s.errs[id]; len(errs) > 0 {
+		s.errs[id] = errs[1:]
+		return nil, errs[0]
+	}
+
+	s.stored = append(s.stored, id)
+	return &store.EntityResponse{}, nil
+}
+
+func TestImport(t *testing.T) {
+	subnets := `{"Subnets": [{"SubnetId": "subnet-0378a966"}, {"SubnetId": "subnet-50760c27"}, {"SubnetId": "subnet-eccedfaa"}]}`
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		db := &failingStore{errs: map[string][]error{"subnet/subnet-50760c27": {store.ErrWriteConflict, store.ErrWriteConflict}}}
+		n, err := Import(db, "subnets", testCustomerId, testAccountId, strings.NewReader(subnets))
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, []string{"subnet/subnet-0378a966", "subnet/subnet-50760c27", "subnet/subnet-eccedfaa"}, db.stored)
+	})
+
+	t.Run("other errors stop the import", func(t *testing.T) {
+		db := &failingStore{errs: map[string][]error{"subnet/subnet-50760c27": {errors.New("value too long")}}}
+		n, err := Import(db, "subnets", testCustomerId, testAccountId, strings.NewReader(subnets))
+		assert.EqualError(t, err, "storing subnet/subnet-50760c27 in account 933693344490: value too long")
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []string{"subnet/subnet-0378a966"}, db.stored)
+	})
+}
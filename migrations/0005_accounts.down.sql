@@ -0,0 +1,26 @@
+drop table accounts;
+
+alter table groups_instances drop constraint groups_instances_group_fkey;
+alter table groups_instances drop constraint groups_instances_instance_fkey;
+alter table groups_instances drop constraint groups_instances_key;
+alter table groups_instances drop column account_id;
+
+alter table subnets drop constraint subnets_pkey;
+alter table subnets drop column account_id;
+alter table subnets add primary key (customer_id, id);
+
+alter table route_tables drop constraint route_tables_pkey;
+alter table route_tables drop column account_id;
+alter table route_tables add primary key (customer_id, id);
+
+alter table groups drop constraint groups_pkey;
+alter table groups drop column account_id;
+alter table groups add primary key (customer_id, name);
+
+alter table instances drop constraint instances_pkey;
+alter table instances drop column account_id;
+alter table instances add primary key (customer_id, id);
+
+alter table groups_instances add foreign key (customer_id, group_name) references groups (customer_id, name) on delete cascade;
+alter table groups_instances add foreign key (customer_id, instance_id) references instances (customer_id, id) on delete cascade;
+alter table groups_instances add unique (customer_id, group_name, instance_id);
@@ -0,0 +1,37 @@
+alter table groups_instances drop constraint groups_instances_customer_id_fkey;
+alter table groups_instances drop constraint groups_instances_customer_id_fkey1;
+alter table groups_instances drop constraint groups_instances_customer_id_group_name_instance_id_key;
+
+alter table instances add column account_id character varying(64) not null default '';
+alter table instances drop constraint instances_pkey;
+alter table instances add primary key (customer_id, account_id, id);
+
+alter table groups add column account_id character varying(64) not null default '';
+alter table groups drop constraint groups_pkey;
+alter table groups add primary key (customer_id, account_id, name);
+
+alter table route_tables add column account_id character varying(64) not null default '';
+alter table route_tables drop constraint route_tables_pkey;
+alter table route_tables add primary key (customer_id, account_id, id);
+
+alter table subnets add column account_id character varying(64) not null default '';
+alter table subnets drop constraint subnets_pkey;
+alter table subnets add primary key (customer_id, account_id, id);
+
+alter table groups_instances add column account_id character varying(64) not null default '';
+alter table groups_instances add constraint groups_instances_group_fkey foreign key (customer_id, account_id, group_name) references groups (customer_id, account_id, name) on delete cascade;
+alter table groups_instances add constraint groups_instances_instance_fkey foreign key (customer_id, account_id, instance_id) references instances (customer_id, account_id, id) on delete cascade;
+alter table groups_instances add constraint groups_instances_key unique (customer_id, account_id, group_name, instance_id);
+
+create table accounts (
+  id character varying(64) not null,
+  customer_id UUID not null,
+  last_sync timestamp with time zone,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (customer_id, id)
+);
+
+create trigger trg_accounts_updated_at before update on accounts for each row execute procedure update_time();
+
+insert into accounts (id, customer_id, last_sync) select '', id, last_sync from customers;
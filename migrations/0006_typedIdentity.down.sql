@@ -0,0 +1,16 @@
+alter table groups_instances drop constraint groups_instances_group_fkey;
+alter table groups_instances drop constraint groups_instances_instance_fkey;
+alter table groups_instances drop constraint groups_instances_key;
+
+alter table groups drop constraint groups_pkey;
+alter table groups add primary key (customer_id, account_id, name);
+
+alter table instances drop constraint instances_pkey;
+alter table instances add primary key (customer_id, account_id, id);
+
+alter table groups_instances drop column instance_type;
+alter table groups_instances drop column group_type;
+
+alter table groups_instances add constraint groups_instances_group_fkey foreign key (customer_id, account_id, group_name) references groups (customer_id, account_id, name) on delete cascade;
+alter table groups_instances add constraint groups_instances_instance_fkey foreign key (customer_id, account_id, instance_id) references instances (customer_id, account_id, id) on delete cascade;
+alter table groups_instances add constraint groups_instances_key unique (customer_id, account_id, group_name, instance_id);
@@ -0,0 +1,23 @@
+alter table groups_instances drop constraint groups_instances_group_fkey;
+alter table groups_instances drop constraint groups_instances_instance_fkey;
+alter table groups_instances drop constraint groups_instances_key;
+
+alter table groups_instances add column group_type group_type;
+alter table groups_instances add column instance_type instance_type;
+
+update groups_instances set group_type = groups.type from groups where groups.customer_id = groups_instances.customer_id and groups.account_id = groups_instances.account_id and groups.name = groups_instances.group_name;
+update groups_instances set instance_type = instances.type from instances where instances.customer_id = groups_instances.customer_id and instances.account_id = groups_instances.account_id and instances.id = groups_instances.instance_id;
+delete from groups_instances where group_type is null or instance_type is null;
+
+alter table groups_instances alter column group_type set not null;
+alter table groups_instances alter column instance_type set not null;
+
+alter table instances drop constraint instances_pkey;
+alter table instances add primary key (customer_id, account_id, type, id);
+
+alter table groups drop constraint groups_pkey;
+alter table groups add primary key (customer_id, account_id, type, name);
+
+alter table groups_instances add constraint groups_instances_group_fkey foreign key (customer_id, account_id, group_type, group_name) references groups (customer_id, account_id, type, name) on delete cascade;
+alter table groups_instances add constraint groups_instances_instance_fkey foreign key (customer_id, account_id, instance_type, instance_id) references instances (customer_id, account_id, type, id) on delete cascade;
+alter table groups_instances add constraint groups_instances_key unique (customer_id, account_id, group_type, group_name, instance_type, instance_id);
@@ -0,0 +1,10 @@
+create table expirations (
+  customer_id UUID not null,
+  account_id character varying(64) not null default '',
+  expired_at timestamp with time zone not null,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (customer_id, account_id)
+);
+
+create trigger trg_expirations_updated_at before update on expirations for each row execute procedure update_time();
@@ -0,0 +1 @@
+drop table expiry_ttls;
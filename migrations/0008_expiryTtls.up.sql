@@ -0,0 +1,10 @@
+create table expiry_ttls (
+  customer_id UUID not null,
+  entity_type character varying(32) not null,
+  ttl_seconds integer not null,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL,
+	primary key (customer_id, entity_type)
+);
+
+create trigger trg_expiry_ttls_updated_at before update on expiry_ttls for each row execute procedure update_time();
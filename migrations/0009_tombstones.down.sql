@@ -0,0 +1,9 @@
+delete from instances where deleted_at is not null;
+delete from groups where deleted_at is not null;
+delete from route_tables where deleted_at is not null;
+delete from subnets where deleted_at is not null;
+
+alter table instances drop column deleted_at;
+alter table groups drop column deleted_at;
+alter table route_tables drop column deleted_at;
+alter table subnets drop column deleted_at;
@@ -0,0 +1,9 @@
+alter table instances add column deleted_at timestamp with time zone;
+alter table groups add column deleted_at timestamp with time zone;
+alter table route_tables add column deleted_at timestamp with time zone;
+alter table subnets add column deleted_at timestamp with time zone;
+
+create index idx_instances_deleted_at on instances (deleted_at) where deleted_at is not null;
+create index idx_groups_deleted_at on groups (deleted_at) where deleted_at is not null;
+create index idx_route_tables_deleted_at on route_tables (deleted_at) where deleted_at is not null;
+create index idx_subnets_deleted_at on subnets (deleted_at) where deleted_at is not null;
@@ -0,0 +1,17 @@
+create table dead_letters (
+  id bigserial primary key,
+  customer_id character varying(255) not null default '',
+  account_id character varying(64) not null default '',
+  type character varying(64) not null default '',
+  source character varying(255) not null default '',
+  body text not null,
+  error text not null,
+  attempts integer not null default 0,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  updated_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+create index idx_dead_letters_customer_type on dead_letters (customer_id, type);
+create index idx_dead_letters_created_at on dead_letters (created_at);
+
+create trigger trg_dead_letters_updated_at before update on dead_letters for each row execute procedure update_time();
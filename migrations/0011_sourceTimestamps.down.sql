@@ -0,0 +1,4 @@
+alter table instances drop column source_timestamp;
+alter table groups drop column source_timestamp;
+alter table route_tables drop column source_timestamp;
+alter table subnets drop column source_timestamp;
@@ -0,0 +1,4 @@
+alter table instances add column source_timestamp timestamp with time zone;
+alter table groups add column source_timestamp timestamp with time zone;
+alter table route_tables add column source_timestamp timestamp with time zone;
+alter table subnets add column source_timestamp timestamp with time zone;
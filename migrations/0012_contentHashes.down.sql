@@ -0,0 +1,4 @@
+alter table instances drop column content_hash, drop column changed_at, drop column last_seen_at;
+alter table groups drop column content_hash, drop column changed_at, drop column last_seen_at;
+alter table route_tables drop column content_hash, drop column changed_at, drop column last_seen_at;
+alter table subnets drop column content_hash, drop column changed_at, drop column last_seen_at;
@@ -0,0 +1,27 @@
+alter table instances add column content_hash character varying(64) not null default '',
+  add column changed_at timestamp with time zone,
+  add column last_seen_at timestamp with time zone;
+update instances set changed_at = updated_at, last_seen_at = updated_at;
+alter table instances alter column changed_at set default now(), alter column changed_at set not null,
+  alter column last_seen_at set default now(), alter column last_seen_at set not null;
+
+alter table groups add column content_hash character varying(64) not null default '',
+  add column changed_at timestamp with time zone,
+  add column last_seen_at timestamp with time zone;
+update groups set changed_at = updated_at, last_seen_at = updated_at;
+alter table groups alter column changed_at set default now(), alter column changed_at set not null,
+  alter column last_seen_at set default now(), alter column last_seen_at set not null;
+
+alter table route_tables add column content_hash character varying(64) not null default '',
+  add column changed_at timestamp with time zone,
+  add column last_seen_at timestamp with time zone;
+update route_tables set changed_at = updated_at, last_seen_at = updated_at;
+alter table route_tables alter column changed_at set default now(), alter column changed_at set not null,
+  alter column last_seen_at set default now(), alter column last_seen_at set not null;
+
+alter table subnets add column content_hash character varying(64) not null default '',
+  add column changed_at timestamp with time zone,
+  add column last_seen_at timestamp with time zone;
+update subnets set changed_at = updated_at, last_seen_at = updated_at;
+alter table subnets alter column changed_at set default now(), alter column changed_at set not null,
+  alter column last_seen_at set default now(), alter column last_seen_at set not null;
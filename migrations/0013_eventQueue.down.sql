@@ -0,0 +1,2 @@
+drop table event_queue;
+drop function notify_event_queue();
@@ -0,0 +1,18 @@
+create table event_queue (
+  id bigserial primary key,
+  body text not null,
+  attempts integer not null default 0,
+  available_at timestamp with time zone DEFAULT now() NOT NULL,
+  created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+create index idx_event_queue_available_at on event_queue (available_at);
+
+create function notify_event_queue() returns trigger as $$
+begin
+  perform pg_notify('fieri_events', '');
+  return null;
+end;
+$$ language plpgsql;
+
+create trigger trg_event_queue_notify after insert on event_queue for each statement execute procedure notify_event_queue();
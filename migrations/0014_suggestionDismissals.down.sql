@@ -0,0 +1 @@
+drop table suggestion_dismissals;
@@ -0,0 +1,12 @@
+create table suggestion_dismissals (
+  id bigserial primary key,
+  customer_id UUID not null,
+  account_id character varying(64) not null,
+  target_type character varying(64) not null,
+  target_id character varying(255) not null,
+  protocol character varying(16) not null,
+  port integer not null,
+  path text not null default '',
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  unique (customer_id, account_id, target_type, target_id, protocol, port, path)
+);
@@ -0,0 +1,15 @@
+drop index idx_instances_endpoint_address;
+alter table instances drop column endpoint_address, drop column endpoint_port;
+
+drop table groups_subnets;
+
+delete from groups where type = 'rds-subnet';
+alter table groups_instances drop constraint groups_instances_group_fkey;
+
+alter type group_type rename to group_type_new;
+create type group_type as enum ('security', 'rds-security', 'elb', 'autoscaling', 'tag');
+alter table groups alter column type type group_type using type::text::group_type;
+alter table groups_instances alter column group_type type group_type using group_type::text::group_type;
+drop type group_type_new;
+
+alter table groups_instances add constraint groups_instances_group_fkey foreign key (customer_id, account_id, group_type, group_name) references groups (customer_id, account_id, type, name) on delete cascade;
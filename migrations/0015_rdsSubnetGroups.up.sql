@@ -0,0 +1,30 @@
+-- enum values can't be added within a transaction on 9.4, so group_type is
+-- recreated with rds-subnet.
+alter table groups_instances drop constraint groups_instances_group_fkey;
+
+alter type group_type rename to group_type_old;
+create type group_type as enum ('security', 'rds-security', 'rds-subnet', 'elb', 'autoscaling', 'tag');
+alter table groups alter column type type group_type using type::text::group_type;
+alter table groups_instances alter column group_type type group_type using group_type::text::group_type;
+drop type group_type_old;
+
+alter table groups_instances add constraint groups_instances_group_fkey foreign key (customer_id, account_id, group_type, group_name) references groups (customer_id, account_id, type, name) on delete cascade;
+
+create table groups_subnets (
+  customer_id UUID not null,
+  account_id character varying(64) not null default '',
+  group_type group_type not null,
+  group_name character varying(128) not null,
+  subnet_id character varying(128) not null,
+  created_at timestamp with time zone DEFAULT now() NOT NULL,
+  constraint groups_subnets_group_fkey foreign key (customer_id, account_id, group_type, group_name) references groups (customer_id, account_id, type, name) on delete cascade,
+  constraint groups_subnets_key unique (customer_id, account_id, group_type, group_name, subnet_id)
+);
+
+create index idx_groups_subnets_subnet on groups_subnets (customer_id, account_id, subnet_id);
+
+alter table instances add column endpoint_address character varying(255),
+  add column endpoint_port integer;
+update instances set endpoint_address = data->'Endpoint'->>'Address', endpoint_port = (data->'Endpoint'->>'Port')::integer where type = 'rds';
+
+create index idx_instances_endpoint_address on instances (customer_id, lower(endpoint_address)) where endpoint_address is not null;
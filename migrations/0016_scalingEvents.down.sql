@@ -0,0 +1 @@
+drop table scaling_events;
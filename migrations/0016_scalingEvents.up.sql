@@ -0,0 +1,20 @@
+create table scaling_events (
+  id bigserial primary key,
+  customer_id UUID not null,
+  account_id character varying(64) not null default '',
+  group_name character varying(255) not null,
+  kind character varying(64) not null,
+  previous_desired integer,
+  desired integer,
+  previous_min_size integer,
+  min_size integer,
+  previous_max_size integer,
+  max_size integer,
+  instances jsonb not null default '[]',
+  processes jsonb not null default '[]',
+  observed_at timestamp with time zone not null,
+  created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+create index idx_scaling_events_group on scaling_events (customer_id, account_id, group_name, observed_at);
+create index idx_scaling_events_observed_at on scaling_events (observed_at);
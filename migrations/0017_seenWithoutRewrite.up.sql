@@ -0,0 +1,13 @@
+-- entities reported unchanged only have last_seen_at set, so updated_at
+-- follows their data rather than every report.
+drop trigger trg_instances_updated_at on instances;
+create trigger trg_instances_updated_at before update on instances for each row when (OLD.data is distinct from NEW.data) execute procedure update_time();
+
+drop trigger trg_groups_updated_at on groups;
+create trigger trg_groups_updated_at before update on groups for each row when (OLD.data is distinct from NEW.data) execute procedure update_time();
+
+drop trigger trg_route_tables_updated_at on route_tables;
+create trigger trg_route_tables_updated_at before update on route_tables for each row when (OLD.data is distinct from NEW.data) execute procedure update_time();
+
+drop trigger trg_subnets_updated_at on subnets;
+create trigger trg_subnets_updated_at before update on subnets for each row when (OLD.data is distinct from NEW.data) execute procedure update_time();
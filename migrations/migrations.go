@@ -0,0 +1,301 @@
+// Package migrations embeds fieri's schema migrations and applies them. It
+// keeps its bookkeeping in the same schema_migrations table as the migrate
+// tool it replaces, so databases migrated by either are interchangeable.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// lockId is the advisory lock held while migrating, so replicas started at
+// the same time don't race to apply the same migration.
+const lockId = 0x6669657269
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// ErrNoMigrations is returned by Version for a database that was never migrated.
+var ErrNoMigrations = errors.New("no migrations are applied")
+
+// Migration is a single schema version with the sql to apply and revert it.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied to a database.
+type Status struct {
+	*Migration
+	Applied bool
+}
+
+// All returns every embedded migration ordered by version.
+func All() ([]*Migration, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := files.ReadFile(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Latest returns the schema version this binary expects.
+func Latest() (uint64, error) {
+	migrations, err := All()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Version returns the highest migration applied to db, or ErrNoMigrations.
+func Version(db *sql.DB) (uint64, error) {
+	if err := ensureTable(db); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRow("select max(version) from schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	if !version.Valid {
+		return 0, ErrNoMigrations
+	}
+
+	return uint64(version.Int64), nil
+}
+
+// Check returns an error unless db is migrated to exactly the version this
+// binary expects.
+func Check(db *sql.DB) error {
+	latest, err := Latest()
+	if err != nil {
+		return err
+	}
+
+	version, err := Version(db)
+	if err != nil {
+		return fmt.Errorf("schema check: %s, expected version %d", err, latest)
+	}
+
+	if version != latest {
+		return fmt.Errorf("schema check: database is at version %d, expected version %d", version, latest)
+	}
+
+	return nil
+}
+
+// StatusOf lists every embedded migration and whether it's applied to db.
+func StatusOf(db *sql.DB) ([]*Status, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*Status, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = &Status{m, applied[m.Version]}
+	}
+
+	return statuses, nil
+}
+
+// Up applies every pending migration in order, each in its own transaction,
+// and returns the ones it applied.
+func Up(db *sql.DB) ([]*Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []*Migration
+	err = withLock(db, func() error {
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if applied[m.Version] {
+				continue
+			}
+
+			if err := apply(db, m.Up, "insert into schema_migrations (version) values ($1)", m.Version); err != nil {
+				return fmt.Errorf("migration %d_%s up: %s", m.Version, m.Name, err)
+			}
+			ran = append(ran, m)
+		}
+
+		return nil
+	})
+
+	return ran, err
+}
+
+// Down reverts the most recently applied steps migrations, newest first,
+// and returns the ones it reverted.
+func Down(db *sql.DB, steps int) ([]*Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []*Migration
+	err = withLock(db, func() error {
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+			m := migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+
+			if err := apply(db, m.Down, "delete from schema_migrations where version = $1", m.Version); err != nil {
+				return fmt.Errorf("migration %d_%s down: %s", m.Version, m.Name, err)
+			}
+			ran = append(ran, m)
+		}
+
+		return nil
+	})
+
+	return ran, err
+}
+
+func apply(db *sql.DB, content, record string, version uint64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// some down migrations are intentionally empty.
+	if strings.TrimSpace(content) != "" {
+		if _, err := tx.Exec(content); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(record, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func withLock(db *sql.DB, fn func() error) error {
+	// advisory locks belong to a session, so hold one connection throughout.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", lockId); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "select pg_advisory_unlock($1)", lockId)
+
+	if err := ensureTable(db); err != nil {
+		return err
+	}
+
+	return fn()
+}
+
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec("create table if not exists schema_migrations (version int not null primary key)")
+	return err
+}
+
+func appliedVersions(db *sql.DB) (map[uint64]bool, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("select version from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[uint64]bool)
+	for rows.Next() {
+		var version uint64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opsee/fieri/store"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoCustomer = errors.New("no customer exists")
+
+// Client reads from a fieri http service, mirroring the read methods of
+// store.Store so callers can use either.
+type Client struct {
+	addr   string
+	client *http.Client
+}
+
+// NewClient returns a client for the fieri service at addr, e.g.
+// http://fieri:9092, giving each request up to timeout.
+func NewClient(addr string, timeout time.Duration) *Client {
+	return &Client{
+		addr:   strings.TrimSuffix(addr, "/"),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *Client) GetInstance(request *store.InstanceRequest) (*store.InstanceResponse, error) {
+	query := url.Values{}
+	setQuery(query, "account_id", request.AccountId)
+	setIncludeDeleted(query, request.IncludeDeleted)
+
+	response := &store.InstanceResponse{}
+	path := fmt.Sprintf("/instance/%s/%s", url.PathEscape(request.Type), url.PathEscape(request.InstanceId))
+	if err := c.get(path, request.CustomerId, query, response); err != nil {
+		return nil, err
+	}
+	fillInstance(response, request.CustomerId)
+
+	return response, nil
+}
+
+func (c *Client) ListInstances(request *store.InstancesRequest) (*store.InstancesResponse, error) {
+	query := url.Values{}
+	setQuery(query, "account_id", request.AccountId)
+	setQuery(query, "group_id", request.GroupId)
+	setQuery(query, "group_type", request.GroupType)
+	setQuery(query, "endpoint", request.EndpointAddress)
+	setIncludeDeleted(query, request.IncludeDeleted)
+	setSince(query, request.ChangedSince, request.SeenSince)
+
+	path := "/instances"
+	if request.Type != "" {
+		path += "/" + url.PathEscape(request.Type)
+	}
+
+	response := &store.InstancesResponse{}
+	if err := c.get(path, request.CustomerId, query, response); err != nil {
+		return nil, err
+	}
+
+	for _, instance := range response.Instances {
+		fillInstance(instance, request.CustomerId)
+	}
+
+	return response, nil
+}
+
+func (c *Client) GetGroup(request *store.GroupRequest) (*store.GroupResponse, error) {
+	query := url.Values{}
+	setQuery(query, "account_id", request.AccountId)
+	setIncludeDeleted(query, request.IncludeDeleted)
+
+	response := &store.GroupResponse{}
+	path := fmt.Sprintf("/group/%s/%s", url.PathEscape(request.Type), url.PathEscape(request.GroupId))
+	if err := c.get(path, request.CustomerId, query, response); err != nil {
+		return nil, err
+	}
+	fillGroup(response, request.CustomerId)
+
+	return response, nil
+}
+
+func (c *Client) ListGroups(request *store.GroupsRequest) (*store.GroupsResponse, error) {
+	query := url.Values{}
+	setQuery(query, "account_id", request.AccountId)
+	setIncludeDeleted(query, request.IncludeDeleted)
+	setSince(query, request.ChangedSince, request.SeenSince)
+
+	path := "/groups"
+	if request.Type != "" {
+		path += "/" + url.PathEscape(request.Type)
+	}
+
+	response := &store.GroupsResponse{}
+	if err := c.get(path, request.CustomerId, query, response); err != nil {
+		return nil, err
+	}
+
+	for _, group := range response.Groups {
+		fillGroup(group, request.CustomerId)
+	}
+
+	return response, nil
+}
+
+func (c *Client) GetCustomer(request *store.CustomerRequest) (*store.CustomerResponse, error) {
+	response := &store.CustomerResponse{}
+	if err := c.get("/customer", request.Id, nil, response); err != nil {
+		return nil, err
+	}
+
+	// the service answers with a message rather than an error status.
+	if response.Customer == nil {
+		return nil, errNoCustomer
+	}
+
+	return response, nil
+}
+
+func (c *Client) ListAccounts(request *store.AccountsRequest) (*store.AccountsResponse, error) {
+	response := &store.AccountsResponse{}
+	err := c.get("/accounts", request.CustomerId, nil, response)
+
+	return response, err
+}
+
+func (c *Client) get(path, customerId string, query url.Values, response interface{}) error {
+	u := c.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Customer-Id", customerId)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message := &MessageResponse{}
+		json.NewDecoder(resp.Body).Decode(message)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, message.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// fillInstance restores the instance fields that are only serialized on the
+// enclosing response.
+func fillInstance(response *store.InstanceResponse, customerId string) {
+	if response.Instance == nil {
+		return
+	}
+
+	response.Instance.Id = response.Id
+	response.Instance.CustomerId = customerId
+	response.Instance.AccountId = response.AccountId
+	response.Instance.Type = response.Type
+	response.Instance.DeletedAt = response.DeletedAt
+}
+
+func fillGroup(response *store.GroupResponse, customerId string) {
+	for _, instance := range response.Instances {
+		fillInstance(instance, customerId)
+	}
+
+	if response.Group == nil {
+		return
+	}
+
+	response.Group.Name = response.Id
+	response.Group.CustomerId = customerId
+	response.Group.AccountId = response.AccountId
+	response.Group.Type = response.Type
+	response.Group.DeletedAt = response.DeletedAt
+	response.Group.InstanceCount = response.InstanceCount
+}
+
+func setQuery(query url.Values, key, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+func setIncludeDeleted(query url.Values, includeDeleted bool) {
+	if includeDeleted {
+		query.Set("include_deleted", strconv.FormatBool(includeDeleted))
+	}
+}
+
+func setSince(query url.Values, changedSince, seenSince *time.Time) {
+	if changedSince != nil {
+		query.Set("changed_since", changedSince.Format(time.RFC3339Nano))
+	}
+
+	if seenSince != nil {
+		query.Set("seen_since", seenSince.Format(time.RFC3339Nano))
+	}
+}
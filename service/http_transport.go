@@ -2,21 +2,37 @@ package service
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/julienschmidt/httprouter"
+	"github.com/opsee/fieri/analysis"
+	"github.com/opsee/fieri/consumer"
 	"github.com/opsee/fieri/store"
 	"github.com/yeller/yeller-golang"
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type handlerFunc func(ctx context.Context, request interface{}) (interface{}, int, error)
 type decodeFunc func(r *http.Request, p httprouter.Params) (interface{}, error)
 type panicFunc func(rw http.ResponseWriter, r *http.Request, data interface{})
 
-func (s *service) StartHTTP(addr string) {
+// NewHTTPServer returns a server for the fieri API listening on addr, taking
+// pushed discovery events at POST /events when events isn't nil. The caller
+// owns its lifecycle.
+func (s *service) NewHTTPServer(addr string, events *consumer.HTTP) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: s.router(events),
+	}
+}
+
+func (s *service) router(events *consumer.HTTP) http.Handler {
 	ctx := context.Background()
 
 	router := httprouter.New()
@@ -24,20 +40,42 @@ func (s *service) StartHTTP(addr string) {
 	router.PanicHandler = s.makePanicHandler()
 	router.OPTIONS("/*any", s.wrapHandler(ctx, decodeIdentity, s.okHandler))
 	router.GET("/health", s.wrapHandler(ctx, decodeIdentity, s.okHandler))
+	router.Handler("GET", "/debug/vars", expvar.Handler())
 	router.GET("/instances", s.wrapHandler(ctx, decodeInstancesRequest, s.instancesHandler))
 	router.GET("/instances/:type", s.wrapHandler(ctx, decodeInstancesRequest, s.instancesHandler))
 	router.GET("/instance/:type/:id", s.wrapHandler(ctx, decodeInstanceRequest, s.instanceHandler))
+	router.GET("/instance/:type/:id/exposure", s.wrapHandler(ctx, decodeInstanceRequest, s.instanceExposureHandler))
+	router.GET("/exposure", s.wrapHandler(ctx, decodeExposureRequest, s.exposureHandler))
+	router.GET("/reachability", s.wrapHandler(ctx, decodeReachabilityRequest, s.reachabilityHandler))
+	router.GET("/topology", s.wrapHandler(ctx, decodeTopologyRequest, s.topologyHandler))
+	router.GET("/suggestions", s.wrapHandler(ctx, decodeSuggestionsRequest, s.suggestionsHandler))
+	router.GET("/suggestions/dismissals", s.wrapHandler(ctx, decodeSuggestionDismissalsRequest, s.suggestionDismissalsHandler))
+	router.POST("/suggestions/dismissals", s.wrapHandler(ctx, decodeSuggestionDismissal, s.dismissSuggestionHandler))
+	router.DELETE("/suggestions/dismissals/:id", s.wrapHandler(ctx, decodeSuggestionDismissalRequest, s.deleteSuggestionDismissalHandler))
 	router.GET("/groups", s.wrapHandler(ctx, decodeGroupsRequest, s.groupsHandler))
 	router.GET("/groups/:type", s.wrapHandler(ctx, decodeGroupsRequest, s.groupsHandler))
 	router.GET("/group/:type/:id", s.wrapHandler(ctx, decodeGroupRequest, s.groupHandler))
+	router.GET("/group/:type/:id/events", s.wrapHandler(ctx, decodeScalingEventsRequest, s.scalingEventsHandler))
 	router.POST("/entity/:type", s.wrapHandler(ctx, decodeEntityRequest, s.entityHandler))
 	router.GET("/customer", s.wrapHandler(ctx, decodeCustomerRequest, s.customerHandler))
-	http.ListenAndServe(addr, router)
+	router.GET("/accounts", s.wrapHandler(ctx, decodeAccountsRequest, s.accountsHandler))
+	router.GET("/admin/expiry/:customer_id", s.wrapHandler(ctx, decodeExpiryRequest, s.expiryPreviewHandler))
+	router.PUT("/admin/expiry/:customer_id/ttls", s.wrapHandler(ctx, decodeExpiryTTLsRequest, s.expiryTTLsHandler))
+	router.GET("/admin/dead-letters", s.wrapHandler(ctx, decodeDeadLettersRequest, s.deadLettersHandler))
+	router.DELETE("/admin/dead-letters", s.wrapHandler(ctx, decodeDeadLettersRequest, s.purgeDeadLettersHandler))
+	router.GET("/admin/dead-letters/:id", s.wrapHandler(ctx, decodeDeadLetterRequest, s.deadLetterHandler))
+	router.DELETE("/admin/dead-letters/:id", s.wrapHandler(ctx, decodeDeadLetterRequest, s.deleteDeadLetterHandler))
+	router.POST("/admin/dead-letters/:id/replay", s.wrapHandler(ctx, decodeDeadLetterRequest, s.replayDeadLetterHandler))
+	if events != nil {
+		router.Handler("POST", "/events", events)
+	}
+
+	return router
 }
 
 func (s *service) wrapHandler(ctx context.Context, decoder decodeFunc, handler handlerFunc) httprouter.Handle {
 	return func(rw http.ResponseWriter, r *http.Request, params httprouter.Params) {
-		ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+		ctx, cancel := context.WithTimeout(ctx, s.forwardTimeout)
 		defer cancel()
 
 		req, err := decoder(r, params)
@@ -66,6 +104,9 @@ func (s *service) wrapHandler(ctx context.Context, decoder decodeFunc, handler h
 				return
 			}
 
+			if text, ok := rf.response.(*textResponse); ok {
+				rw.Header().Set("Content-Type", text.contentType)
+			}
 			rw.WriteHeader(rf.status)
 			rw.Write(encodedResponse)
 			log.WithFields(log.Fields{
@@ -93,10 +134,17 @@ func decodeInstanceRequest(r *http.Request, params httprouter.Params) (interface
 		return nil, errMissingCustomerId
 	}
 
+	includeDeleted, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+
 	return &store.InstanceRequest{
-		CustomerId: customerId,
-		InstanceId: params.ByName("id"),
-		Type:       params.ByName("type"),
+		CustomerId:     customerId,
+		AccountId:      r.URL.Query().Get("account_id"),
+		InstanceId:     params.ByName("id"),
+		Type:           params.ByName("type"),
+		IncludeDeleted: includeDeleted,
 	}, nil
 }
 
@@ -106,9 +154,28 @@ func decodeInstancesRequest(r *http.Request, params httprouter.Params) (interfac
 		return nil, errMissingCustomerId
 	}
 
+	includeDeleted, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+
+	changedSince, seenSince, err := decodeSince(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+
 	return &store.InstancesRequest{
-		CustomerId: customerId,
-		Type:       params.ByName("type"),
+		CustomerId:      customerId,
+		AccountId:       query.Get("account_id"),
+		GroupId:         query.Get("group_id"),
+		GroupType:       query.Get("group_type"),
+		Type:            params.ByName("type"),
+		EndpointAddress: query.Get("endpoint"),
+		IncludeDeleted:  includeDeleted,
+		ChangedSince:    changedSince,
+		SeenSince:       seenSince,
 	}, nil
 }
 
@@ -118,22 +185,81 @@ func decodeGroupRequest(r *http.Request, params httprouter.Params) (interface{},
 		return nil, errMissingCustomerId
 	}
 
+	includeDeleted, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+
 	return &store.GroupRequest{
-		CustomerId: customerId,
-		GroupId:    params.ByName("id"),
-		Type:       params.ByName("type"),
+		CustomerId:     customerId,
+		AccountId:      r.URL.Query().Get("account_id"),
+		GroupId:        params.ByName("id"),
+		Type:           params.ByName("type"),
+		IncludeDeleted: includeDeleted,
 	}, nil
 }
 
+// decodeScalingEventsRequest only accepts autoscaling groups, the only ones
+// scaling events are recorded for.
+func decodeScalingEventsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	if params.ByName("type") != store.AutoScalingGroupStoreType {
+		return nil, errMalformedEventsGroupType
+	}
+
+	query := r.URL.Query()
+	request := &store.ScalingEventsRequest{
+		CustomerId: customerId,
+		AccountId:  query.Get("account_id"),
+		GroupName:  params.ByName("id"),
+	}
+
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, errMalformedSince
+		}
+		request.Since = &t
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, errMalformedLimit
+		}
+		request.Limit = n
+	}
+
+	return request, nil
+}
+
 func decodeGroupsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
 	customerId := r.Header.Get("Customer-Id")
 	if customerId == "" {
 		return nil, errMissingCustomerId
 	}
 
+	includeDeleted, err := decodeIncludeDeleted(r)
+	if err != nil {
+		return nil, err
+	}
+
+	changedSince, seenSince, err := decodeSince(r)
+	if err != nil {
+		return nil, err
+	}
+
 	return &store.GroupsRequest{
-		CustomerId: customerId,
-		Type:       params.ByName("type"),
+		CustomerId:     customerId,
+		AccountId:      r.URL.Query().Get("account_id"),
+		Type:           params.ByName("type"),
+		IncludeDeleted: includeDeleted,
+		ChangedSince:   changedSince,
+		SeenSince:      seenSince,
 	}, nil
 }
 
@@ -143,12 +269,20 @@ func decodeEntityRequest(r *http.Request, params httprouter.Params) (interface{}
 		return nil, err
 	}
 
-	entity, err := store.NewEntity(params.ByName("type"), r.Header.Get("Customer-Id"), body)
+	entity, err := store.NewEntity(params.ByName("type"), r.Header.Get("Customer-Id"), r.Header.Get("Account-Id"), body)
 	if err != nil {
 		log.WithError(err).WithField("body", string(body)).Error("failed decoding entity")
 		return nil, errMalformedRequestBody
 	}
 
+	if sourceTimestamp := r.Header.Get("Source-Timestamp"); sourceTimestamp != "" {
+		t, err := time.Parse(time.RFC3339Nano, sourceTimestamp)
+		if err != nil {
+			return nil, errMalformedSourceTimestamp
+		}
+		store.SetSourceTimestamp(entity, t)
+	}
+
 	return entity, nil
 }
 
@@ -162,6 +296,270 @@ func decodeCustomerRequest(r *http.Request, params httprouter.Params) (interface
 	return request, nil
 }
 
+func decodeAccountsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	return &store.AccountsRequest{CustomerId: customerId}, nil
+}
+
+func decodeExpiryRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	return &store.ExpiryRequest{CustomerId: params.ByName("customer_id")}, nil
+}
+
+func decodeExpiryTTLsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	request := &store.ExpiryTTLsRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		return nil, errMalformedRequestBody
+	}
+
+	request.CustomerId = params.ByName("customer_id")
+	return request, nil
+}
+
+func decodeDeadLetterRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return nil, errMalformedDeadLetterId
+	}
+
+	return &store.DeadLetterRequest{Id: id}, nil
+}
+
+func decodeDeadLettersRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	query := r.URL.Query()
+	request := &store.DeadLettersRequest{
+		CustomerId: query.Get("customer_id"),
+		Type:       query.Get("type"),
+	}
+
+	if before := query.Get("before"); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return nil, errMalformedBefore
+		}
+		request.Before = &t
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, errMalformedLimit
+		}
+		request.Limit = n
+	}
+
+	return request, nil
+}
+
+func decodeExposureRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	request := &analysis.ExposureRequest{
+		CustomerId: customerId,
+		AccountId:  r.URL.Query().Get("account_id"),
+	}
+
+	if all := r.URL.Query().Get("all"); all != "" {
+		include, err := strconv.ParseBool(all)
+		if err != nil {
+			return nil, errMalformedAll
+		}
+		request.All = include
+	}
+
+	return request, nil
+}
+
+func decodeReachabilityRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	query := r.URL.Query()
+
+	from, err := analysis.ParseEntityRef(query.Get("from"))
+	if err != nil || (from.Type != store.InstanceStoreType && from.Type != store.DBInstanceStoreType) {
+		return nil, errMalformedFrom
+	}
+
+	to, err := analysis.ParseEntityRef(query.Get("to"))
+	if err != nil || (to.Type != store.InstanceStoreType && to.Type != store.DBInstanceStoreType && to.Type != store.ELBStoreType) {
+		return nil, errMalformedTo
+	}
+
+	protocol := query.Get("protocol")
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, errMalformedProtocol
+	}
+
+	port, err := strconv.ParseInt(query.Get("port"), 10, 64)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errMalformedPort
+	}
+
+	return &analysis.ReachabilityRequest{
+		CustomerId: customerId,
+		AccountId:  query.Get("account_id"),
+		From:       from,
+		To:         to,
+		Protocol:   protocol,
+		Port:       port,
+	}, nil
+}
+
+// topologyRequest is a topology request along with the format to render it
+// in.
+type topologyRequest struct {
+	*analysis.TopologyRequest
+	format string
+}
+
+func decodeTopologyRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	query := r.URL.Query()
+	request := &analysis.TopologyRequest{
+		CustomerId: customerId,
+		AccountId:  query.Get("account_id"),
+		VpcId:      query.Get("vpc_id"),
+		Depth:      analysis.DefaultDepth,
+	}
+
+	if types := query.Get("types"); types != "" {
+		request.Types = strings.Split(types, ",")
+	}
+
+	if focus := query.Get("focus"); focus != "" {
+		ref, err := analysis.ParseEntityRef(focus)
+		if err != nil {
+			return nil, errMalformedFocus
+		}
+		request.Focus = ref
+	}
+
+	if depth := query.Get("depth"); depth != "" {
+		n, err := strconv.Atoi(depth)
+		if err != nil || n < 0 {
+			return nil, errMalformedDepth
+		}
+		request.Depth = n
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "dot":
+	default:
+		return nil, errMalformedFormat
+	}
+
+	return &topologyRequest{request, format}, nil
+}
+
+func decodeSuggestionsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	return &analysis.SuggestionsRequest{CustomerId: customerId, AccountId: r.URL.Query().Get("account_id")}, nil
+}
+
+func decodeSuggestionDismissalsRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	return &store.SuggestionDismissalsRequest{CustomerId: customerId}, nil
+}
+
+// decodeSuggestionDismissal reads a suggestion to dismiss, given the way
+// GET /suggestions returns it, e.g. {"target": {"type": "elb", "id":
+// "my-elb", "account_id": "123456789012"}, "protocol": "http", "port": 80,
+// "path": "/health"}.
+func decodeSuggestionDismissal(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	suggestion := &analysis.Suggestion{}
+	err := json.NewDecoder(r.Body).Decode(suggestion)
+	if err != nil || suggestion.Target == nil || suggestion.Target.AccountId == "" || suggestion.Target.Type == "" || suggestion.Target.Id == "" {
+		return nil, errMalformedRequestBody
+	}
+
+	// http suggestions always have a path, "/" when they have no other.
+	switch suggestion.Protocol {
+	case "http", "https":
+		if suggestion.Path == "" {
+			suggestion.Path = "/"
+		}
+	case "tcp":
+		suggestion.Path = ""
+	default:
+		return nil, errMalformedCheckProtocol
+	}
+
+	if suggestion.Port < 1 || suggestion.Port > 65535 {
+		return nil, errMalformedPort
+	}
+
+	return &store.SuggestionDismissal{
+		CustomerId: customerId,
+		AccountId:  suggestion.Target.AccountId,
+		TargetType: suggestion.Target.Type,
+		TargetId:   suggestion.Target.Id,
+		Protocol:   suggestion.Protocol,
+		Port:       suggestion.Port,
+		Path:       suggestion.Path,
+	}, nil
+}
+
+func decodeSuggestionDismissalRequest(r *http.Request, params httprouter.Params) (interface{}, error) {
+	customerId := r.Header.Get("Customer-Id")
+	if customerId == "" {
+		return nil, errMissingCustomerId
+	}
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return nil, errMalformedDismissalId
+	}
+
+	return &store.SuggestionDismissalRequest{CustomerId: customerId, Id: id}, nil
+}
+
+func decodeIncludeDeleted(r *http.Request) (bool, error) {
+	includeDeleted := r.URL.Query().Get("include_deleted")
+	if includeDeleted == "" {
+		return false, nil
+	}
+
+	include, err := strconv.ParseBool(includeDeleted)
+	if err != nil {
+		return false, errMalformedIncludeDeleted
+	}
+
+	return include, nil
+}
+
 func (s *service) okHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
 	return map[string]bool{"ok": true}, http.StatusOK, nil
 }
@@ -177,13 +575,117 @@ func (s *service) instancesHandler(ctx context.Context, request interface{}) (in
 
 func (s *service) instanceHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
 	response, err := s.GetInstance(request.(*store.InstanceRequest))
+	if err == store.ErrAmbiguousAccount {
+		return MessageResponse{"The instance exists in more than one account, give its account_id."}, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) instanceExposureHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := analysis.InstanceExposure(s.Store, request.(*store.InstanceRequest))
+	if err == analysis.ErrInstanceNotFound {
+		return MessageResponse{"No instance exists."}, http.StatusNotFound, nil
+	}
+	if err == store.ErrAmbiguousAccount {
+		return MessageResponse{"The instance exists in more than one account, give its account_id."}, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) exposureHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := analysis.CustomerExposure(s.Store, request.(*analysis.ExposureRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) reachabilityHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := analysis.Reach(s.Store, request.(*analysis.ReachabilityRequest))
+	if err == analysis.ErrInstanceNotFound {
+		return MessageResponse{"No instance exists."}, http.StatusNotFound, nil
+	}
+	if err == analysis.ErrGroupNotFound {
+		return MessageResponse{"No load balancer exists."}, http.StatusNotFound, nil
+	}
+	if err == store.ErrAmbiguousAccount {
+		return MessageResponse{"The instance or load balancer exists in more than one account, prefix it with the account id, e.g. 933693344490/i-123."}, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) topologyHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	req := request.(*topologyRequest)
+	response, err := analysis.GetTopology(s.Store, req.TopologyRequest)
+	if err == analysis.ErrFocusNotFound {
+		return MessageResponse{"No focus entity exists."}, http.StatusNotFound, nil
+	}
+	if err == analysis.ErrFocusAmbiguous {
+		return MessageResponse{"The focus entity exists in more than one account, prefix it with the account id, e.g. 933693344490/ec2/i-123."}, http.StatusBadRequest, nil
+	}
 	if err != nil {
 		return nil, 0, err
 	}
 
+	if req.format == "dot" {
+		return &textResponse{"text/vnd.graphviz", response.DOT()}, http.StatusOK, nil
+	}
+
 	return response, http.StatusOK, nil
 }
 
+func (s *service) suggestionsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := analysis.Suggest(s.Store, request.(*analysis.SuggestionsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) suggestionDismissalsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListSuggestionDismissals(request.(*store.SuggestionDismissalsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) dismissSuggestionHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PutSuggestionDismissal(request.(*store.SuggestionDismissal))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deleteSuggestionDismissalHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	err := s.DeleteSuggestionDismissal(request.(*store.SuggestionDismissalRequest))
+	if err == store.ErrDismissalNotFound {
+		return MessageResponse{"No dismissal exists."}, http.StatusNotFound, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return MessageResponse{"Dismissal deleted."}, http.StatusOK, nil
+}
+
 func (s *service) groupsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
 	response, err := s.ListGroups(request.(*store.GroupsRequest))
 	if err != nil {
@@ -195,6 +697,18 @@ func (s *service) groupsHandler(ctx context.Context, request interface{}) (inter
 
 func (s *service) groupHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
 	response, err := s.GetGroup(request.(*store.GroupRequest))
+	if err == store.ErrAmbiguousAccount {
+		return MessageResponse{"The group exists in more than one account, give its account_id."}, http.StatusBadRequest, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) scalingEventsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListScalingEvents(request.(*store.ScalingEventsRequest))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -204,6 +718,12 @@ func (s *service) groupHandler(ctx context.Context, request interface{}) (interf
 
 func (s *service) entityHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
 	response, err := s.PutEntity(request)
+	if err == store.ErrStaleEntity {
+		return MessageResponse{"A newer version of the entity is already stored."}, http.StatusConflict, nil
+	}
+	if err == store.ErrWriteConflict {
+		return MessageResponse{"The entity was written concurrently, retry the request."}, http.StatusServiceUnavailable, nil
+	}
 	if err != nil {
 		return nil, 0, err
 	}
@@ -220,6 +740,93 @@ func (s *service) customerHandler(ctx context.Context, request interface{}) (int
 	return response, http.StatusOK, nil
 }
 
+func (s *service) accountsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListAccounts(request.(*store.AccountsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) expiryPreviewHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PreviewExpiry(request.(*store.ExpiryRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) expiryTTLsHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PutExpiryTTLs(request.(*store.ExpiryTTLsRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deadLettersHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.ListDeadLetters(request.(*store.DeadLettersRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) purgeDeadLettersHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.PurgeDeadLetters(request.(*store.DeadLettersRequest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	response, err := s.GetDeadLetter(request.(*store.DeadLetterRequest))
+	if err == store.ErrDeadLetterNotFound {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response, http.StatusOK, nil
+}
+
+func (s *service) deleteDeadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	err := s.DeleteDeadLetter(request.(*store.DeadLetterRequest))
+	if err == store.ErrDeadLetterNotFound {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return MessageResponse{"Dead letter deleted."}, http.StatusOK, nil
+}
+
+// replayDeadLetterHandler handles a dead letter's event again. A replay that
+// fails leaves the letter in place with the new error.
+func (s *service) replayDeadLetterHandler(ctx context.Context, request interface{}) (interface{}, int, error) {
+	letter, err := s.GetDeadLetter(request.(*store.DeadLetterRequest))
+	if err == store.ErrDeadLetterNotFound {
+		return MessageResponse{"No dead letter exists."}, http.StatusNotFound, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := consumer.ReplayDeadLetter(s.Store, letter); err != nil {
+		return MessageResponse{fmt.Sprint("Replay failed: ", err)}, http.StatusUnprocessableEntity, nil
+	}
+
+	return MessageResponse{"Dead letter replayed."}, http.StatusOK, nil
+}
+
 func (s *service) makePanicHandler() panicFunc {
 	return func(rw http.ResponseWriter, r *http.Request, data interface{}) {
 		yeller.NotifyPanic(data)
@@ -242,5 +849,34 @@ func (s *service) renderBadRequest(rw http.ResponseWriter, r *http.Request, err
 }
 
 func encodeResponse(response interface{}) ([]byte, error) {
+	if text, ok := response.(*textResponse); ok {
+		return text.body, nil
+	}
+
 	return json.Marshal(response)
 }
+
+// decodeSince decodes the changed_since and seen_since RFC 3339 times, either
+// of which may be left out.
+func decodeSince(r *http.Request) (*time.Time, *time.Time, error) {
+	query := r.URL.Query()
+
+	var changedSince, seenSince *time.Time
+	if v := query.Get("changed_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, errMalformedChangedSince
+		}
+		changedSince = &t
+	}
+
+	if v := query.Get("seen_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, errMalformedSeenSince
+		}
+		seenSince = &t
+	}
+
+	return changedSince, seenSince, nil
+}
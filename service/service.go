@@ -12,33 +12,58 @@ type Service interface {
 
 type service struct {
 	store.Store
+	forwardTimeout time.Duration
 }
 
 type MessageResponse struct {
 	Message string `json:"message"`
 }
 
+// textResponse is written as is with its content type rather than encoded
+// as json.
+type textResponse struct {
+	contentType string
+	body        []byte
+}
+
 type requestForwarder struct {
 	response interface{}
 	status   int
 	err      error
 }
 
-const (
-	forwardTimeout = 5 * time.Second
-)
-
 var (
-	errMissingCustomerId    = errors.New("missing customer id header (Customer-Id).")
-	errMalformedRequestBody = errors.New("malformed request body.")
-	errMissingAccessKey     = errors.New("missing access_key.")
-	errMissingSecretKey     = errors.New("missing secret_key.")
-	errMissingRegion        = errors.New("missing region.")
-	errMissingEmail         = errors.New("missing email.")
-	errMissingRequestId     = errors.New("missing request_id.")
-	errMissingUserId        = errors.New("missing user_id.")
+	errMissingCustomerId        = errors.New("missing customer id header (Customer-Id).")
+	errMalformedRequestBody     = errors.New("malformed request body.")
+	errMalformedIncludeDeleted  = errors.New("malformed include_deleted, must be true or false.")
+	errMalformedDeadLetterId    = errors.New("malformed dead letter id.")
+	errMalformedBefore          = errors.New("malformed before, must be an RFC 3339 time.")
+	errMalformedLimit           = errors.New("malformed limit, must be a positive number.")
+	errMalformedSourceTimestamp = errors.New("malformed Source-Timestamp header, must be an RFC 3339 time.")
+	errMalformedChangedSince    = errors.New("malformed changed_since, must be an RFC 3339 time.")
+	errMalformedSeenSince       = errors.New("malformed seen_since, must be an RFC 3339 time.")
+	errMalformedAll             = errors.New("malformed all, must be true or false.")
+	errMalformedFrom            = errors.New("malformed from, must be an instance, e.g. i-123 or rds/my-db.")
+	errMalformedTo              = errors.New("malformed to, must be an instance or load balancer, e.g. i-123 or elb/my-elb.")
+	errMalformedProtocol        = errors.New("malformed protocol, must be tcp or udp.")
+	errMalformedPort            = errors.New("malformed port, must be a number from 1 to 65535.")
+	errMalformedFocus           = errors.New("malformed focus, must be a type and id, e.g. ec2/i-123 or vpc/vpc-123, or an ec2 instance id, optionally prefixed by an account id.")
+	errMalformedDepth           = errors.New("malformed depth, must be a number of at least 0.")
+	errMalformedFormat          = errors.New("malformed format, must be json or dot.")
+	errMalformedDismissalId     = errors.New("malformed dismissal id.")
+	errMalformedCheckProtocol   = errors.New("malformed protocol, must be http, https or tcp.")
+	errMalformedEventsGroupType = errors.New("malformed group type, events are only recorded for autoscaling groups.")
+	errMalformedSince           = errors.New("malformed since, must be an RFC 3339 time.")
+	errMissingAccessKey         = errors.New("missing access_key.")
+	errMissingSecretKey         = errors.New("missing secret_key.")
+	errMissingRegion            = errors.New("missing region.")
+	errMissingEmail             = errors.New("missing email.")
+	errMissingRequestId         = errors.New("missing request_id.")
+	errMissingUserId            = errors.New("missing user_id.")
 )
 
-func NewService(store store.Store) *service {
-	return &service{store}
+// NewService returns a service backed by store that gives each http request
+// up to forwardTimeout to be handled.
+func NewService(store store.Store, forwardTimeout time.Duration) *service {
+	return &service{store, forwardTimeout}
 }
@@ -0,0 +1,358 @@
+package store
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"time"
+)
+
+// batchTable is a table written by PutEntities. A batch's rows are copied
+// into a temporary table shaped like it, then written with one statement.
+// Rows are the key columns' values followed by the other columns'. Entity
+// tables' values start with data, content_hash and source_timestamp, and any
+// after those are derived from the data, so are written as they are.
+type batchTable struct {
+	table  string
+	keys   []string
+	values []string
+}
+
+var (
+	instancesBatch   = batchTable{"instances", []string{"customer_id", "account_id", "type", "id"}, []string{"data", "content_hash", "source_timestamp", "endpoint_address", "endpoint_port"}}
+	groupsBatch      = batchTable{"groups", []string{"customer_id", "account_id", "type", "name"}, []string{"data", "content_hash", "source_timestamp"}}
+	routeTablesBatch = batchTable{"route_tables", []string{"customer_id", "account_id", "id"}, []string{"data", "content_hash", "source_timestamp"}}
+	subnetsBatch     = batchTable{"subnets", []string{"customer_id", "account_id", "id"}, []string{"data", "content_hash", "source_timestamp"}}
+
+	// the stubs are the instances and groups entities refer to, created
+	// when they aren't stored yet just as ensureInstance and ensureGroup do.
+	instanceStubsBatch = batchTable{"instances", []string{"customer_id", "account_id", "type", "id"}, []string{"data"}}
+	groupStubsBatch    = batchTable{"groups", []string{"customer_id", "account_id", "type", "name"}, []string{"data"}}
+	linksBatch         = batchTable{"groups_instances", []string{"customer_id", "account_id", "group_type", "group_name", "instance_type", "instance_id"}, nil}
+	subnetLinksBatch   = batchTable{"groups_subnets", []string{"customer_id", "account_id", "group_type", "group_name", "subnet_id"}, nil}
+)
+
+func (t batchTable) columns() []string {
+	return append(append([]string{}, t.keys...), t.values...)
+}
+
+// copy copies rows into the temporary table temp, dropped when tx commits.
+func (t batchTable) copy(tx *sqlx.Tx, temp string, rows [][]interface{}) error {
+	columns := strings.Join(t.columns(), ", ")
+	_, err := tx.Exec(fmt.Sprintf("create temporary table %s on commit drop as select %s from %s with no data", temp, columns, t.table))
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(temp, t.columns()...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	return err
+}
+
+func (t batchTable) match(temp string) string {
+	clauses := make([]string, len(t.keys))
+	for i, key := range t.keys {
+		clauses[i] = fmt.Sprintf("%s.%s = %s.%s", t.table, key, temp, key)
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// upsert writes rows of entities as the single entity upserts do, only
+// marking unchanged entities seen and skipping stale versions, and returns
+// how many it wrote.
+func (t batchTable) upsert(tx *sqlx.Tx, temp string, rows [][]interface{}) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	if err := t.copy(tx, temp, rows); err != nil {
+		return 0, err
+	}
+
+	derived := ""
+	for _, column := range t.values[3:] {
+		derived += fmt.Sprintf(", %[1]s = %[2]s.%[1]s", column, temp)
+	}
+
+	fresh := fmt.Sprintf("(%[1]s.source_timestamp is null or %[2]s.source_timestamp is null or %[1]s.source_timestamp <= %[2]s.source_timestamp)", t.table, temp)
+	query := fmt.Sprintf(`with seen as (update %[1]s set (last_seen_at, deleted_at, source_timestamp) = (now(), null, coalesce(%[2]s.source_timestamp, %[1]s.source_timestamp))
+		  from %[2]s where %[3]s and %[4]s and %[1]s.content_hash = %[2]s.content_hash returning 1),
+		  updated as (update %[1]s set (data, content_hash, changed_at, last_seen_at, deleted_at, source_timestamp) =
+		  (%[2]s.data, %[2]s.content_hash, now(), now(), null, coalesce(%[2]s.source_timestamp, %[1]s.source_timestamp))%[6]s
+		  from %[2]s where %[3]s and %[4]s and %[1]s.content_hash is distinct from %[2]s.content_hash returning 1),
+		  inserted as (insert into %[1]s (%[5]s) select %[5]s from %[2]s where not exists (select 1 from %[1]s where %[3]s) returning 1)
+		  `, t.table, temp, t.match(temp), fresh, strings.Join(t.columns(), ", "), derived) + countWritten("seen", "updated", "inserted")
+
+	var written int
+	err := tx.Get(&written, query)
+	return written, err
+}
+
+// insertMissing inserts the rows that aren't already stored, leaving the
+// others as they are.
+func (t batchTable) insertMissing(tx *sqlx.Tx, temp string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if err := t.copy(tx, temp, rows); err != nil {
+		return err
+	}
+
+	columns := strings.Join(t.columns(), ", ")
+	_, err := tx.Exec(fmt.Sprintf("insert into %[1]s (%[2]s) select %[2]s from %[3]s where not exists (select 1 from %[1]s where %[4]s)", t.table, columns, temp, t.match(temp)))
+	return err
+}
+
+// batchRows collects a table's rows, keeping one per key.
+type batchRows struct {
+	table      batchTable
+	rows       [][]interface{}
+	timestamps []*time.Time
+	index      map[string]int
+}
+
+func newBatchRows(table batchTable) *batchRows {
+	return &batchRows{table: table, index: make(map[string]int)}
+}
+
+// add adds row unless it's already there. Entity rows carry their source
+// timestamp, and replace an earlier row for the same entity unless it was
+// observed later.
+func (b *batchRows) add(row []interface{}, timestamp *time.Time) {
+	key := fmt.Sprint(row[:len(b.table.keys)]...)
+	i, ok := b.index[key]
+	if !ok {
+		b.index[key] = len(b.rows)
+		b.rows = append(b.rows, row)
+		b.timestamps = append(b.timestamps, timestamp)
+		return
+	}
+
+	if previous := b.timestamps[i]; timestamp == nil || previous == nil || !timestamp.Before(*previous) {
+		b.rows[i] = row
+		b.timestamps[i] = timestamp
+	}
+}
+
+// batch is the set of writes for a PutEntities call. Subnet groups are the
+// rds subnet groups of instances, written in full as putInstance writes
+// them, but not counted as entities of the batch.
+type batch struct {
+	instances     *batchRows
+	groups        *batchRows
+	routeTables   *batchRows
+	subnets       *batchRows
+	subnetGroups  *batchRows
+	instanceStubs *batchRows
+	groupStubs    *batchRows
+	links         *batchRows
+	subnetLinks   *batchRows
+	accounts      map[string]*Account
+}
+
+func newBatch() *batch {
+	return &batch{
+		instances:     newBatchRows(instancesBatch),
+		groups:        newBatchRows(groupsBatch),
+		routeTables:   newBatchRows(routeTablesBatch),
+		subnets:       newBatchRows(subnetsBatch),
+		subnetGroups:  newBatchRows(groupsBatch),
+		instanceStubs: newBatchRows(instanceStubsBatch),
+		groupStubs:    newBatchRows(groupStubsBatch),
+		links:         newBatchRows(linksBatch),
+		subnetLinks:   newBatchRows(subnetLinksBatch),
+		accounts:      make(map[string]*Account),
+	}
+}
+
+// add adds an entity's writes to the batch. Data is copied as text, since
+// the copy protocol would otherwise send it as bytea.
+func (b *batch) add(entity interface{}) error {
+	var (
+		rows      *batchRows
+		row       []interface{}
+		timestamp *time.Time
+		account   *Account
+	)
+
+	switch e := entity.(type) {
+	case *Instance:
+		e.ContentHash = contentHash(e.Data)
+		rows, timestamp = b.instances, e.SourceTimestamp
+		row = []interface{}{e.CustomerId, e.AccountId, e.Type, e.Id, string(e.Data), e.ContentHash, e.SourceTimestamp, e.EndpointAddress, e.EndpointPort}
+		account = &Account{Id: e.AccountId, CustomerId: e.CustomerId}
+
+		for _, group := range e.Groups {
+			if group.Type == DBSubnetGroupStoreType {
+				group.ContentHash = contentHash(group.Data)
+				b.subnetGroups.add([]interface{}{group.CustomerId, group.AccountId, group.Type, group.Name, string(group.Data), group.ContentHash, group.SourceTimestamp}, group.SourceTimestamp)
+				b.linkSubnets(group)
+			} else {
+				b.groupStubs.add([]interface{}{group.CustomerId, group.AccountId, group.Type, group.Name, string(group.Data)}, nil)
+			}
+			b.link(group, e)
+		}
+
+	case *Group:
+		e.ContentHash = contentHash(e.Data)
+		rows, timestamp = b.groups, e.SourceTimestamp
+		row = []interface{}{e.CustomerId, e.AccountId, e.Type, e.Name, string(e.Data), e.ContentHash, e.SourceTimestamp}
+		account = &Account{Id: e.AccountId, CustomerId: e.CustomerId}
+
+		for _, instance := range e.Instances {
+			b.instanceStubs.add([]interface{}{instance.CustomerId, instance.AccountId, instance.Type, instance.Id, string(instance.Data)}, nil)
+			b.link(e, instance)
+		}
+		b.linkSubnets(e)
+
+	case *RouteTable:
+		e.ContentHash = contentHash(e.Data)
+		rows, timestamp = b.routeTables, e.SourceTimestamp
+		row = []interface{}{e.CustomerId, e.AccountId, e.Id, string(e.Data), e.ContentHash, e.SourceTimestamp}
+		account = &Account{Id: e.AccountId, CustomerId: e.CustomerId}
+
+	case *Subnet:
+		e.ContentHash = contentHash(e.Data)
+		rows, timestamp = b.subnets, e.SourceTimestamp
+		row = []interface{}{e.CustomerId, e.AccountId, e.Id, string(e.Data), e.ContentHash, e.SourceTimestamp}
+		account = &Account{Id: e.AccountId, CustomerId: e.CustomerId}
+
+	default:
+		return ErrInvalidType
+	}
+
+	rows.add(row, timestamp)
+	b.accounts[account.CustomerId+"/"+account.Id] = account
+
+	return nil
+}
+
+func (b *batch) link(group *Group, instance *Instance) {
+	b.links.add([]interface{}{group.CustomerId, group.AccountId, group.Type, group.Name, instance.Type, instance.Id}, nil)
+}
+
+func (b *batch) linkSubnets(group *Group) {
+	for _, subnetId := range group.Subnets {
+		b.subnetLinks.add([]interface{}{group.CustomerId, group.AccountId, group.Type, group.Name, subnetId}, nil)
+	}
+}
+
+// PutEntities stores a batch of entities in one transaction, writing each
+// table with a single statement rather than a few per entity. Entities are
+// written as PutEntity writes them, except that when the batch holds more
+// than one version of an entity only the last observed is written. Either
+// every entity is written or, on error, none are. Like PutEntity, it fails
+// with ErrWriteConflict when a concurrent write inserted one of its rows
+// first.
+func (pg *Postgres) PutEntities(entities []interface{}) (*EntitiesResponse, error) {
+	response, err := pg.putEntities(entities)
+	return response, upsertError(err)
+}
+
+func (pg *Postgres) putEntities(entities []interface{}) (*EntitiesResponse, error) {
+	b := newBatch()
+	for _, entity := range entities {
+		if err := b.add(entity); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// scaling events compare autoscaling groups with their stored versions,
+	// so are recorded before the groups are written.
+	for _, row := range b.groups.rows {
+		if row[2] != AutoScalingGroupStoreType {
+			continue
+		}
+
+		group := &Group{CustomerId: row[0].(string), AccountId: row[1].(string), Type: row[2].(string), Name: row[3].(string), Data: []byte(row[4].(string)), SourceTimestamp: row[6].(*time.Time)}
+		if err := recordScalingEvents(tx, group); err != nil {
+			return nil, err
+		}
+	}
+
+	written := 0
+	for _, rows := range []*batchRows{b.instances, b.groups, b.routeTables, b.subnets} {
+		n, err := rows.table.upsert(tx, "batch_"+rows.table.table, rows.rows)
+		if err != nil {
+			return nil, err
+		}
+		written += n
+	}
+
+	if _, err := b.subnetGroups.table.upsert(tx, "batch_subnet_groups", b.subnetGroups.rows); err != nil {
+		return nil, err
+	}
+
+	// stubs go in after the entities, so that an entity in the batch is
+	// stored with its own data rather than its stub's.
+	if err := b.instanceStubs.table.insertMissing(tx, "batch_instance_stubs", b.instanceStubs.rows); err != nil {
+		return nil, err
+	}
+
+	if err := b.groupStubs.table.insertMissing(tx, "batch_group_stubs", b.groupStubs.rows); err != nil {
+		return nil, err
+	}
+
+	if err := b.links.table.insertMissing(tx, "batch_links", b.links.rows); err != nil {
+		return nil, err
+	}
+
+	if err := b.subnetLinks.table.insertMissing(tx, "batch_subnet_links", b.subnetLinks.rows); err != nil {
+		return nil, err
+	}
+
+	// accounts are written in order so that concurrent batches lock them in
+	// the same order.
+	keys := make([]string, 0, len(b.accounts))
+	for key := range b.accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lastSync := time.Now()
+	customers := make(map[string]bool)
+	for _, key := range keys {
+		account := b.accounts[key]
+		if !customers[account.CustomerId] {
+			if err := putCustomer(tx, &Customer{Id: account.CustomerId, LastSync: lastSync}); err != nil {
+				return nil, err
+			}
+			customers[account.CustomerId] = true
+		}
+
+		account.LastSync = lastSync
+		if err := putAccount(tx, account); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	stale := len(entities) - written
+	staleWrites.Add(int64(stale))
+
+	return &EntitiesResponse{Stored: written, Stale: stale}, nil
+}
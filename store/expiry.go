@@ -0,0 +1,92 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExpiryConfig controls the expiry sweep. An entity is expired once it has
+// gone unseen for longer than its type's TTL, measured back from the last
+// sync of the account it belongs to. TTLs maps entity store types to their
+// TTL; types without an entry use DefaultTTL. Customers may override both in
+// the database. Expired entities are kept as tombstones for Retention before
+// they're purged.
+type ExpiryConfig struct {
+	Interval   time.Duration
+	DefaultTTL time.Duration
+	TTLs       map[string]time.Duration
+	Retention  time.Duration
+}
+
+// ExpirableTypes lists every entity store type that expiry applies to.
+var ExpirableTypes = []string{
+	InstanceStoreType,
+	DBInstanceStoreType,
+	SecurityGroupStoreType,
+	DBSecurityGroupStoreType,
+	DBSubnetGroupStoreType,
+	AutoScalingGroupStoreType,
+	ELBStoreType,
+	RouteTableStoreType,
+	SubnetStoreType,
+}
+
+// TTL returns the TTL for an entity type, preferring a customer override.
+func (c ExpiryConfig) TTL(entityType string, overrides map[string]time.Duration) time.Duration {
+	if ttl, ok := overrides[entityType]; ok {
+		return ttl
+	}
+
+	if ttl, ok := c.TTLs[entityType]; ok {
+		return ttl
+	}
+
+	return c.DefaultTTL
+}
+
+// ParseTTLs parses a comma-separated list of type=duration pairs, such as
+// "autoscaling=5m,rds=1h".
+func ParseTTLs(s string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ttl %q, expected type=duration", pair)
+		}
+
+		entityType := strings.TrimSpace(parts[0])
+		if !isExpirableType(entityType) {
+			return nil, fmt.Errorf("invalid ttl %q, unknown type %q", pair, entityType)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl %q: %s", pair, err)
+		}
+
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q, must be positive", pair)
+		}
+
+		ttls[entityType] = ttl
+	}
+
+	return ttls, nil
+}
+
+func isExpirableType(entityType string) bool {
+	for _, t := range ExpirableTypes {
+		if t == entityType {
+			return true
+		}
+	}
+
+	return false
+}
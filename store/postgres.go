@@ -1,83 +1,235 @@
 package store
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"expvar"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
+// notStale guards entity upserts so that a version observed before the one
+// stored is never written over it. Versions without a source timestamp are
+// always written.
+const notStale = "(source_timestamp is null or cast(:source_timestamp as timestamptz) is null or source_timestamp <= cast(:source_timestamp as timestamptz))"
+
+// unchanged and changed split entity upserts by content hash. Unchanged
+// entities are only marked seen, so bastions reporting the same entities on
+// every poll don't rewrite their data.
+const (
+	unchanged = "content_hash = :content_hash"
+	changed   = "content_hash is distinct from :content_hash"
+)
+
+// staleWrites counts the entity versions dropped for being older than the one
+// stored, served with the other expvars at /debug/vars.
+var staleWrites = expvar.NewInt("stale_writes")
+
+// countWritten finishes an upsert from its ctes, selecting how many rows
+// they wrote.
+func countWritten(ctes ...string) string {
+	counts := make([]string, len(ctes))
+	for i, cte := range ctes {
+		counts[i] = fmt.Sprintf("(select count(*) from %s)", cte)
+	}
+
+	return "select " + strings.Join(counts, " + ")
+}
+
+// contentHash identifies an entity's data, so that a report of an unchanged
+// entity can skip rewriting it.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 type Postgres struct {
-	db              *sqlx.DB
-	expireChan      chan expireReq
-	expirys         map[string]int64
-	expireMut       *sync.Mutex
-	expireInterval  int64
-	expireThreshold int
+	db       *sqlx.DB
+	expiry   ExpiryConfig
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+type expiryTable struct {
+	table    string
+	idColumn string
+	typed    bool
+}
+
+type ttlOverride struct {
+	EntityType string `db:"entity_type"`
+	TTLSeconds int64  `db:"ttl_seconds"`
+}
+
+// expiryLockClass namespaces fieri's expiry advisory locks, keyed within the
+// class by a hash of the customer and account ids.
+const expiryLockClass = 0x66696572
+
+// expiryTables maps each expirable entity type to the table holding it.
+var expiryTables = map[string]expiryTable{
+	InstanceStoreType:         {"instances", "id", true},
+	DBInstanceStoreType:       {"instances", "id", true},
+	SecurityGroupStoreType:    {"groups", "name", true},
+	DBSecurityGroupStoreType:  {"groups", "name", true},
+	DBSubnetGroupStoreType:    {"groups", "name", true},
+	AutoScalingGroupStoreType: {"groups", "name", true},
+	ELBStoreType:              {"groups", "name", true},
+	RouteTableStoreType:       {"route_tables", "id", false},
+	SubnetStoreType:           {"subnets", "id", false},
+}
+
+// filter accumulates the where clauses of a query along with their
+// positional arguments. Clauses are format strings taking the position of
+// each of their arguments in turn, e.g. "customer_id = $%d".
+type filter struct {
+	clauses []string
+	args    []interface{}
+}
+
+func (f *filter) add(clause string, args ...interface{}) {
+	positions := make([]interface{}, len(args))
+	for i, arg := range args {
+		f.args = append(f.args, arg)
+		positions[i] = len(f.args)
+	}
+
+	f.clauses = append(f.clauses, fmt.Sprintf(clause, positions...))
 }
 
-type expireReq struct {
-	timestamp  int64
-	customerId string
+func (f *filter) where() string {
+	return strings.Join(f.clauses, " and ")
 }
 
-func NewPostgres(connection string, expireInterval, expireThreshold int) (Store, error) {
-	db, err := sqlx.Open("postgres", connection)
+// PostgresConfig configures the postgres store's connection pool and expiry.
+type PostgresConfig struct {
+	Connection   string
+	MaxOpenConns int
+	MaxIdleConns int
+	Expiry       ExpiryConfig
+}
+
+func NewPostgres(config PostgresConfig) (Store, error) {
+	db, err := sqlx.Open("postgres", config.Connection)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(64)
-	db.SetMaxIdleConns(8)
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
 
 	return &Postgres{
-		db:              db,
-		expireChan:      make(chan expireReq),
-		expirys:         make(map[string]int64),
-		expireInterval:  int64(expireInterval),
-		expireThreshold: expireThreshold,
-		expireMut:       &sync.Mutex{},
+		db:     db,
+		expiry: config.Expiry,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
 	}, nil
 }
 
+// Start runs the expiry scheduler, sweeping every known customer account
+// once per expire interval until Stop is called. It is independent of the
+// write path, so PutEntity never waits on expiry.
 func (pg *Postgres) Start() {
-	log.Info("starting db expiry channel")
+	log.Info("starting db expiry sweep")
+	defer close(pg.done)
+
+	ticker := time.NewTicker(pg.expiry.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pg.sweep()
+		case <-pg.stop:
+			log.Info("stopped db expiry sweep")
+			return
+		}
+	}
+}
+
+// Stop ends the expiry scheduler started by Start, waiting for a sweep in
+// progress to finish.
+func (pg *Postgres) Stop() {
+	pg.stopOnce.Do(func() { close(pg.stop) })
+	<-pg.done
+}
 
-	for req := range pg.expireChan {
-		lastEx, ok := pg.expirys[req.customerId]
-		if !ok {
-			pg.expirys[req.customerId] = req.timestamp
+// Close releases the connection pool. Call it after Stop.
+func (pg *Postgres) Close() error {
+	return pg.db.Close()
+}
+
+func (pg *Postgres) sweep() {
+	accounts := make([]*Account, 0)
+	err := pg.db.Select(&accounts, "select * from accounts where last_sync is not null")
+	if err != nil {
+		log.WithError(err).Error("error listing accounts for expiry")
+		return
+	}
+
+	for _, account := range accounts {
+		logger := log.WithFields(log.Fields{
+			"customer-id": account.CustomerId,
+			"account-id":  account.Id,
+			"last-sync":   account.LastSync,
+		})
+
+		expired, err := pg.expireEntities(account.CustomerId, account.Id, account.LastSync)
+		if err != nil {
+			logger.WithError(err).Error("error expiring entities")
 			continue
 		}
 
-		if req.timestamp-lastEx > pg.expireInterval {
-			go func(req expireReq) {
-				logger := log.WithFields(log.Fields{
-					"customer-id": req.customerId,
-					"timestamp":   req.timestamp,
-				})
-
-				err := pg.expireEntities(req.customerId, req.timestamp)
-				if err != nil {
-					logger.WithError(err).Error("error expiring entities")
-					return
-				}
-
-				logger.Info("expiring entities")
-
-				pg.expireMut.Lock()
-				defer pg.expireMut.Unlock()
-				pg.expirys[req.customerId] = req.timestamp
-			}(req)
+		if expired {
+			logger.Info("expiring entities")
+		}
+	}
+
+	err = pg.purgeEntities()
+	if err != nil {
+		log.WithError(err).Error("error purging expired entities")
+	}
+}
+
+// purgeEntities hard deletes entities that were tombstoned longer than the
+// retention period ago.
+func (pg *Postgres) purgeEntities() error {
+	cutoff := time.Now().Add(-1 * pg.expiry.Retention)
+
+	for _, table := range []string{"groups", "instances", "route_tables", "subnets"} {
+		_, err := pg.db.Exec("delete from "+table+" where deleted_at < $1", cutoff)
+		if err != nil {
+			return err
 		}
 	}
+
+	// scaling events go with the autoscaling groups they belong to.
+	_, err := pg.db.Exec("delete from scaling_events where not exists (select 1 from groups where groups.customer_id = scaling_events.customer_id and groups.account_id = scaling_events.account_id and groups.type = $1 and groups.name = scaling_events.group_name)", AutoScalingGroupStoreType)
+	return err
 }
 
+// PutEntity stores an entity. When another writer inserts the same entity
+// between the upsert's check and its insert, it fails with ErrWriteConflict,
+// which is transient: written again, the entity is found and updated.
 func (pg *Postgres) PutEntity(entity interface{}) (*EntityResponse, error) {
+	response, err := pg.putEntity(entity)
+	return response, upsertError(err)
+}
+
+func (pg *Postgres) putEntity(entity interface{}) (*EntityResponse, error) {
 	var (
 		err        error
 		response   *EntityResponse
 		customerId string
+		accountId  string
 	)
 
 	switch entity.(type) {
@@ -85,32 +237,40 @@ func (pg *Postgres) PutEntity(entity interface{}) (*EntityResponse, error) {
 		err = pg.putInstance(entity.(*Instance))
 		response = &EntityResponse{entity}
 		customerId = entity.(*Instance).CustomerId
+		accountId = entity.(*Instance).AccountId
 
 	case *Group:
 		err = pg.putGroup(entity.(*Group))
 		response = &EntityResponse{entity}
 		customerId = entity.(*Group).CustomerId
+		accountId = entity.(*Group).AccountId
 
 	case *RouteTable:
 		err = pg.putRouteTable(entity.(*RouteTable))
 		response = &EntityResponse{entity}
 		customerId = entity.(*RouteTable).CustomerId
+		accountId = entity.(*RouteTable).AccountId
 
 	case *Subnet:
 		err = pg.putSubnet(entity.(*Subnet))
 		response = &EntityResponse{entity}
 		customerId = entity.(*Subnet).CustomerId
+		accountId = entity.(*Subnet).AccountId
 	}
 
-	if err == nil {
+	// a stale entity was still reported by a sync, so the sync is recorded
+	// as PutEntities records it.
+	if err == nil || err == ErrStaleEntity {
 		lastSync := time.Now()
 		customer := &Customer{Id: customerId, LastSync: lastSync}
-		err = pg.putCustomer(customer)
-		if err != nil {
+		if err := putCustomer(pg.db, customer); err != nil {
 			return nil, err
 		}
 
-		pg.expireChan <- expireReq{lastSync.Unix(), customerId}
+		account := &Account{Id: accountId, CustomerId: customerId, LastSync: lastSync}
+		if err := putAccount(pg.db, account); err != nil {
+			return nil, err
+		}
 	}
 
 	return response, err
@@ -125,9 +285,35 @@ func (pg *Postgres) GetInstance(request *InstanceRequest) (*InstanceResponse, er
 		return nil, ErrMissingInstanceId
 	}
 
-	instance := new(Instance)
-	err := pg.db.Get(instance, "select * from instances where customer_id = $1 and id = $2", request.CustomerId, request.InstanceId)
-	return &InstanceResponse{instance}, err
+	if request.Type == "" {
+		return nil, ErrMissingType
+	}
+
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	f.add("type = $%d", request.Type)
+	f.add("id = $%d", request.InstanceId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+
+	instances := make([]*Instance, 0)
+	err := pg.db.Select(&instances, "select * from instances where "+f.where(), f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if len(instances) > 1 {
+		return nil, ErrAmbiguousAccount
+	}
+
+	return newInstanceResponse(instances[0]), nil
 }
 
 func (pg *Postgres) ListInstances(request *InstancesRequest) (*InstancesResponse, error) {
@@ -138,7 +324,7 @@ func (pg *Postgres) ListInstances(request *InstancesRequest) (*InstancesResponse
 
 	responses := make([]*InstanceResponse, len(instances))
 	for i, inst := range instances {
-		responses[i] = &InstanceResponse{inst}
+		responses[i] = newInstanceResponse(inst)
 	}
 
 	return &InstancesResponse{responses}, err
@@ -149,14 +335,24 @@ func (pg *Postgres) CountInstances(request *InstancesRequest) (*CountResponse, e
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	var count int
-
-	if request.Type == "" {
-		err = pg.db.Get(&count, "select count(id) from instances where customer_id = $1", request.CustomerId)
-	} else {
-		err = pg.db.Get(&count, "select count(id) from instances where customer_id = $1 and type = $2", request.CustomerId, request.Type)
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if request.Type != "" {
+		f.add("type = $%d", request.Type)
+	}
+	if request.EndpointAddress != "" {
+		f.add("lower(endpoint_address) = lower($%d)", request.EndpointAddress)
 	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+	addSinceFilters(f, "", request.ChangedSince, request.SeenSince)
+
+	var count int
+	err := pg.db.Get(&count, "select count(id) from instances where "+f.where(), f.args...)
 
 	return &CountResponse{count}, err
 }
@@ -175,23 +371,69 @@ func (pg *Postgres) GetGroup(request *GroupRequest) (*GroupResponse, error) {
 		return nil, ErrMissingGroupId
 	}
 
-	group := new(Group)
-	err := pg.db.Get(group, "select * from groups where customer_id = $1 and name = $2", request.CustomerId, request.GroupId)
+	if request.Type == "" {
+		return nil, ErrMissingType
+	}
+
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	f.add("type = $%d", request.Type)
+	f.add("name = $%d", request.GroupId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+
+	groups := make([]*Group, 0)
+	err := pg.db.Select(&groups, "select * from groups where "+f.where(), f.args...)
 	if err != nil {
 		return nil, err
 	}
 
-	instances, err := pg.listInstances(&InstancesRequest{CustomerId: request.CustomerId, GroupId: request.GroupId, Type: request.Type})
+	if len(groups) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if len(groups) > 1 {
+		return nil, ErrAmbiguousAccount
+	}
+
+	group := groups[0]
+
+	instances, err := pg.listInstances(&InstancesRequest{CustomerId: request.CustomerId, AccountId: group.AccountId, GroupId: group.Name, GroupType: group.Type, IncludeDeleted: request.IncludeDeleted})
 	if err != nil {
 		return nil, err
 	}
 
 	iresponses := make([]*InstanceResponse, len(instances))
 	for i, inst := range instances {
-		iresponses[i] = &InstanceResponse{inst}
+		iresponses[i] = newInstanceResponse(inst)
+	}
+
+	subnets, err := pg.ListSubnets(&NetworkRequest{CustomerId: request.CustomerId, AccountId: group.AccountId, GroupId: group.Name, GroupType: group.Type, IncludeDeleted: request.IncludeDeleted})
+	if err != nil {
+		return nil, err
 	}
 
-	return &GroupResponse{group, iresponses, len(instances)}, err
+	capacity, err := groupCapacity(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupResponse{
+		Id:            group.Name,
+		Group:         group,
+		AccountId:     group.AccountId,
+		Type:          group.Type,
+		ChangedAt:     group.ChangedAt,
+		LastSeenAt:    group.LastSeenAt,
+		DeletedAt:     group.DeletedAt,
+		Instances:     iresponses,
+		InstanceCount: len(instances),
+		Subnets:       subnets.Subnets,
+		Capacity:      capacity,
+	}, err
 }
 
 func (pg *Postgres) ListGroups(request *GroupsRequest) (*GroupsResponse, error) {
@@ -199,24 +441,42 @@ func (pg *Postgres) ListGroups(request *GroupsRequest) (*GroupsResponse, error)
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	groups := make([]*Group, 0)
-
-	if request.Type == "" {
-		err = pg.db.Select(&groups, "select groups.*, count(distinct(groups_instances.instance_id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.customer_id = groups.customer_id where groups.customer_id = $1 group by groups.name, groups.customer_id", request.CustomerId)
-	} else {
-		err = pg.db.Select(&groups, "select groups.*, count(distinct(groups_instances.instance_id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.customer_id = groups.customer_id where groups.customer_id = $1 and groups.type = $2 group by groups.name, groups.customer_id", request.CustomerId, request.Type)
+	f := &filter{}
+	f.add("groups.customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("groups.account_id = $%d", request.AccountId)
+	}
+	if request.Type != "" {
+		f.add("groups.type = $%d", request.Type)
 	}
+	if !request.IncludeDeleted {
+		f.add("groups.deleted_at is null")
+	}
+	addSinceFilters(f, "groups.", request.ChangedSince, request.SeenSince)
 
+	groups := make([]*Group, 0)
+	err := pg.db.Select(&groups, "select groups.*, count(distinct(instances.id)) as instance_count from groups left outer join groups_instances on groups_instances.group_name = groups.name and groups_instances.group_type = groups.type and groups_instances.customer_id = groups.customer_id and groups_instances.account_id = groups.account_id left outer join instances on instances.id = groups_instances.instance_id and instances.type = groups_instances.instance_type and instances.customer_id = groups_instances.customer_id and instances.account_id = groups_instances.account_id and instances.deleted_at is null where "+f.where()+" group by groups.name, groups.type, groups.customer_id, groups.account_id", f.args...)
 	if err != nil {
 		return nil, err
 	}
 
 	grouprs := make([]*GroupResponse, len(groups))
 	for i, g := range groups {
+		capacity, err := groupCapacity(g)
+		if err != nil {
+			return nil, err
+		}
+
 		grouprs[i] = &GroupResponse{
+			Id:            g.Name,
 			Group:         g,
+			AccountId:     g.AccountId,
+			Type:          g.Type,
+			ChangedAt:     g.ChangedAt,
+			LastSeenAt:    g.LastSeenAt,
+			DeletedAt:     g.DeletedAt,
 			InstanceCount: g.InstanceCount,
+			Capacity:      capacity,
 		}
 	}
 
@@ -228,16 +488,87 @@ func (pg *Postgres) CountGroups(request *GroupsRequest) (*CountResponse, error)
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if request.Type != "" {
+		f.add("type = $%d", request.Type)
+	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+	addSinceFilters(f, "", request.ChangedSince, request.SeenSince)
+
 	var count int
+	err := pg.db.Get(&count, "select count(name) from groups where "+f.where(), f.args...)
 
-	if request.Type == "" {
-		err = pg.db.Get(&count, "select count(name) from groups where customer_id = $1", request.CustomerId)
-	} else {
-		err = pg.db.Get(&count, "select count(name) from groups where customer_id = $1 and type = $2", request.CustomerId, request.Type)
+	return &CountResponse{count}, err
+}
+
+// ListGroupLinks lists the links between the groups the request matches and
+// their instances, leaving out deleted instances along with deleted groups.
+func (pg *Postgres) ListGroupLinks(request *GroupsRequest) (*GroupLinksResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
 	}
 
-	return &CountResponse{count}, err
+	f := &filter{}
+	f.add("groups.customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("groups.account_id = $%d", request.AccountId)
+	}
+	if request.Type != "" {
+		f.add("groups.type = $%d", request.Type)
+	}
+	if !request.IncludeDeleted {
+		f.add("groups.deleted_at is null")
+		f.add("instances.deleted_at is null")
+	}
+	addSinceFilters(f, "groups.", request.ChangedSince, request.SeenSince)
+
+	links := make([]*GroupLink, 0)
+	err := pg.db.Select(&links, "select groups_instances.account_id, groups_instances.group_type, groups_instances.group_name, groups_instances.instance_type, groups_instances.instance_id from groups_instances join groups on groups.name = groups_instances.group_name and groups.type = groups_instances.group_type and groups.customer_id = groups_instances.customer_id and groups.account_id = groups_instances.account_id join instances on instances.id = groups_instances.instance_id and instances.type = groups_instances.instance_type and instances.customer_id = groups_instances.customer_id and instances.account_id = groups_instances.account_id where "+f.where(), f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupLinksResponse{links}, nil
+}
+
+func (pg *Postgres) ListSubnets(request *NetworkRequest) (*SubnetsResponse, error) {
+	f, err := networkFilter(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.GroupId != "" && request.GroupType != "" {
+		f.add("id in (select subnet_id from groups_subnets where customer_id = subnets.customer_id and account_id = subnets.account_id and group_name = $%d and group_type = $%d)", request.GroupId, request.GroupType)
+	}
+
+	subnets := make([]*Subnet, 0)
+	err = pg.db.Select(&subnets, "select * from subnets where "+f.where(), f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubnetsResponse{subnets}, nil
+}
+
+func (pg *Postgres) ListRouteTables(request *NetworkRequest) (*RouteTablesResponse, error) {
+	f, err := networkFilter(request)
+	if err != nil {
+		return nil, err
+	}
+
+	routeTables := make([]*RouteTable, 0)
+	err = pg.db.Select(&routeTables, "select * from route_tables where "+f.where(), f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RouteTablesResponse{routeTables}, nil
 }
 
 func (pg *Postgres) DeleteGroups() error {
@@ -256,40 +587,363 @@ func (pg *Postgres) GetCustomer(request *CustomerRequest) (*CustomerResponse, er
 	return &CustomerResponse{customer}, err
 }
 
-func (pg *Postgres) listInstances(request *InstancesRequest) ([]*Instance, error) {
+func (pg *Postgres) ListAccounts(request *AccountsRequest) (*AccountsResponse, error) {
 	if request.CustomerId == "" {
 		return nil, ErrMissingCustomerId
 	}
 
-	var err error
-	instances := make([]*Instance, 0)
+	accounts := make([]*Account, 0)
+	err := pg.db.Select(&accounts, "select * from accounts where customer_id = $1 order by id", request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountsResponse{accounts}, nil
+}
+
+// PreviewExpiry lists the entities the next sweep would expire for a
+// customer, without deleting anything.
+func (pg *Postgres) PreviewExpiry(request *ExpiryRequest) (*ExpiryPreviewResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
 
-	if request.GroupId != "" {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1 and id in (select instance_id from groups_instances where customer_id = $1 and group_name = $2)", request.CustomerId, request.GroupId)
-	} else if request.Type == "" {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1", request.CustomerId)
+	overrides, err := pg.ttlOverrides(pg.db, request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]*Account, 0)
+	err = pg.db.Select(&accounts, "select * from accounts where customer_id = $1 and last_sync is not null", request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := make([]*ExpiredEntity, 0)
+	for _, account := range accounts {
+		for _, entityType := range ExpirableTypes {
+			cutoff := account.LastSync.Add(-1 * pg.expiry.TTL(entityType, overrides))
+			t, f := expiryFilter(entityType, account.CustomerId, account.Id, cutoff)
+
+			expired := make([]*ExpiredEntity, 0)
+			err = pg.db.Select(&expired, "select account_id, "+t.idColumn+" as id, last_seen_at from "+t.table+" where "+f.where(), f.args...)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range expired {
+				e.Type = entityType
+			}
+
+			entities = append(entities, expired...)
+		}
+	}
+
+	return &ExpiryPreviewResponse{pg.ttlSeconds(overrides), entities}, nil
+}
+
+// PutExpiryTTLs sets or removes a customer's per-type TTL overrides.
+func (pg *Postgres) PutExpiryTTLs(request *ExpiryTTLsRequest) (*ExpiryTTLsResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	for entityType, ttl := range request.TTLs {
+		if !isExpirableType(entityType) {
+			return nil, ErrInvalidType
+		}
+
+		if ttl < 0 {
+			return nil, ErrInvalidTTL
+		}
+	}
+
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for entityType, ttl := range request.TTLs {
+		if ttl == 0 {
+			_, err = tx.Exec("delete from expiry_ttls where customer_id = $1 and entity_type = $2", request.CustomerId, entityType)
+		} else {
+			_, err = tx.Exec("with update_ttls as (update expiry_ttls set ttl_seconds = $3 where customer_id = $1 and entity_type = $2 returning entity_type), insert_ttls as (insert into expiry_ttls (customer_id, entity_type, ttl_seconds) select $1 as customer_id, ($2::varchar(32)) as entity_type, ($3::integer) as ttl_seconds where not exists (select entity_type from update_ttls limit 1) returning entity_type) select * from update_ttls union all select * from insert_ttls;", request.CustomerId, entityType, ttl)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	overrides, err := pg.ttlOverrides(tx, request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExpiryTTLsResponse{pg.ttlSeconds(overrides)}, tx.Commit()
+}
+
+// PutDeadLetter captures an event that couldn't be stored, or when the letter
+// has an id records another failed attempt at it.
+func (pg *Postgres) PutDeadLetter(letter *DeadLetter) (*DeadLetter, error) {
+	if letter.Body == "" {
+		return nil, ErrMissingBody
+	}
+
+	var err error
+	if letter.Id == 0 {
+		err = pg.db.QueryRowx("insert into dead_letters (customer_id, account_id, type, source, body, error, attempts) values ($1, $2, $3, $4, $5, $6, $7) returning *", letter.CustomerId, letter.AccountId, letter.Type, letter.Source, letter.Body, letter.Error, letter.Attempts).StructScan(letter)
 	} else {
-		err = pg.db.Select(&instances, "select * from instances where customer_id = $1 and type = $2", request.CustomerId, request.Type)
+		err = pg.db.QueryRowx("update dead_letters set (error, attempts) = ($2, $3) where id = $1 returning *", letter.Id, letter.Error, letter.Attempts).StructScan(letter)
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	return letter, err
+}
+
+func (pg *Postgres) GetDeadLetter(request *DeadLetterRequest) (*DeadLetter, error) {
+	if request.Id == 0 {
+		return nil, ErrMissingDeadLetterId
+	}
+
+	letter := &DeadLetter{}
+	err := pg.db.Get(letter, "select * from dead_letters where id = $1", request.Id)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	return letter, err
+}
+
+// ListDeadLetters lists the newest dead letters first, 100 at a time unless
+// the request sets a limit.
+func (pg *Postgres) ListDeadLetters(request *DeadLettersRequest) (*DeadLettersResponse, error) {
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	f := deadLetterFilter(request)
+	args := append(f.args, limit)
+
+	letters := make([]*DeadLetter, 0)
+	err := pg.db.Select(&letters, fmt.Sprintf("select * from dead_letters where %s order by id desc limit $%d", f.where(), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLettersResponse{letters}, nil
+}
+
+func (pg *Postgres) DeleteDeadLetter(request *DeadLetterRequest) error {
+	if request.Id == 0 {
+		return ErrMissingDeadLetterId
+	}
+
+	result, err := pg.db.Exec("delete from dead_letters where id = $1", request.Id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrDeadLetterNotFound
+	}
+
+	return nil
+}
+
+// PurgeDeadLetters deletes every dead letter matching the request.
+func (pg *Postgres) PurgeDeadLetters(request *DeadLettersRequest) (*CountResponse, error) {
+	f := deadLetterFilter(request)
+
+	result, err := pg.db.Exec(fmt.Sprintf("delete from dead_letters where %s", f.where()), f.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := result.RowsAffected()
+	return &CountResponse{int(n)}, err
+}
+
+// PutSuggestionDismissal dismisses a suggestion, or returns the existing
+// dismissal when it was already dismissed.
+func (pg *Postgres) PutSuggestionDismissal(dismissal *SuggestionDismissal) (*SuggestionDismissal, error) {
+	if dismissal.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	if dismissal.AccountId == "" || dismissal.TargetType == "" || dismissal.TargetId == "" {
+		return nil, ErrMissingTarget
+	}
+
+	if dismissal.Port < 1 || dismissal.Port > 65535 {
+		return nil, ErrInvalidPort
+	}
+
+	args := []interface{}{dismissal.CustomerId, dismissal.AccountId, dismissal.TargetType, dismissal.TargetId, dismissal.Protocol, dismissal.Port, dismissal.Path}
+	_, err := pg.db.Exec("insert into suggestion_dismissals (customer_id, account_id, target_type, target_id, protocol, port, path) select $1, $2, $3, $4, $5, $6, $7 where not exists (select 1 from suggestion_dismissals where customer_id = $1 and account_id = $2 and target_type = $3 and target_id = $4 and protocol = $5 and port = $6 and path = $7)", args...)
+	// a concurrent dismissal of the same suggestion inserted it first.
+	if err != nil && !isUniqueViolation(err) {
+		return nil, err
+	}
+
+	err = pg.db.Get(dismissal, "select * from suggestion_dismissals where customer_id = $1 and account_id = $2 and target_type = $3 and target_id = $4 and protocol = $5 and port = $6 and path = $7", args...)
+	return dismissal, err
+}
+
+func (pg *Postgres) ListSuggestionDismissals(request *SuggestionDismissalsRequest) (*SuggestionDismissalsResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	dismissals := make([]*SuggestionDismissal, 0)
+	err := pg.db.Select(&dismissals, "select * from suggestion_dismissals where customer_id = $1 order by id", request.CustomerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SuggestionDismissalsResponse{dismissals}, nil
+}
+
+func (pg *Postgres) DeleteSuggestionDismissal(request *SuggestionDismissalRequest) error {
+	if request.CustomerId == "" {
+		return ErrMissingCustomerId
+	}
+
+	result, err := pg.db.Exec("delete from suggestion_dismissals where customer_id = $1 and id = $2", request.CustomerId, request.Id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrDismissalNotFound
+	}
+
+	return nil
+}
+
+// ListScalingEvents lists an autoscaling group's events, newest first, 100 at
+// a time unless the request sets a limit.
+func (pg *Postgres) ListScalingEvents(request *ScalingEventsRequest) (*ScalingEventsResponse, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	if request.GroupName == "" {
+		return nil, ErrMissingGroupId
+	}
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	f.add("group_name = $%d", request.GroupName)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if request.Since != nil {
+		f.add("observed_at >= $%d", *request.Since)
+	}
+	args := append(f.args, limit)
+
+	events := make([]*ScalingEvent, 0)
+	err := pg.db.Select(&events, fmt.Sprintf("select * from scaling_events where %s order by observed_at desc, id desc limit $%d", f.where(), len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScalingEventsResponse{events}, nil
+}
+
+// ClaimQueuedEvents takes up to limit of the oldest available events from
+// the event queue, counting an attempt at each. They're hidden from other
+// claims for the lease, after which they're delivered again unless they've
+// been finished or requeued.
+func (pg *Postgres) ClaimQueuedEvents(limit int, lease time.Duration) ([]*QueuedEvent, error) {
+	events := make([]*QueuedEvent, 0)
+	err := pg.db.Select(&events, "update event_queue set (attempts, available_at) = (attempts + 1, now() + $2 * interval '1 second') where id in (select id from event_queue where available_at <= now() order by id limit $1 for update) returning *", limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// FinishQueuedEvent removes a handled event from the event queue.
+func (pg *Postgres) FinishQueuedEvent(id int64) error {
+	_, err := pg.db.Exec("delete from event_queue where id = $1", id)
+	return err
+}
+
+// RequeueQueuedEvent makes a claimed event available again after delay.
+func (pg *Postgres) RequeueQueuedEvent(id int64, delay time.Duration) error {
+	_, err := pg.db.Exec("update event_queue set available_at = now() + $2 * interval '1 second' where id = $1", id, delay.Seconds())
+	return err
+}
+
+func (pg *Postgres) listInstances(request *InstancesRequest) ([]*Instance, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+
+	if request.Type != "" {
+		f.add("type = $%d", request.Type)
+	}
+	if request.EndpointAddress != "" {
+		f.add("lower(endpoint_address) = lower($%d)", request.EndpointAddress)
+	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+	addSinceFilters(f, "", request.ChangedSince, request.SeenSince)
+
+	if request.GroupId != "" && request.GroupType != "" {
+		f.add("(type, id) in (select instance_type, instance_id from groups_instances where customer_id = instances.customer_id and account_id = instances.account_id and group_name = $%d and group_type = $%d)", request.GroupId, request.GroupType)
+	} else if request.GroupId != "" {
+		f.add("(type, id) in (select instance_type, instance_id from groups_instances where customer_id = instances.customer_id and account_id = instances.account_id and group_name = $%d)", request.GroupId)
 	}
 
+	instances := make([]*Instance, 0)
+	err := pg.db.Select(&instances, "select * from instances where "+f.where(), f.args...)
+
 	return instances, err
 }
 
 func (pg *Postgres) putInstance(instance *Instance) error {
-	query := "with update_instances as (update instances set (type, data) = (:type, :data) where id = :id and customer_id = :customer_id returning id), insert_instances as (insert into instances (id, customer_id, type, data) select :id as id, :customer_id as customer_id, :type as type, :data as data where not exists (select id from update_instances limit 1) returning id) select * from update_instances union all select * from insert_instances;"
-	_, err := pg.db.NamedExec(query, instance)
-	if err != nil {
+	instance.ContentHash = contentHash(instance.Data)
+	query := "with seen_instances as (update instances set (last_seen_at, deleted_at, source_timestamp) = (now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp)) where id = :id and type = :type and customer_id = :customer_id and account_id = :account_id and " + notStale + " and " + unchanged + " returning id), update_instances as (update instances set (data, content_hash, changed_at, last_seen_at, deleted_at, source_timestamp, endpoint_address, endpoint_port) = (:data, :content_hash, now(), now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp), :endpoint_address, :endpoint_port) where id = :id and type = :type and customer_id = :customer_id and account_id = :account_id and " + notStale + " and " + changed + " returning id), insert_instances as (insert into instances (id, customer_id, account_id, type, data, content_hash, source_timestamp, endpoint_address, endpoint_port) select :id as id, :customer_id as customer_id, :account_id as account_id, :type as type, :data as data, :content_hash as content_hash, cast(:source_timestamp as timestamptz) as source_timestamp, cast(:endpoint_address as varchar(255)) as endpoint_address, cast(:endpoint_port as integer) as endpoint_port where not exists (select id from instances where id = :id and type = :type and customer_id = :customer_id and account_id = :account_id) returning id) " + countWritten("seen_instances", "update_instances", "insert_instances")
+	if err := upsert(pg.db, query, instance); err != nil {
 		return err
 	}
 
 	// i don't really want to use transactions for this right now until a refactor
 	for _, group := range instance.Groups {
-		err := pg.ensureGroup(group)
-		if err != nil {
+		var err error
+		if group.Type == DBSubnetGroupStoreType {
+			// rds subnet groups are only described within their instances,
+			// so they're written in full rather than as stubs.
+			err = pg.putGroup(group)
+		} else {
+			err = pg.ensureGroup(group)
+		}
+		if err != nil && err != ErrStaleEntity {
 			return err
 		}
 
-		_, err = pg.db.Exec("insert into groups_instances (customer_id, group_name, instance_id) select $1 as customer_id, ($2::varchar(128)) as group_name, ($3::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and group_name = $2 and instance_id = $3)", group.CustomerId, group.Name, instance.Id)
+		err = pg.linkGroupInstance(group, instance)
 		if err != nil {
 			return err
 		}
@@ -299,11 +953,30 @@ func (pg *Postgres) putInstance(instance *Instance) error {
 }
 
 func (pg *Postgres) putGroup(group *Group) error {
-	query := "with update_groups as (update groups set (type, data) = (:type, :data) where name = :name and customer_id = :customer_id returning name), insert_groups as (insert into groups (name, customer_id, type, data) select :name as name, :customer_id as customer_id, :type as type, :data as data where not exists (select name from update_groups limit 1) returning name) select * from update_groups union all select * from insert_groups;"
-	_, err := pg.db.NamedExec(query, group)
+	group.ContentHash = contentHash(group.Data)
+
+	// scaling events are recorded in the upsert's transaction, so that a
+	// stale write rolls them back with it.
+	tx, err := pg.db.Beginx()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if group.Type == AutoScalingGroupStoreType {
+		if err := recordScalingEvents(tx, group); err != nil {
+			return err
+		}
+	}
+
+	query := "with seen_groups as (update groups set (last_seen_at, deleted_at, source_timestamp) = (now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp)) where name = :name and type = :type and customer_id = :customer_id and account_id = :account_id and " + notStale + " and " + unchanged + " returning name), update_groups as (update groups set (data, content_hash, changed_at, last_seen_at, deleted_at, source_timestamp) = (:data, :content_hash, now(), now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp)) where name = :name and type = :type and customer_id = :customer_id and account_id = :account_id and " + notStale + " and " + changed + " returning name), insert_groups as (insert into groups (name, customer_id, account_id, type, data, content_hash, source_timestamp) select :name as name, :customer_id as customer_id, :account_id as account_id, :type as type, :data as data, :content_hash as content_hash, cast(:source_timestamp as timestamptz) as source_timestamp where not exists (select name from groups where name = :name and type = :type and customer_id = :customer_id and account_id = :account_id) returning name) " + countWritten("seen_groups", "update_groups", "insert_groups")
+	if err := upsert(tx, query, group); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
 	// i don't really want to use transactions for this right now until a refactor
 	for _, instance := range group.Instances {
@@ -312,7 +985,14 @@ func (pg *Postgres) putGroup(group *Group) error {
 			return err
 		}
 
-		_, err = pg.db.Exec("insert into groups_instances (customer_id, group_name, instance_id) select $1 as customer_id, ($2::varchar(128)) as group_name, ($3::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and group_name = $2 and instance_id = $3)", group.CustomerId, group.Name, instance.Id)
+		err = pg.linkGroupInstance(group, instance)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, subnetId := range group.Subnets {
+		err := pg.linkGroupSubnet(group, subnetId)
 		if err != nil {
 			return err
 		}
@@ -321,55 +1001,286 @@ func (pg *Postgres) putGroup(group *Group) error {
 	return nil
 }
 
-func (pg *Postgres) putCustomer(customer *Customer) error {
+func putCustomer(q sqlx.Ext, customer *Customer) error {
 	query := "with update_customers as (update customers set last_sync = :last_sync where id = :id returning id), insert_customers as (insert into customers (id, last_sync) select :id as id, :last_sync as last_sync where not exists (select id from update_customers limit 1) returning id) select * from update_customers union all select * from insert_customers;"
-	_, err := pg.db.NamedExec(query, customer)
+	_, err := sqlx.NamedExec(q, query, customer)
 	return err
 }
 
-func (pg *Postgres) putRouteTable(routeTable *RouteTable) error {
-	query := `with update_route_tables as
-		  (update route_tables set data = :data where customer_id = :customer_id and id = :id returning id),
-		  insert_route_tables as (insert into route_tables (id, customer_id, data) select :id as id,
-		  :customer_id as customer_id, :data as data where not exists (select id from update_route_tables limit 1) returning id)
-		  select * from update_route_tables union all select * from insert_route_tables;
-		  `
-	_, err := pg.db.NamedExec(query, routeTable)
+func putAccount(q sqlx.Ext, account *Account) error {
+	query := "with update_accounts as (update accounts set last_sync = :last_sync where customer_id = :customer_id and id = :id returning id), insert_accounts as (insert into accounts (id, customer_id, last_sync) select :id as id, :customer_id as customer_id, :last_sync as last_sync where not exists (select id from update_accounts limit 1) returning id) select * from update_accounts union all select * from insert_accounts;"
+	_, err := sqlx.NamedExec(q, query, account)
 	return err
 }
 
-func (pg *Postgres) putSubnet(subnet *Subnet) error {
-	query := `with update_subnets as
-		  (update subnets set data = :data where customer_id = :customer_id and id = :id returning id),
-		  insert_subnets as (insert into subnets (id, customer_id, data) select :id as id,
-		  :customer_id as customer_id, :data as data where not exists (select id from update_subnets limit 1) returning id)
-		  select * from update_subnets union all select * from insert_subnets;
-		  `
-	_, err := pg.db.NamedExec(query, subnet)
-	return err
+func (pg *Postgres) putRouteTable(routeTable *RouteTable) error {
+	routeTable.ContentHash = contentHash(routeTable.Data)
+	query := `with seen_route_tables as
+		  (update route_tables set (last_seen_at, deleted_at, source_timestamp) = (now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp))
+		  where customer_id = :customer_id and account_id = :account_id and id = :id and ` + notStale + ` and ` + unchanged + ` returning id),
+		  update_route_tables as
+		  (update route_tables set (data, content_hash, changed_at, last_seen_at, deleted_at, source_timestamp) = (:data, :content_hash, now(), now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp))
+		  where customer_id = :customer_id and account_id = :account_id and id = :id and ` + notStale + ` and ` + changed + ` returning id),
+		  insert_route_tables as (insert into route_tables (id, customer_id, account_id, data, content_hash, source_timestamp) select :id as id,
+		  :customer_id as customer_id, :account_id as account_id, :data as data, :content_hash as content_hash, cast(:source_timestamp as timestamptz) as source_timestamp
+		  where not exists (select id from route_tables where customer_id = :customer_id and account_id = :account_id and id = :id) returning id)
+		  ` + countWritten("seen_route_tables", "update_route_tables", "insert_route_tables")
+	return upsert(pg.db, query, routeTable)
 }
 
-func (pg *Postgres) expireEntities(customerId string, lastSync int64) error {
-	lastSyncTime := time.Unix(lastSync, 0).Add(time.Duration(-1*pg.expireThreshold) * time.Second)
+func (pg *Postgres) putSubnet(subnet *Subnet) error {
+	subnet.ContentHash = contentHash(subnet.Data)
+	query := `with seen_subnets as
+		  (update subnets set (last_seen_at, deleted_at, source_timestamp) = (now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp))
+		  where customer_id = :customer_id and account_id = :account_id and id = :id and ` + notStale + ` and ` + unchanged + ` returning id),
+		  update_subnets as
+		  (update subnets set (data, content_hash, changed_at, last_seen_at, deleted_at, source_timestamp) = (:data, :content_hash, now(), now(), null, coalesce(cast(:source_timestamp as timestamptz), source_timestamp))
+		  where customer_id = :customer_id and account_id = :account_id and id = :id and ` + notStale + ` and ` + changed + ` returning id),
+		  insert_subnets as (insert into subnets (id, customer_id, account_id, data, content_hash, source_timestamp) select :id as id,
+		  :customer_id as customer_id, :account_id as account_id, :data as data, :content_hash as content_hash, cast(:source_timestamp as timestamptz) as source_timestamp
+		  where not exists (select id from subnets where customer_id = :customer_id and account_id = :account_id and id = :id) returning id)
+		  ` + countWritten("seen_subnets", "update_subnets", "insert_subnets")
+	return upsert(pg.db, query, subnet)
+}
 
-	groupExpireQuery := "delete from groups where customer_id = $1 and updated_at < $2"
-	_, err := pg.db.Exec(groupExpireQuery, customerId, lastSyncTime)
+// upsert runs an entity upsert built with notStale and countWritten. An
+// upsert that writes nothing found a version of the entity observed after
+// this one, so it's dropped and counted rather than written.
+func upsert(q sqlx.Ext, query string, entity interface{}) error {
+	rows, err := sqlx.NamedQuery(q, query, entity)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	instanceExpireQuery := "delete from instances where customer_id = $1 and updated_at < $2"
-	_, err = pg.db.Exec(instanceExpireQuery, customerId, lastSyncTime)
+	written := 0
+	if rows.Next() {
+		if err := rows.Scan(&written); err != nil {
+			return err
+		}
+	}
 
-	return err
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if written == 0 {
+		staleWrites.Add(1)
+		return ErrStaleEntity
+	}
+
+	return nil
+}
+
+// expireEntities tombstones a customer account's entities that haven't been
+// seen within their type's TTL of lastSync. Only one fieri replica
+// expires an account at a time, and only once per sweep: the run holds a
+// transaction-level advisory lock for the account and records its time in
+// the expirations table. Runs within half an interval of the last one are
+// skipped, leaving slack for sweeps that start late. It reports whether this
+// call did the work.
+func (pg *Postgres) expireEntities(customerId, accountId string, lastSync time.Time) (bool, error) {
+	tx, err := pg.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.Get(&locked, "select pg_try_advisory_xact_lock($1, hashtext($2::text || '/' || $3::text))", expiryLockClass, customerId, accountId)
+	if err != nil || !locked {
+		return false, err
+	}
+
+	var recent bool
+	err = tx.Get(&recent, "select exists (select 1 from expirations where customer_id = $1 and account_id = $2 and expired_at > now() - $3 * interval '1 second')", customerId, accountId, pg.expiry.Interval.Seconds()/2)
+	if err != nil || recent {
+		return false, err
+	}
+
+	overrides, err := pg.ttlOverrides(tx, customerId)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entityType := range ExpirableTypes {
+		cutoff := lastSync.Add(-1 * pg.expiry.TTL(entityType, overrides))
+		t, f := expiryFilter(entityType, customerId, accountId, cutoff)
+
+		_, err = tx.Exec("update "+t.table+" set deleted_at = now() where "+f.where(), f.args...)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec("with update_expirations as (update expirations set expired_at = now() where customer_id = $1 and account_id = $2 returning customer_id), insert_expirations as (insert into expirations (customer_id, account_id, expired_at) select $1 as customer_id, ($2::varchar(64)) as account_id, now() as expired_at where not exists (select customer_id from update_expirations limit 1) returning customer_id) select * from update_expirations union all select * from insert_expirations;", customerId, accountId)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (pg *Postgres) ttlOverrides(q sqlx.Queryer, customerId string) (map[string]time.Duration, error) {
+	rows := make([]*ttlOverride, 0)
+	err := sqlx.Select(q, &rows, "select entity_type, ttl_seconds from expiry_ttls where customer_id = $1", customerId)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]time.Duration, len(rows))
+	for _, row := range rows {
+		overrides[row.EntityType] = time.Duration(row.TTLSeconds) * time.Second
+	}
+
+	return overrides, nil
+}
+
+func (pg *Postgres) ttlSeconds(overrides map[string]time.Duration) map[string]int64 {
+	ttls := make(map[string]int64, len(ExpirableTypes))
+	for _, entityType := range ExpirableTypes {
+		ttls[entityType] = int64(pg.expiry.TTL(entityType, overrides).Seconds())
+	}
+
+	return ttls
+}
+
+func expiryFilter(entityType, customerId, accountId string, cutoff time.Time) (expiryTable, *filter) {
+	t := expiryTables[entityType]
+
+	f := &filter{}
+	f.add("customer_id = $%d", customerId)
+	f.add("account_id = $%d", accountId)
+	f.add("last_seen_at < $%d", cutoff)
+	f.add("deleted_at is null")
+	if t.typed {
+		f.add("type = $%d", entityType)
+	}
+
+	return t, f
 }
 
 func (pg *Postgres) ensureInstance(instance *Instance) error {
-	_, err := pg.db.Exec("insert into instances (id, customer_id, type, data) select ($1::varchar(128)) as id, $2 as customer_id, $3 as type, $4 as data where not exists (select id from instances where id = $1 and customer_id = $2)", instance.Id, instance.CustomerId, instance.Type, instance.Data)
+	_, err := pg.db.Exec("insert into instances (id, customer_id, account_id, type, data) select ($1::varchar(128)) as id, $2 as customer_id, ($3::varchar(64)) as account_id, ($4::instance_type) as type, $5 as data where not exists (select id from instances where id = $1 and customer_id = $2 and account_id = $3 and type = $4)", instance.Id, instance.CustomerId, instance.AccountId, instance.Type, instance.Data)
 	return err
 }
 
 func (pg *Postgres) ensureGroup(group *Group) error {
-	_, err := pg.db.Exec("insert into groups (name, customer_id, type, data) select ($1::varchar(128)) as name, $2 as customer_id, $3 as type, $4 as data where not exists (select name from groups where name = $1 and customer_id = $2)", group.Name, group.CustomerId, group.Type, group.Data)
+	_, err := pg.db.Exec("insert into groups (name, customer_id, account_id, type, data) select ($1::varchar(128)) as name, $2 as customer_id, ($3::varchar(64)) as account_id, ($4::group_type) as type, $5 as data where not exists (select name from groups where name = $1 and customer_id = $2 and account_id = $3 and type = $4)", group.Name, group.CustomerId, group.AccountId, group.Type, group.Data)
+	return err
+}
+
+func (pg *Postgres) linkGroupInstance(group *Group, instance *Instance) error {
+	_, err := pg.db.Exec("insert into groups_instances (customer_id, account_id, group_type, group_name, instance_type, instance_id) select $1 as customer_id, ($2::varchar(64)) as account_id, ($3::group_type) as group_type, ($4::varchar(128)) as group_name, ($5::instance_type) as instance_type, ($6::varchar(128)) as instance_id where not exists (select instance_id from groups_instances where customer_id = $1 and account_id = $2 and group_type = $3 and group_name = $4 and instance_type = $5 and instance_id = $6)", group.CustomerId, group.AccountId, group.Type, group.Name, instance.Type, instance.Id)
+	return err
+}
+
+func (pg *Postgres) linkGroupSubnet(group *Group, subnetId string) error {
+	_, err := pg.db.Exec("insert into groups_subnets (customer_id, account_id, group_type, group_name, subnet_id) select $1 as customer_id, ($2::varchar(64)) as account_id, ($3::group_type) as group_type, ($4::varchar(128)) as group_name, ($5::varchar(128)) as subnet_id where not exists (select subnet_id from groups_subnets where customer_id = $1 and account_id = $2 and group_type = $3 and group_name = $4 and subnet_id = $5)", group.CustomerId, group.AccountId, group.Type, group.Name, subnetId)
 	return err
 }
+
+// addSinceFilters limits f to entities whose content changed at or after
+// changedSince and that were last seen at or after seenSince, when set. prefix
+// qualifies the columns in joins.
+func addSinceFilters(f *filter, prefix string, changedSince, seenSince *time.Time) {
+	if changedSince != nil {
+		f.add(prefix+"changed_at >= $%d", *changedSince)
+	}
+
+	if seenSince != nil {
+		f.add(prefix+"last_seen_at >= $%d", *seenSince)
+	}
+}
+
+func networkFilter(request *NetworkRequest) (*filter, error) {
+	if request.CustomerId == "" {
+		return nil, ErrMissingCustomerId
+	}
+
+	f := &filter{}
+	f.add("customer_id = $%d", request.CustomerId)
+	if request.AccountId != "" {
+		f.add("account_id = $%d", request.AccountId)
+	}
+	if !request.IncludeDeleted {
+		f.add("deleted_at is null")
+	}
+
+	return f, nil
+}
+
+// deadLetterFilter matches every dead letter when the request sets no
+// filters.
+func deadLetterFilter(request *DeadLettersRequest) *filter {
+	f := &filter{}
+	f.add("true")
+	if request.CustomerId != "" {
+		f.add("customer_id = $%d", request.CustomerId)
+	}
+
+	if request.Type != "" {
+		f.add("type = $%d", request.Type)
+	}
+
+	if request.Before != nil {
+		f.add("created_at < $%d", *request.Before)
+	}
+
+	return f
+}
+
+func newInstanceResponse(instance *Instance) *InstanceResponse {
+	return &InstanceResponse{
+		Id:         instance.Id,
+		Instance:   instance,
+		AccountId:  instance.AccountId,
+		Type:       instance.Type,
+		ChangedAt:  instance.ChangedAt,
+		LastSeenAt: instance.LastSeenAt,
+		DeletedAt:  instance.DeletedAt,
+	}
+}
+
+// upsertError turns the unique violation hit by an upsert racing another
+// writer's insert into ErrWriteConflict.
+func upsertError(err error) error {
+	if isUniqueViolation(err) {
+		return ErrWriteConflict
+	}
+
+	return err
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// IsTransient reports whether err is a database failure worth retrying, such
+// as a lost connection, a deadlock or the server shutting down, rather than
+// one the same write would hit again.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == ErrWriteConflict || err == driver.ErrBadConn || err == sql.ErrConnDone || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		// connection exception, transaction rollback, insufficient resources,
+		// operator intervention and system error.
+		case "08", "40", "53", "57", "58":
+			return true
+		}
+	}
+
+	return false
+}
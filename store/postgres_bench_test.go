@@ -0,0 +1,40 @@
+package store
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkPutEntityConcurrent writes instances from parallel goroutines
+// while the expiry sweep runs, as the consumer does. Instances are reported
+// again and again, as bastions report them, so most writes find them
+// already stored.
+func BenchmarkPutEntityConcurrent(b *testing.B) {
+	pg := testPostgres(b, ExpiryConfig{Interval: 10 * time.Millisecond, DefaultTTL: time.Hour, Retention: time.Hour})
+	defer pg.Close()
+
+	go pg.Start()
+	defer pg.Stop()
+
+	customerId := testCustomerId(b)
+	var n int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := fmt.Sprintf("i-%08x", atomic.AddInt64(&n, 1)%1000)
+			instance, err := NewInstance(customerId, "933693344490", &opsee_aws_ec2.Instance{InstanceId: aws.String(id)})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := pg.PutEntity(instance); err != nil && err != ErrStaleEntity {
+				b.Fatal(err)
+			}
+		}
+	})
+}
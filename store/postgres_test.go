@@ -0,0 +1,254 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/lib/pq"
+	opsee_aws_ec2 "github.com/opsee/basic/schema/aws/ec2"
+	opsee_aws_elb "github.com/opsee/basic/schema/aws/elb"
+	"github.com/opsee/fieri/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPostgres connects to the database in POSTGRES_CONN, as set by testenv,
+// and migrates it. Tests needing a database are skipped without one.
+func testPostgres(tb testing.TB, expiry ExpiryConfig) *Postgres {
+	conn := os.Getenv("POSTGRES_CONN")
+	if conn == "" {
+		tb.Skip("POSTGRES_CONN isn't set")
+	}
+
+	db, err := NewPostgres(PostgresConfig{Connection: conn, MaxOpenConns: 10, MaxIdleConns: 10, Expiry: expiry})
+	require.NoError(tb, err)
+
+	pg := db.(*Postgres)
+	_, err = migrations.Up(pg.db.DB)
+	require.NoError(tb, err)
+
+	return pg
+}
+
+// testCustomerId returns a new customer id, so that tests sharing a database
+// don't see each other's entities.
+func testCustomerId(tb testing.TB) string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	require.NoError(tb, err)
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func TestExpireEntitiesAcrossReplicas(t *testing.T) {
+	expiry := ExpiryConfig{Interval: time.Hour, DefaultTTL: time.Hour, Retention: time.Hour}
+	replicas := []*Postgres{testPostgres(t, expiry), testPostgres(t, expiry)}
+	defer func() {
+		for _, pg := range replicas {
+			pg.Close()
+		}
+	}()
+
+	lastSync := time.Now()
+	customers := make([]string, 5)
+	for i := range customers {
+		customers[i] = testCustomerId(t)
+		require.NoError(t, putCustomer(replicas[0].db, &Customer{Id: customers[i], LastSync: lastSync}))
+		require.NoError(t, putAccount(replicas[0].db, &Account{Id: "933693344490", CustomerId: customers[i], LastSync: lastSync}))
+	}
+
+	var (
+		mu      sync.Mutex
+		expired = make(map[string]int)
+		wg      sync.WaitGroup
+	)
+
+	// every replica sweeps every customer a few times at once, as replicas
+	// started together would.
+	for _, pg := range replicas {
+		for _, customerId := range customers {
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(pg *Postgres, customerId string) {
+					defer wg.Done()
+
+					ok, err := pg.expireEntities(customerId, "933693344490", lastSync)
+					assert.NoError(t, err)
+
+					if ok {
+						mu.Lock()
+						expired[customerId]++
+						mu.Unlock()
+					}
+				}(pg, customerId)
+			}
+		}
+	}
+	wg.Wait()
+
+	for _, customerId := range customers {
+		assert.Equal(t, 1, expired[customerId], "expiries of customer %s", customerId)
+
+		var n int
+		require.NoError(t, replicas[0].db.Get(&n, "select count(*) from expirations where customer_id = $1", customerId))
+		assert.Equal(t, 1, n, "expirations of customer %s", customerId)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"write conflict", ErrWriteConflict, true},
+		{"racing upsert", upsertError(&pq.Error{Code: "23505"}), true},
+		{"unique violation elsewhere", &pq.Error{Code: "23505"}, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"syntax error", &pq.Error{Code: "42601"}, false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"stale", ErrStaleEntity, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.transient, IsTransient(test.err), test.name)
+	}
+}
+
+func TestPutSuggestionDismissalConcurrently(t *testing.T) {
+	pg := testPostgres(t, ExpiryConfig{})
+	defer pg.Close()
+
+	customerId := testCustomerId(t)
+	ids := make(chan int64, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			dismissal, err := pg.PutSuggestionDismissal(&SuggestionDismissal{CustomerId: customerId, AccountId: "933693344490", TargetType: ELBStoreType, TargetId: "web", Protocol: "http", Port: 80, Path: "/"})
+			if assert.NoError(t, err) {
+				ids <- dismissal.Id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	first := <-ids
+	for id := range ids {
+		assert.Equal(t, first, id)
+	}
+}
+
+func TestStaleWritesRecordTheSync(t *testing.T) {
+	pg := testPostgres(t, ExpiryConfig{})
+	defer pg.Close()
+
+	newer, older := time.Now(), time.Now().Add(-time.Hour)
+	put := map[string]func(entity interface{}) error{
+		"PutEntity": func(entity interface{}) error {
+			_, err := pg.PutEntity(entity)
+			return err
+		},
+		"PutEntities": func(entity interface{}) error {
+			_, err := pg.PutEntities([]interface{}{entity})
+			return err
+		},
+	}
+
+	for name, put := range put {
+		t.Run(name, func(t *testing.T) {
+			customerId := testCustomerId(t)
+			instance := func(observed time.Time) *Instance {
+				i, err := NewInstance(customerId, "933693344490", &opsee_aws_ec2.Instance{InstanceId: aws.String("i-39aae6fb")})
+				require.NoError(t, err)
+				SetSourceTimestamp(i, observed)
+				return i
+			}
+
+			require.NoError(t, put(instance(newer)))
+			before := accountSync(t, pg, customerId)
+
+			err := put(instance(older))
+			if err != ErrStaleEntity {
+				require.NoError(t, err)
+			}
+			assert.True(t, accountSync(t, pg, customerId).After(before), "last sync moved forward")
+		})
+	}
+}
+
+func TestGetAcrossAccounts(t *testing.T) {
+	pg := testPostgres(t, ExpiryConfig{})
+	defer pg.Close()
+
+	// web and i-39aae6fb are in both accounts, api and i-301674fb only in
+	// the second.
+	customerId := testCustomerId(t)
+	entities := []struct {
+		accountId, instanceId, loadBalancer string
+	}{
+		{"933693344490", "i-39aae6fb", "web"},
+		{"120589623411", "i-39aae6fb", "web"},
+		{"120589623411", "i-301674fb", "api"},
+	}
+	for _, e := range entities {
+		instance, err := NewInstance(customerId, e.accountId, &opsee_aws_ec2.Instance{InstanceId: aws.String(e.instanceId)})
+		require.NoError(t, err)
+		_, err = pg.PutEntity(instance)
+		require.NoError(t, err)
+
+		group, err := NewGroup(customerId, e.accountId, &opsee_aws_elb.LoadBalancerDescription{LoadBalancerName: aws.String(e.loadBalancer)})
+		require.NoError(t, err)
+		_, err = pg.PutEntity(group)
+		require.NoError(t, err)
+	}
+
+	_, err := pg.GetInstance(&InstanceRequest{CustomerId: customerId, Type: InstanceStoreType, InstanceId: "i-39aae6fb"})
+	assert.Equal(t, ErrAmbiguousAccount, err)
+
+	_, err = pg.GetGroup(&GroupRequest{CustomerId: customerId, Type: ELBStoreType, GroupId: "web"})
+	assert.Equal(t, ErrAmbiguousAccount, err)
+
+	instance, err := pg.GetInstance(&InstanceRequest{CustomerId: customerId, AccountId: "120589623411", Type: InstanceStoreType, InstanceId: "i-39aae6fb"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "120589623411", instance.AccountId)
+	}
+
+	group, err := pg.GetGroup(&GroupRequest{CustomerId: customerId, AccountId: "933693344490", Type: ELBStoreType, GroupId: "web"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "933693344490", group.AccountId)
+	}
+
+	instance, err = pg.GetInstance(&InstanceRequest{CustomerId: customerId, Type: InstanceStoreType, InstanceId: "i-301674fb"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "120589623411", instance.AccountId)
+	}
+
+	group, err = pg.GetGroup(&GroupRequest{CustomerId: customerId, Type: ELBStoreType, GroupId: "api"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "120589623411", group.AccountId)
+	}
+
+	_, err = pg.GetInstance(&InstanceRequest{CustomerId: customerId, AccountId: "933693344490", Type: InstanceStoreType, InstanceId: "i-301674fb"})
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func accountSync(t *testing.T, pg *Postgres, customerId string) time.Time {
+	response, err := pg.ListAccounts(&AccountsRequest{CustomerId: customerId})
+	require.NoError(t, err)
+	require.Len(t, response.Accounts, 1)
+	return response.Accounts[0].LastSync
+}
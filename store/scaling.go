@@ -0,0 +1,372 @@
+package store
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jmoiron/sqlx"
+	opsee_aws_autoscaling "github.com/opsee/basic/schema/aws/autoscaling"
+	"strings"
+	"time"
+)
+
+// Scaling event kinds. Instances that leave a group while its desired
+// capacity stays put are told apart by how they were last seen: unhealthy
+// ones were replaced, ones already terminating or detaching were removed by
+// the group, and the rest were lost.
+const (
+	ScaleOutEvent             = "scale-out"
+	ScaleInEvent              = "scale-in"
+	CapacityChangeEvent       = "capacity-change"
+	UnhealthyReplacementEvent = "unhealthy-replacement"
+	InstanceRemovedEvent      = "instance-removed"
+	InstanceLostEvent         = "instance-lost"
+	InstanceLaunchedEvent     = "instance-launched"
+	InstanceUnhealthyEvent    = "instance-unhealthy"
+	ProcessesSuspendedEvent   = "processes-suspended"
+	ProcessesResumedEvent     = "processes-resumed"
+)
+
+// How an event's instances changed.
+const (
+	launchedChange   = "launched"
+	terminatedChange = "terminated"
+	unhealthyChange  = "unhealthy"
+)
+
+// AutoScalingCapacity is an autoscaling group's capacity, the state of its
+// instances, and the names of its suspended processes.
+type AutoScalingCapacity struct {
+	DesiredCapacity    *int64           `json:"desired_capacity"`
+	MinSize            *int64           `json:"min_size"`
+	MaxSize            *int64           `json:"max_size"`
+	Instances          ScalingInstances `json:"instances"`
+	SuspendedProcesses ScalingProcesses `json:"suspended_processes"`
+}
+
+// ScalingInstance is an instance of an autoscaling group. Change is only set
+// on the instances of a scaling event.
+type ScalingInstance struct {
+	InstanceId       string `json:"instance_id"`
+	LifecycleState   string `json:"lifecycle_state,omitempty"`
+	HealthStatus     string `json:"health_status,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	Change           string `json:"change,omitempty"`
+}
+
+// ScalingInstances and ScalingProcesses are stored as jsonb.
+type ScalingInstances []*ScalingInstance
+type ScalingProcesses []string
+
+// ScalingEvent is a change to an autoscaling group seen between two of its
+// versions. The capacities are the group's before and after the change.
+type ScalingEvent struct {
+	Id              int64            `json:"id"`
+	CustomerId      string           `json:"customer_id" db:"customer_id"`
+	AccountId       string           `json:"account_id" db:"account_id"`
+	GroupName       string           `json:"group_name" db:"group_name"`
+	Kind            string           `json:"kind"`
+	PreviousDesired *int64           `json:"previous_desired" db:"previous_desired"`
+	Desired         *int64           `json:"desired"`
+	PreviousMinSize *int64           `json:"previous_min_size" db:"previous_min_size"`
+	MinSize         *int64           `json:"min_size" db:"min_size"`
+	PreviousMaxSize *int64           `json:"previous_max_size" db:"previous_max_size"`
+	MaxSize         *int64           `json:"max_size" db:"max_size"`
+	Instances       ScalingInstances `json:"instances"`
+	Processes       ScalingProcesses `json:"processes"`
+	ObservedAt      time.Time        `json:"observed_at" db:"observed_at"`
+	CreatedAt       time.Time        `json:"created_at" db:"created_at"`
+}
+
+// ScalingEventsRequest filters an autoscaling group's events. Since, when set,
+// only matches events observed at or after it. Limit defaults to 100.
+type ScalingEventsRequest struct {
+	CustomerId string     `json:"customer_id"`
+	AccountId  string     `json:"account_id"`
+	GroupName  string     `json:"group_name"`
+	Since      *time.Time `json:"since,omitempty"`
+	Limit      int        `json:"limit"`
+}
+
+type ScalingEventsResponse struct {
+	Events []*ScalingEvent `json:"events"`
+}
+
+// NewAutoScalingCapacity reads the capacity of an autoscaling group from its
+// stored data.
+func NewAutoScalingCapacity(data []byte) (*AutoScalingCapacity, error) {
+	group := &opsee_aws_autoscaling.Group{}
+	if err := json.Unmarshal(data, group); err != nil {
+		return nil, err
+	}
+
+	capacity := &AutoScalingCapacity{
+		DesiredCapacity:    group.DesiredCapacity,
+		MinSize:            group.MinSize,
+		MaxSize:            group.MaxSize,
+		Instances:          make(ScalingInstances, 0, len(group.Instances)),
+		SuspendedProcesses: make(ScalingProcesses, 0, len(group.SuspendedProcesses)),
+	}
+
+	for _, instance := range group.Instances {
+		if instance.InstanceId == nil {
+			continue
+		}
+
+		capacity.Instances = append(capacity.Instances, &ScalingInstance{
+			InstanceId:       aws.StringValue(instance.InstanceId),
+			LifecycleState:   aws.StringValue(instance.LifecycleState),
+			HealthStatus:     aws.StringValue(instance.HealthStatus),
+			AvailabilityZone: aws.StringValue(instance.AvailabilityZone),
+		})
+	}
+
+	for _, process := range group.SuspendedProcesses {
+		if process.ProcessName != nil {
+			capacity.SuspendedProcesses = append(capacity.SuspendedProcesses, *process.ProcessName)
+		}
+	}
+
+	return capacity, nil
+}
+
+// recordScalingEvents stores the events between an autoscaling group's stored
+// version and group, which is about to replace it in the same transaction.
+// The stored row is locked until then, so concurrent writes of the group
+// compare against each other's versions in turn. Versions observed before
+// the stored one are stale, so aren't compared, and a group seen for the
+// first time has nothing to compare against.
+func recordScalingEvents(q sqlx.Ext, group *Group) error {
+	previous := &Group{}
+	err := sqlx.Get(q, previous, "select * from groups where customer_id = $1 and account_id = $2 and type = $3 and name = $4 for update", group.CustomerId, group.AccountId, group.Type, group.Name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if previous.SourceTimestamp != nil && group.SourceTimestamp != nil && group.SourceTimestamp.Before(*previous.SourceTimestamp) {
+		return nil
+	}
+
+	if previous.ContentHash == contentHash(group.Data) {
+		return nil
+	}
+
+	before, err := NewAutoScalingCapacity(previous.Data)
+	if err != nil {
+		return err
+	}
+
+	// a group stored without its capacity has nothing to compare against.
+	if before.DesiredCapacity == nil {
+		return nil
+	}
+
+	after, err := NewAutoScalingCapacity(group.Data)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range scalingEvents(before, after) {
+		_, err := q.Exec("insert into scaling_events (customer_id, account_id, group_name, kind, previous_desired, desired, previous_min_size, min_size, previous_max_size, max_size, instances, processes, observed_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, coalesce(cast($13 as timestamptz), now()))", group.CustomerId, group.AccountId, group.Name, event.Kind, event.PreviousDesired, event.Desired, event.PreviousMinSize, event.MinSize, event.PreviousMaxSize, event.MaxSize, event.Instances, event.Processes, group.SourceTimestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scalingEvents compares two versions of an autoscaling group. Instances that
+// leave with a scale-in, or join with a scale-out, belong to it; launches
+// alongside an unhealthy replacement are the replacements.
+func scalingEvents(before, after *AutoScalingCapacity) []*ScalingEvent {
+	previous := make(map[string]*ScalingInstance, len(before.Instances))
+	for _, instance := range before.Instances {
+		previous[instance.InstanceId] = instance
+	}
+
+	current := make(map[string]*ScalingInstance, len(after.Instances))
+	var launched, unhealthy ScalingInstances
+	for _, instance := range after.Instances {
+		current[instance.InstanceId] = instance
+
+		p, ok := previous[instance.InstanceId]
+		if !ok {
+			launched = append(launched, instance.changed(launchedChange))
+		} else if !isUnhealthy(p) && isUnhealthy(instance) {
+			unhealthy = append(unhealthy, instance.changed(unhealthyChange))
+		}
+	}
+
+	var replaced, removed, lost ScalingInstances
+	for _, instance := range before.Instances {
+		if _, ok := current[instance.InstanceId]; ok {
+			continue
+		}
+
+		switch terminated := instance.changed(terminatedChange); {
+		case isUnhealthy(instance):
+			replaced = append(replaced, terminated)
+		case isLeaving(instance):
+			removed = append(removed, terminated)
+		default:
+			lost = append(lost, terminated)
+		}
+	}
+
+	events := make([]*ScalingEvent, 0)
+	add := func(kind string, instances ScalingInstances, processes ScalingProcesses) {
+		if instances == nil {
+			instances = ScalingInstances{}
+		}
+		if processes == nil {
+			processes = ScalingProcesses{}
+		}
+
+		events = append(events, &ScalingEvent{
+			Kind:            kind,
+			PreviousDesired: before.DesiredCapacity,
+			Desired:         after.DesiredCapacity,
+			PreviousMinSize: before.MinSize,
+			MinSize:         after.MinSize,
+			PreviousMaxSize: before.MaxSize,
+			MaxSize:         after.MaxSize,
+			Instances:       instances,
+			Processes:       processes,
+		})
+	}
+
+	desired, previousDesired := aws.Int64Value(after.DesiredCapacity), aws.Int64Value(before.DesiredCapacity)
+	switch {
+	case desired > previousDesired:
+		add(ScaleOutEvent, launched, nil)
+		launched = nil
+	case desired < previousDesired:
+		add(ScaleInEvent, append(removed, lost...), nil)
+		removed, lost = nil, nil
+	}
+
+	if aws.Int64Value(before.MinSize) != aws.Int64Value(after.MinSize) || aws.Int64Value(before.MaxSize) != aws.Int64Value(after.MaxSize) {
+		add(CapacityChangeEvent, nil, nil)
+	}
+
+	if len(replaced) > 0 {
+		add(UnhealthyReplacementEvent, append(replaced, launched...), nil)
+		launched = nil
+	}
+
+	for _, e := range []struct {
+		kind      string
+		instances ScalingInstances
+	}{
+		{InstanceRemovedEvent, removed},
+		{InstanceLostEvent, lost},
+		{InstanceLaunchedEvent, launched},
+		{InstanceUnhealthyEvent, unhealthy},
+	} {
+		if len(e.instances) > 0 {
+			add(e.kind, e.instances, nil)
+		}
+	}
+
+	if suspended := missingFrom(after.SuspendedProcesses, before.SuspendedProcesses); len(suspended) > 0 {
+		add(ProcessesSuspendedEvent, nil, suspended)
+	}
+
+	if resumed := missingFrom(before.SuspendedProcesses, after.SuspendedProcesses); len(resumed) > 0 {
+		add(ProcessesResumedEvent, nil, resumed)
+	}
+
+	return events
+}
+
+func (i *ScalingInstance) changed(change string) *ScalingInstance {
+	instance := *i
+	instance.Change = change
+	return &instance
+}
+
+func isUnhealthy(instance *ScalingInstance) bool {
+	return strings.EqualFold(instance.HealthStatus, "Unhealthy")
+}
+
+// isLeaving is true of instances the group is already terminating or
+// detaching.
+func isLeaving(instance *ScalingInstance) bool {
+	return strings.HasPrefix(instance.LifecycleState, "Terminat") || strings.HasPrefix(instance.LifecycleState, "Detach")
+}
+
+// missingFrom returns the processes of a that aren't in b.
+func missingFrom(a, b ScalingProcesses) ScalingProcesses {
+	in := make(map[string]bool, len(b))
+	for _, process := range b {
+		in[process] = true
+	}
+
+	var missing ScalingProcesses
+	for _, process := range a {
+		if !in[process] {
+			missing = append(missing, process)
+		}
+	}
+
+	return missing
+}
+
+// Value sends the instances as text, since the driver would otherwise send
+// them as bytea.
+func (s ScalingInstances) Value() (driver.Value, error) {
+	if s == nil {
+		s = ScalingInstances{}
+	}
+	return jsonValue(s)
+}
+
+func (s *ScalingInstances) Scan(src interface{}) error {
+	return scanJSON(src, s)
+}
+
+func (s ScalingProcesses) Value() (driver.Value, error) {
+	if s == nil {
+		s = ScalingProcesses{}
+	}
+	return jsonValue(s)
+}
+
+func (s *ScalingProcesses) Scan(src interface{}) error {
+	return scanJSON(src, s)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func scanJSON(src interface{}, dest interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		return json.Unmarshal(s, dest)
+	case string:
+		return json.Unmarshal([]byte(s), dest)
+	default:
+		return fmt.Errorf("can't scan %T as json", src)
+	}
+}
+
+// groupCapacity returns the capacity of autoscaling groups, and nil for
+// other groups.
+func groupCapacity(group *Group) (*AutoScalingCapacity, error) {
+	if group.Type != AutoScalingGroupStoreType {
+		return nil, nil
+	}
+
+	return NewAutoScalingCapacity(group.Data)
+}
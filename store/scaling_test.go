@@ -0,0 +1,78 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// scalingVersions reads versions of the same autoscaling group, as it would
+// be described at successive syncs.
+func scalingVersions(t *testing.T) map[string]*AutoScalingCapacity {
+	b, err := ioutil.ReadFile("testdata/scaling-groups.json")
+	require.NoError(t, err)
+
+	groups := make(map[string]json.RawMessage)
+	require.NoError(t, json.Unmarshal(b, &groups))
+
+	versions := make(map[string]*AutoScalingCapacity, len(groups))
+	for name, data := range groups {
+		versions[name], err = NewAutoScalingCapacity(data)
+		require.NoError(t, err, name)
+	}
+
+	return versions
+}
+
+// describeEvent summarizes an event as its kind followed by its instances'
+// changes and its processes, e.g. "scale-out i-123/launched".
+func describeEvent(event *ScalingEvent) string {
+	fields := []string{event.Kind}
+	for _, instance := range event.Instances {
+		fields = append(fields, instance.InstanceId+"/"+instance.Change)
+	}
+
+	return strings.Join(append(fields, event.Processes...), " ")
+}
+
+func TestScalingEvents(t *testing.T) {
+	versions := scalingVersions(t)
+
+	tests := []struct {
+		name          string
+		before, after string
+		events        []string
+	}{
+		{"unchanged", "steady", "steady", []string{}},
+		{"scale-out", "steady", "scaled-out", []string{"scale-out i-2c3d4e5f/launched"}},
+		{"scale-in", "scaled-out", "steady", []string{"scale-in i-2c3d4e5f/terminated"}},
+		{"scale-in before the instance leaves", "scaled-out", "scaling-in", []string{"scale-in"}},
+		{"instance removed after a scale-in", "scaling-in", "steady", []string{"instance-removed i-2c3d4e5f/terminated"}},
+		{"instance turns unhealthy", "steady", "unhealthy", []string{"instance-unhealthy i-1b2c3d4e/unhealthy"}},
+		{"unhealthy replacement", "unhealthy", "replaced", []string{"unhealthy-replacement i-1b2c3d4e/terminated i-3d4e5f60/launched"}},
+		{"healthy instance lost", "steady", "replaced", []string{"instance-lost i-1b2c3d4e/terminated", "instance-launched i-3d4e5f60/launched"}},
+		{"min and max change", "steady", "resized", []string{"capacity-change"}},
+		{"processes suspended", "steady", "suspended", []string{"processes-suspended AZRebalance Launch"}},
+		{"processes resumed", "suspended", "steady", []string{"processes-resumed AZRebalance Launch"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, after := versions[test.before], versions[test.after]
+			require.NotNil(t, before, test.before)
+			require.NotNil(t, after, test.after)
+
+			events := make([]string, 0)
+			for _, event := range scalingEvents(before, after) {
+				assert.Equal(t, before.DesiredCapacity, event.PreviousDesired, "%s previous desired", event.Kind)
+				assert.Equal(t, after.DesiredCapacity, event.Desired, "%s desired", event.Kind)
+				events = append(events, describeEvent(event))
+			}
+
+			assert.Equal(t, test.events, events)
+		})
+	}
+}
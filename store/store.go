@@ -15,7 +15,10 @@ import (
 
 type Store interface {
 	Start()
+	Stop()
+	Close() error
 	PutEntity(interface{}) (*EntityResponse, error)
+	PutEntities([]interface{}) (*EntitiesResponse, error)
 	GetInstance(*InstanceRequest) (*InstanceResponse, error)
 	ListInstances(*InstancesRequest) (*InstancesResponse, error)
 	CountInstances(*InstancesRequest) (*CountResponse, error)
@@ -23,49 +26,237 @@ type Store interface {
 	GetCustomer(*CustomerRequest) (*CustomerResponse, error)
 	ListGroups(*GroupsRequest) (*GroupsResponse, error)
 	CountGroups(*GroupsRequest) (*CountResponse, error)
+	ListGroupLinks(*GroupsRequest) (*GroupLinksResponse, error)
+	ListSubnets(*NetworkRequest) (*SubnetsResponse, error)
+	ListRouteTables(*NetworkRequest) (*RouteTablesResponse, error)
+	ListAccounts(*AccountsRequest) (*AccountsResponse, error)
+	PreviewExpiry(*ExpiryRequest) (*ExpiryPreviewResponse, error)
+	PutExpiryTTLs(*ExpiryTTLsRequest) (*ExpiryTTLsResponse, error)
+	PutDeadLetter(*DeadLetter) (*DeadLetter, error)
+	GetDeadLetter(*DeadLetterRequest) (*DeadLetter, error)
+	ListDeadLetters(*DeadLettersRequest) (*DeadLettersResponse, error)
+	DeleteDeadLetter(*DeadLetterRequest) error
+	PurgeDeadLetters(*DeadLettersRequest) (*CountResponse, error)
+	PutSuggestionDismissal(*SuggestionDismissal) (*SuggestionDismissal, error)
+	ListSuggestionDismissals(*SuggestionDismissalsRequest) (*SuggestionDismissalsResponse, error)
+	DeleteSuggestionDismissal(*SuggestionDismissalRequest) error
+	ListScalingEvents(*ScalingEventsRequest) (*ScalingEventsResponse, error)
+	ClaimQueuedEvents(limit int, lease time.Duration) ([]*QueuedEvent, error)
+	FinishQueuedEvent(id int64) error
+	RequeueQueuedEvent(id int64, delay time.Duration) error
 }
 
+// InstanceRequest gets an instance by its type and id. Without AccountId it
+// must be in only one of the customer's accounts, otherwise getting it fails
+// with ErrAmbiguousAccount. GroupRequest does the same for groups.
 type InstanceRequest struct {
-	CustomerId string `json:"customer_id"`
-	InstanceId string `json:"instance_id"`
-	Type       string `json:"type"`
+	CustomerId     string `json:"customer_id"`
+	AccountId      string `json:"account_id"`
+	InstanceId     string `json:"instance_id"`
+	Type           string `json:"type"`
+	IncludeDeleted bool   `json:"include_deleted"`
 }
 
+// InstancesRequest filters instances. ChangedSince matches instances whose
+// content changed at or after it, and SeenSince those reported at or after
+// it, changed or not. EndpointAddress matches rds instances by their
+// endpoint's hostname, ignoring case.
 type InstancesRequest struct {
-	CustomerId string `json:"customer_id"`
-	GroupId    string `json:"group_id"`
-	Type       string `json:"type"`
+	CustomerId      string     `json:"customer_id"`
+	AccountId       string     `json:"account_id"`
+	GroupId         string     `json:"group_id"`
+	GroupType       string     `json:"group_type"`
+	Type            string     `json:"type"`
+	EndpointAddress string     `json:"endpoint_address"`
+	IncludeDeleted  bool       `json:"include_deleted"`
+	ChangedSince    *time.Time `json:"changed_since,omitempty"`
+	SeenSince       *time.Time `json:"seen_since,omitempty"`
 }
 
 type GroupRequest struct {
-	CustomerId string `json:"customer_id"`
-	GroupId    string `json:"group_id"`
-	Type       string `json:"type"`
+	CustomerId     string `json:"customer_id"`
+	AccountId      string `json:"account_id"`
+	GroupId        string `json:"group_id"`
+	Type           string `json:"type"`
+	IncludeDeleted bool   `json:"include_deleted"`
 }
 
+// GroupsRequest filters groups like InstancesRequest filters instances.
 type GroupsRequest struct {
+	CustomerId     string     `json:"customer_id"`
+	AccountId      string     `json:"account_id"`
+	Type           string     `json:"type"`
+	IncludeDeleted bool       `json:"include_deleted"`
+	ChangedSince   *time.Time `json:"changed_since,omitempty"`
+	SeenSince      *time.Time `json:"seen_since,omitempty"`
+}
+
+// NetworkRequest filters subnets and route tables. GroupId and GroupType
+// limit subnets to those linked to a group, such as an rds subnet group.
+type NetworkRequest struct {
+	CustomerId     string `json:"customer_id"`
+	AccountId      string `json:"account_id"`
+	GroupId        string `json:"group_id"`
+	GroupType      string `json:"group_type"`
+	IncludeDeleted bool   `json:"include_deleted"`
+}
+
+type AccountsRequest struct {
 	CustomerId string `json:"customer_id"`
-	Type       string `json:"type"`
 }
 
+type ExpiryRequest struct {
+	CustomerId string `json:"customer_id"`
+}
+
+// ExpiryTTLsRequest sets a customer's TTL overrides, in seconds, keyed by
+// entity type. A TTL of zero removes the override.
+type ExpiryTTLsRequest struct {
+	CustomerId string           `json:"customer_id"`
+	TTLs       map[string]int64 `json:"ttls"`
+}
+
+type DeadLetterRequest struct {
+	Id int64 `json:"id"`
+}
+
+// DeadLettersRequest filters dead letters. Before, when set, only matches
+// letters first captured before it. Limit only applies to listing.
+type DeadLettersRequest struct {
+	CustomerId string     `json:"customer_id"`
+	Type       string     `json:"type"`
+	Before     *time.Time `json:"before,omitempty"`
+	Limit      int        `json:"limit"`
+}
+
+type SuggestionDismissalRequest struct {
+	CustomerId string `json:"customer_id"`
+	Id         int64  `json:"id"`
+}
+
+type SuggestionDismissalsRequest struct {
+	CustomerId string `json:"customer_id"`
+}
+
+// InstanceResponse carries an instance with the times its content last
+// changed and it was last reported, which its raw data doesn't include.
 type InstanceResponse struct {
-	Instance *Instance `json:"instance"`
+	Id         string     `json:"id"`
+	Instance   *Instance  `json:"instance"`
+	AccountId  string     `json:"account_id"`
+	Type       string     `json:"type"`
+	ChangedAt  time.Time  `json:"changed_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
 }
 
 type InstancesResponse struct {
 	Instances []*InstanceResponse `json:"instances"`
 }
 
+// GroupResponse carries a group with its instances and subnets. Capacity is
+// only set for autoscaling groups.
 type GroupResponse struct {
-	Group         *Group              `json:"group"`
-	Instances     []*InstanceResponse `json:"instances,omitempty"`
-	InstanceCount int                 `json:"instance_count"`
+	Id            string               `json:"id"`
+	Group         *Group               `json:"group"`
+	AccountId     string               `json:"account_id"`
+	Type          string               `json:"type"`
+	ChangedAt     time.Time            `json:"changed_at"`
+	LastSeenAt    time.Time            `json:"last_seen_at"`
+	DeletedAt     *time.Time           `json:"deleted_at,omitempty"`
+	Instances     []*InstanceResponse  `json:"instances,omitempty"`
+	InstanceCount int                  `json:"instance_count"`
+	Subnets       []*Subnet            `json:"subnets,omitempty"`
+	Capacity      *AutoScalingCapacity `json:"capacity,omitempty"`
 }
 
 type GroupsResponse struct {
 	Groups []*GroupResponse `json:"groups"`
 }
 
+type GroupLinksResponse struct {
+	Links []*GroupLink `json:"links"`
+}
+
+type SubnetsResponse struct {
+	Subnets []*Subnet `json:"subnets"`
+}
+
+type RouteTablesResponse struct {
+	RouteTables []*RouteTable `json:"route_tables"`
+}
+
+type AccountsResponse struct {
+	Accounts []*Account `json:"accounts"`
+}
+
+// ExpiryTTLsResponse holds a customer's effective TTLs in seconds, keyed by
+// entity type.
+type ExpiryTTLsResponse struct {
+	TTLs map[string]int64 `json:"ttls"`
+}
+
+type ExpiryPreviewResponse struct {
+	TTLs     map[string]int64 `json:"ttls"`
+	Entities []*ExpiredEntity `json:"entities"`
+}
+
+// ExpiredEntity is an entity the next expiry sweep would remove.
+type ExpiredEntity struct {
+	AccountId  string    `json:"account_id" db:"account_id"`
+	Type       string    `json:"type" db:"-"`
+	Id         string    `json:"id"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []*DeadLetter `json:"dead_letters"`
+}
+
+type SuggestionDismissalsResponse struct {
+	Dismissals []*SuggestionDismissal `json:"dismissals"`
+}
+
+// DeadLetter is a discovery event that couldn't be stored, kept with the
+// last error so it can be replayed once the cause is fixed.
+type DeadLetter struct {
+	Id         int64     `json:"id"`
+	CustomerId string    `json:"customer_id" db:"customer_id"`
+	AccountId  string    `json:"account_id" db:"account_id"`
+	Type       string    `json:"type"`
+	Source     string    `json:"source"`
+	Body       string    `json:"body"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// SuggestionDismissal records that a customer doesn't want a check on a
+// target's protocol, port and path suggested again. The target is in
+// AccountId, since the same names are used across accounts.
+type SuggestionDismissal struct {
+	Id         int64     `json:"id"`
+	CustomerId string    `json:"customer_id" db:"customer_id"`
+	AccountId  string    `json:"account_id" db:"account_id"`
+	TargetType string    `json:"target_type" db:"target_type"`
+	TargetId   string    `json:"target_id" db:"target_id"`
+	Protocol   string    `json:"protocol"`
+	Port       int64     `json:"port"`
+	Path       string    `json:"path"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// QueuedEvent is a discovery event in the postgres event queue, for installs
+// without nsq. It's delivered once AvailableAt has passed.
+type QueuedEvent struct {
+	Id          int64     `json:"id"`
+	Body        string    `json:"body"`
+	Attempts    int       `json:"attempts"`
+	AvailableAt time.Time `json:"available_at" db:"available_at"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
 type CustomerRequest struct {
 	Id string `json:"id"`
 }
@@ -78,6 +269,13 @@ type EntityResponse struct {
 	Entity interface{} `json:"entity"`
 }
 
+// EntitiesResponse counts the entities of a batch that were written and
+// those dropped as stale, including versions superseded within the batch.
+type EntitiesResponse struct {
+	Stored int `json:"stored"`
+	Stale  int `json:"stale"`
+}
+
 type CountResponse struct {
 	Count int `json:"count"`
 }
@@ -89,41 +287,119 @@ type Customer struct {
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
 }
 
-type Instance struct {
+// Account is an AWS account linked to a customer. Entities discovered before
+// accounts were tracked belong to the account with an empty id.
+type Account struct {
 	Id         string    `json:"id"`
 	CustomerId string    `json:"customer_id" db:"customer_id"`
-	Type       string    `json:"type"`
-	Data       []byte    `json:"data"`
-	Groups     []*Group  `json:"-" db:""`
+	LastSync   time.Time `json:"last_sync" db:"last_sync"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// Instance is a stored instance. EndpointAddress and EndpointPort are where
+// rds instances accept connections, taken from their data.
+type Instance struct {
+	Id              string     `json:"id"`
+	CustomerId      string     `json:"customer_id" db:"customer_id"`
+	AccountId       string     `json:"account_id" db:"account_id"`
+	Type            string     `json:"type"`
+	Data            []byte     `json:"data"`
+	EndpointAddress *string    `json:"endpoint_address,omitempty" db:"endpoint_address"`
+	EndpointPort    *int64     `json:"endpoint_port,omitempty" db:"endpoint_port"`
+	Groups          []*Group   `json:"-" db:""`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+	ContentHash     string     `json:"-" db:"content_hash"`
+	ChangedAt       time.Time  `json:"changed_at" db:"changed_at"`
+	LastSeenAt      time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	SourceTimestamp *time.Time `json:"source_timestamp,omitempty" db:"source_timestamp"`
+}
+
+// Group is a stored group. Subnets are the ids of the subnets of rds subnet
+// groups, which are linked to them.
 type Group struct {
-	Name          string      `json:"name"`
-	CustomerId    string      `json:"customer_id" db:"customer_id"`
-	Type          string      `json:"type"`
-	Data          []byte      `json:"data"`
-	InstanceCount int         `json:"instance_count" db:"instance_count"`
-	Instances     []*Instance `json:"-" db:""`
-	CreatedAt     time.Time   `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time   `json:"updated_at" db:"updated_at"`
+	Name            string      `json:"name"`
+	CustomerId      string      `json:"customer_id" db:"customer_id"`
+	AccountId       string      `json:"account_id" db:"account_id"`
+	Type            string      `json:"type"`
+	Data            []byte      `json:"data"`
+	InstanceCount   int         `json:"instance_count" db:"instance_count"`
+	Instances       []*Instance `json:"-" db:""`
+	Subnets         []string    `json:"-" db:""`
+	CreatedAt       time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at" db:"updated_at"`
+	ContentHash     string      `json:"-" db:"content_hash"`
+	ChangedAt       time.Time   `json:"changed_at" db:"changed_at"`
+	LastSeenAt      time.Time   `json:"last_seen_at" db:"last_seen_at"`
+	DeletedAt       *time.Time  `json:"deleted_at,omitempty" db:"deleted_at"`
+	SourceTimestamp *time.Time  `json:"source_timestamp,omitempty" db:"source_timestamp"`
 }
 
 type RouteTable struct {
-	Id         string    `json:"id"`
-	CustomerId string    `json:"customer_id" db:"customer_id"`
-	Data       []byte    `json:"data"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+	Id              string     `json:"id"`
+	CustomerId      string     `json:"customer_id" db:"customer_id"`
+	AccountId       string     `json:"account_id" db:"account_id"`
+	Data            []byte     `json:"data"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+	ContentHash     string     `json:"-" db:"content_hash"`
+	ChangedAt       time.Time  `json:"changed_at" db:"changed_at"`
+	LastSeenAt      time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	SourceTimestamp *time.Time `json:"source_timestamp,omitempty" db:"source_timestamp"`
 }
 
 type Subnet struct {
-	Id         string    `json:"id"`
-	CustomerId string    `json:"customer_id" db:"customer_id"`
-	Data       []byte    `json:"data"`
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+	Id              string     `json:"id"`
+	CustomerId      string     `json:"customer_id" db:"customer_id"`
+	AccountId       string     `json:"account_id" db:"account_id"`
+	Data            []byte     `json:"data"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at" db:"updated_at"`
+	ContentHash     string     `json:"-" db:"content_hash"`
+	ChangedAt       time.Time  `json:"changed_at" db:"changed_at"`
+	LastSeenAt      time.Time  `json:"last_seen_at" db:"last_seen_at"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	SourceTimestamp *time.Time `json:"source_timestamp,omitempty" db:"source_timestamp"`
+}
+
+// DBSecurityGroup is an ec2-classic rds security group, as described by
+// DescribeDBSecurityGroups. The aws schema doesn't include one.
+type DBSecurityGroup struct {
+	DBSecurityGroupName        *string               `json:"DBSecurityGroupName,omitempty"`
+	DBSecurityGroupDescription *string               `json:"DBSecurityGroupDescription,omitempty"`
+	DBSecurityGroupArn         *string               `json:"DBSecurityGroupArn,omitempty"`
+	OwnerId                    *string               `json:"OwnerId,omitempty"`
+	VpcId                      *string               `json:"VpcId,omitempty"`
+	EC2SecurityGroups          []*DBEC2SecurityGroup `json:"EC2SecurityGroups,omitempty"`
+	IPRanges                   []*DBIPRange          `json:"IPRanges,omitempty"`
+}
+
+// DBEC2SecurityGroup is an ec2 security group allowed in by a db security
+// group.
+type DBEC2SecurityGroup struct {
+	EC2SecurityGroupId      *string `json:"EC2SecurityGroupId,omitempty"`
+	EC2SecurityGroupName    *string `json:"EC2SecurityGroupName,omitempty"`
+	EC2SecurityGroupOwnerId *string `json:"EC2SecurityGroupOwnerId,omitempty"`
+	Status                  *string `json:"Status,omitempty"`
+}
+
+// DBIPRange is a cidr allowed in by a db security group.
+type DBIPRange struct {
+	CIDRIP *string `json:"CIDRIP,omitempty"`
+	Status *string `json:"Status,omitempty"`
+}
+
+// GroupLink is an instance's membership of a group, such as a security group
+// applied to it or a load balancer it's registered with.
+type GroupLink struct {
+	AccountId    string `json:"account_id" db:"account_id"`
+	GroupType    string `json:"group_type" db:"group_type"`
+	GroupName    string `json:"group_name" db:"group_name"`
+	InstanceType string `json:"instance_type" db:"instance_type"`
+	InstanceId   string `json:"instance_id" db:"instance_id"`
 }
 
 const (
@@ -140,8 +416,11 @@ const (
 	DBInstanceStoreType       = "rds"
 	SecurityGroupStoreType    = "security"
 	DBSecurityGroupStoreType  = "rds-security"
+	DBSubnetGroupStoreType    = "rds-subnet"
 	AutoScalingGroupStoreType = "autoscaling"
 	ELBStoreType              = "elb"
+	RouteTableStoreType       = "route-table"
+	SubnetStoreType           = "subnet"
 )
 
 var (
@@ -151,10 +430,23 @@ var (
 	ErrMissingSubnetId     = errors.New("must provide subnet id")
 	ErrMissingCustomerId   = errors.New("must provide customer id")
 	ErrMissingType         = errors.New("must provide type")
+	ErrInvalidType         = errors.New("invalid type")
+	ErrInvalidTTL          = errors.New("ttl must not be negative")
 	ErrMissingBody         = errors.New("must provide body")
+	ErrMissingDeadLetterId = errors.New("must provide dead letter id")
+	ErrDeadLetterNotFound  = errors.New("dead letter not found")
+	ErrMissingTarget       = errors.New("must provide target account, type and id")
+	ErrInvalidPort         = errors.New("port must be from 1 to 65535")
+	ErrDismissalNotFound   = errors.New("suggestion dismissal not found")
+	ErrStaleEntity         = errors.New("a newer version of the entity is already stored")
+	ErrWriteConflict       = errors.New("the entity was inserted by a concurrent write")
+	ErrAmbiguousAccount    = errors.New("the entity is in more than one account, must provide account id")
 )
 
-func NewEntity(entityType, customerId string, blob []byte) (interface{}, error) {
+// NewEntity decodes an entity reported by a bastion. When the event doesn't
+// name an account, entities that carry their owner's account id are
+// attributed to it.
+func NewEntity(entityType, customerId, accountId string, blob []byte) (interface{}, error) {
 	var (
 		err    error
 		entity interface{}
@@ -166,55 +458,98 @@ func NewEntity(entityType, customerId string, blob []byte) (interface{}, error)
 		if err = json.Unmarshal(blob, instanceData); err != nil {
 			break
 		}
-		entity, err = NewInstance(customerId, instanceData)
+		entity, err = NewInstance(customerId, ownerAccount(accountId, instanceOwnerId(instanceData)), instanceData)
 
 	case DBInstanceEntityType:
 		dbInstanceData := &opsee_aws_rds.DBInstance{}
 		if err = json.Unmarshal(blob, dbInstanceData); err != nil {
 			break
 		}
-		entity, err = NewInstance(customerId, dbInstanceData)
+		entity, err = NewInstance(customerId, accountId, dbInstanceData)
 
 	case SecurityGroupEntityType:
 		secGroupData := &opsee_aws_ec2.SecurityGroup{}
 		if err = json.Unmarshal(blob, secGroupData); err != nil {
 			break
 		}
-		entity, err = NewGroup(customerId, secGroupData)
+		entity, err = NewGroup(customerId, ownerAccount(accountId, secGroupData.OwnerId), secGroupData)
+
+	case DBSecurityGroupEntityType:
+		dbSecGroupData := &DBSecurityGroup{}
+		if err = json.Unmarshal(blob, dbSecGroupData); err != nil {
+			break
+		}
+		entity, err = NewGroup(customerId, ownerAccount(accountId, dbSecGroupData.OwnerId), dbSecGroupData)
 
 	case ELBEntityType:
 		elbData := &opsee_aws_elb.LoadBalancerDescription{}
 		if err = json.Unmarshal(blob, elbData); err != nil {
 			break
 		}
-		entity, err = NewGroup(customerId, elbData)
+		entity, err = NewGroup(customerId, accountId, elbData)
 
 	case AutoScalingGroupEntityType:
 		autoscalingData := &opsee_aws_autoscaling.Group{}
 		if err = json.Unmarshal(blob, autoscalingData); err != nil {
 			break
 		}
-		entity, err = NewGroup(customerId, autoscalingData)
+		entity, err = NewGroup(customerId, accountId, autoscalingData)
 
 	case RouteTableEntityType:
 		routeTableData := &opsee_aws_ec2.RouteTable{}
 		if err = json.Unmarshal(blob, routeTableData); err != nil {
 			break
 		}
-		entity, err = NewRouteTable(customerId, routeTableData)
+		entity, err = NewRouteTable(customerId, accountId, routeTableData)
 
 	case SubnetEntityType:
 		subnetData := &opsee_aws_ec2.Subnet{}
 		if err = json.Unmarshal(blob, subnetData); err != nil {
 			break
 		}
-		entity, err = NewSubnet(customerId, subnetData)
+		entity, err = NewSubnet(customerId, accountId, subnetData)
 	}
 
 	return entity, err
 }
 
-func NewInstance(customerId string, instanceData interface{}) (*Instance, error) {
+// ownerAccount returns accountId, or when it's empty the entity's owner.
+func ownerAccount(accountId string, ownerId *string) string {
+	if accountId != "" {
+		return accountId
+	}
+
+	return aws.StringValue(ownerId)
+}
+
+// instanceOwnerId finds an ec2 instance's account. Instances are reported
+// without their reservation, so it's taken from their network interfaces.
+func instanceOwnerId(instance *opsee_aws_ec2.Instance) *string {
+	for _, iface := range instance.NetworkInterfaces {
+		if iface.OwnerId != nil && *iface.OwnerId != "" {
+			return iface.OwnerId
+		}
+	}
+
+	return nil
+}
+
+// SetSourceTimestamp records when the source observed an entity, so that a
+// version observed earlier can't overwrite it.
+func SetSourceTimestamp(entity interface{}, t time.Time) {
+	switch e := entity.(type) {
+	case *Instance:
+		e.SourceTimestamp = &t
+	case *Group:
+		e.SourceTimestamp = &t
+	case *RouteTable:
+		e.SourceTimestamp = &t
+	case *Subnet:
+		e.SourceTimestamp = &t
+	}
+}
+
+func NewInstance(customerId, accountId string, instanceData interface{}) (*Instance, error) {
 	var (
 		instance *Instance
 		groups   []*Group
@@ -234,7 +569,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 			gr := &opsee_aws_ec2.SecurityGroup{}
 			opsee_aws.CopyInto(gr, group)
 
-			g, err := NewGroup(customerId, gr)
+			g, err := NewGroup(customerId, accountId, gr)
 			if err != nil {
 				continue
 			}
@@ -245,6 +580,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 		instance = &Instance{
 			Id:         aws.StringValue(t.InstanceId),
 			CustomerId: customerId,
+			AccountId:  accountId,
 			Type:       InstanceStoreType,
 			Groups:     groups,
 			Data:       jsonD,
@@ -255,13 +591,12 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 			return nil, ErrMissingInstanceId
 		}
 
-		groups = make([]*Group, 0, len(t.VpcSecurityGroups))
+		groups = make([]*Group, 0, len(t.VpcSecurityGroups)+len(t.DBSecurityGroups)+1)
 
 		for _, group := range t.VpcSecurityGroups {
-			gr := &opsee_aws_ec2.SecurityGroup{}
-			opsee_aws.CopyInto(gr, group)
+			gr := &opsee_aws_ec2.SecurityGroup{GroupId: group.VpcSecurityGroupId}
 
-			g, err := NewGroup(customerId, gr)
+			g, err := NewGroup(customerId, accountId, gr)
 			if err != nil {
 				continue
 			}
@@ -269,14 +604,38 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 			groups = append(groups, g)
 		}
 
+		// ec2-classic instances are in db security groups instead.
+		for _, group := range t.DBSecurityGroups {
+			gr := &DBSecurityGroup{DBSecurityGroupName: group.DBSecurityGroupName}
+
+			g, err := NewGroup(customerId, accountId, gr)
+			if err != nil {
+				continue
+			}
+
+			groups = append(groups, g)
+		}
+
+		if t.DBSubnetGroup != nil {
+			if g, err := NewGroup(customerId, accountId, t.DBSubnetGroup); err == nil {
+				groups = append(groups, g)
+			}
+		}
+
 		jsonD, err = json.Marshal(t)
 		instance = &Instance{
 			Id:         aws.StringValue(t.DBInstanceIdentifier),
 			CustomerId: customerId,
+			AccountId:  accountId,
 			Type:       DBInstanceStoreType,
 			Groups:     groups,
 			Data:       jsonD,
 		}
+
+		if t.Endpoint != nil {
+			instance.EndpointAddress = t.Endpoint.Address
+			instance.EndpointPort = t.Endpoint.Port
+		}
 	default:
 		err = fmt.Errorf("unsupported instance type: %#v", t)
 	}
@@ -288,7 +647,7 @@ func NewInstance(customerId string, instanceData interface{}) (*Instance, error)
 	return instance, nil
 }
 
-func NewGroup(customerId string, groupData interface{}) (*Group, error) {
+func NewGroup(customerId, accountId string, groupData interface{}) (*Group, error) {
 	var (
 		group *Group
 		jsonD []byte
@@ -304,11 +663,48 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.GroupId),
 			Type:       SecurityGroupStoreType,
 			Data:       jsonD,
 		}
 
+	case *DBSecurityGroup:
+		if t.DBSecurityGroupName == nil {
+			return nil, ErrMissingGroupId
+		}
+
+		jsonD, err = json.Marshal(t)
+		group = &Group{
+			CustomerId: customerId,
+			AccountId:  accountId,
+			Name:       aws.StringValue(t.DBSecurityGroupName),
+			Type:       DBSecurityGroupStoreType,
+			Data:       jsonD,
+		}
+
+	case *opsee_aws_rds.DBSubnetGroup:
+		if t.DBSubnetGroupName == nil {
+			return nil, ErrMissingGroupId
+		}
+
+		subnets := make([]string, 0, len(t.Subnets))
+		for _, subnet := range t.Subnets {
+			if subnet.SubnetIdentifier != nil {
+				subnets = append(subnets, *subnet.SubnetIdentifier)
+			}
+		}
+
+		jsonD, err = json.Marshal(t)
+		group = &Group{
+			CustomerId: customerId,
+			AccountId:  accountId,
+			Name:       aws.StringValue(t.DBSubnetGroupName),
+			Type:       DBSubnetGroupStoreType,
+			Data:       jsonD,
+			Subnets:    subnets,
+		}
+
 	case *opsee_aws_elb.LoadBalancerDescription:
 		if t.LoadBalancerName == nil {
 			return nil, ErrMissingGroupId
@@ -319,7 +715,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 			inst := &opsee_aws_ec2.Instance{}
 			opsee_aws.CopyInto(inst, instance)
 
-			ii, err := NewInstance(customerId, inst)
+			ii, err := NewInstance(customerId, accountId, inst)
 			if err != nil {
 				continue
 			}
@@ -330,6 +726,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.LoadBalancerName),
 			Type:       ELBStoreType,
 			Data:       jsonD,
@@ -346,7 +743,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 			inst := &opsee_aws_ec2.Instance{}
 			opsee_aws.CopyInto(inst, instance)
 
-			ii, err := NewInstance(customerId, inst)
+			ii, err := NewInstance(customerId, accountId, inst)
 			if err != nil {
 				continue
 			}
@@ -357,6 +754,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 		jsonD, err = json.Marshal(t)
 		group = &Group{
 			CustomerId: customerId,
+			AccountId:  accountId,
 			Name:       aws.StringValue(t.AutoScalingGroupName),
 			Type:       AutoScalingGroupStoreType,
 			Data:       jsonD,
@@ -373,7 +771,7 @@ func NewGroup(customerId string, groupData interface{}) (*Group, error) {
 	return group, nil
 }
 
-func NewRouteTable(customerId string, routeTableData *opsee_aws_ec2.RouteTable) (*RouteTable, error) {
+func NewRouteTable(customerId, accountId string, routeTableData *opsee_aws_ec2.RouteTable) (*RouteTable, error) {
 	jsonD, err := json.Marshal(routeTableData)
 
 	if err != nil {
@@ -383,11 +781,12 @@ func NewRouteTable(customerId string, routeTableData *opsee_aws_ec2.RouteTable)
 	return &RouteTable{
 		Id:         aws.StringValue(routeTableData.RouteTableId),
 		CustomerId: customerId,
+		AccountId:  accountId,
 		Data:       jsonD,
 	}, nil
 }
 
-func NewSubnet(customerId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, error) {
+func NewSubnet(customerId, accountId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, error) {
 	jsonD, err := json.Marshal(subnetData)
 
 	if err != nil {
@@ -397,6 +796,7 @@ func NewSubnet(customerId string, subnetData *opsee_aws_ec2.Subnet) (*Subnet, er
 	return &Subnet{
 		Id:         aws.StringValue(subnetData.SubnetId),
 		CustomerId: customerId,
+		AccountId:  accountId,
 		Data:       jsonD,
 	}, nil
 }
@@ -408,3 +808,15 @@ func (i *Instance) MarshalJSON() ([]byte, error) {
 func (g *Group) MarshalJSON() ([]byte, error) {
 	return g.Data, nil
 }
+
+// UnmarshalJSON reads back the document written by MarshalJSON, leaving every
+// field but Data to be filled from the enclosing response.
+func (i *Instance) UnmarshalJSON(b []byte) error {
+	i.Data = append([]byte(nil), b...)
+	return nil
+}
+
+func (g *Group) UnmarshalJSON(b []byte) error {
+	g.Data = append([]byte(nil), b...)
+	return nil
+}